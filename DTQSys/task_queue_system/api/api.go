@@ -2,11 +2,15 @@ package api
 
 import (
     "context"
-    "database/sql"
     "encoding/json"
+    "errors"
+    "io"
+    "net"
     "net/http"
     "strings"
+    "sync"
     "task_queue_system/auth"
+    "task_queue_system/db"
     "task_queue_system/middleware"
     "task_queue_system/models"
     "task_queue_system/queue"
@@ -16,8 +20,7 @@ import (
     "github.com/go-playground/validator/v10"
     "github.com/google/uuid"
     "github.com/prometheus/client_golang/prometheus"
-    "github.com/rs/cors"
-    log "github.com/sirupsen/logrus"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
@@ -43,54 +46,193 @@ func init() {
 
 type Server struct {
     Queue *queue.Queue
-    DB    *sql.DB
+    Store db.Store
+    // Denylist holds revoked sessions. The default only covers this
+    // process; deployments with several instances share one in Redis.
+    Denylist auth.Denylist
+    // OIDC enables login through an OpenID Connect provider when set.
+    OIDC *auth.OIDCProvider
+    // AuditFile, when set, receives every audit event as a JSON line in
+    // addition to the store.
+    AuditFile io.Writer
+    auditMu   sync.Mutex
+    // Limiter enforces Limits, keyed by rate limit class. The default only
+    // counts the requests to this process; deployments with several
+    // instances share one in Redis. A nil Limiter disables rate limiting.
+    Limiter middleware.Limiter
+    Limits  map[string]middleware.Limit
+    // BodyLimits caps the size of request bodies in bytes, keyed by rate
+    // limit class or BodyTasks.
+    BodyLimits map[string]int64
+    // TrustedProxies are the load balancers and reverse proxies whose
+    // forwarding headers name the client. Requests from anywhere else are
+    // attributed to their peer address.
+    TrustedProxies []*net.IPNet
+    // CORS and Security configure the cross-origin and security headers.
+    CORS     middleware.CORSConfig
+    Security middleware.SecurityConfig
+    // shuttingDown is set by BeginShutdown
+    shuttingDown int32
 }
 
 var validate = validator.New()
 
-func NewServer(queue *queue.Queue, db *sql.DB) *Server {
-    return &Server{Queue: queue, DB: db}
+// idempotencyNamespace seeds the task IDs derived from Idempotency-Key headers.
+var idempotencyNamespace = uuid.MustParse("5b0c4f7e-3f1e-4c55-9a57-2a8f6f0e9d21")
+
+func NewServer(queue *queue.Queue, store db.Store) *Server {
+    return &Server{
+        Queue:      queue,
+        Store:      store,
+        Denylist:   auth.NewMemoryDenylist(),
+        Limiter:    middleware.NewMemoryLimiter(),
+        Limits:     DefaultLimits(),
+        BodyLimits: DefaultBodyLimits(),
+        CORS:       middleware.DefaultCORSConfig(),
+        Security:   middleware.DefaultSecurityConfig(),
+    }
 }
 
 func (s *Server) authMiddleware(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         authHeader := r.Header.Get("Authorization")
         if authHeader == "" {
-            http.Error(w, "Authorization header required", http.StatusUnauthorized)
+            writeError(w, r, http.StatusUnauthorized, "Authorization header required")
             return
         }
 
         tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-        claims, err := auth.ValidateToken(tokenStr)
+        if auth.IsAPIKey(tokenStr) {
+            s.apiKeyAuth(w, r, next, tokenStr)
+            return
+        }
+
+        claims, err := auth.ValidateToken(tokenStr, auth.TokenAccess)
         if err != nil {
-            http.Error(w, err.Error(), http.StatusUnauthorized)
+            writeErrorCode(w, r, http.StatusUnauthorized, CodeInvalidToken, "Invalid or expired token")
             return
         }
 
-        // Add the username to the context
+        denied, err := s.Denylist.Denied(r.Context(), claims)
+        if err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to check token")
+            return
+        }
+        if denied {
+            writeErrorCode(w, r, http.StatusUnauthorized, CodeTokenRevoked, "Token has been revoked")
+            return
+        }
+
+        // Add the username, role, organization and session to the context
+        setAuditActor(r, claims.Username, claims.Org)
         ctx := context.WithValue(r.Context(), "username", claims.Username)
+        ctx = context.WithValue(ctx, "role", claims.Role)
+        ctx = context.WithValue(ctx, "org", claims.Org)
+        ctx = context.WithValue(ctx, "session", claims.SessionID)
         next.ServeHTTP(w, r.WithContext(ctx))
     })
 }
 
+// apiKeyAuth authenticates a service account by API key. The key is looked
+// up on every request, so revocation and expiry apply at once.
+func (s *Server) apiKeyAuth(w http.ResponseWriter, r *http.Request, next http.Handler, apiKey string) {
+    key, err := auth.ValidateAPIKey(s.Store, apiKey)
+    if err == auth.ErrInvalidAPIKey {
+        writeErrorCode(w, r, http.StatusUnauthorized, CodeInvalidToken, err.Error())
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to check API key")
+        return
+    }
+
+    // Service accounts have no session; their scopes replace a role
+    setAuditActor(r, key.Account, key.Org)
+    ctx := context.WithValue(r.Context(), "username", key.Account)
+    ctx = context.WithValue(ctx, "role", auth.RoleService)
+    ctx = context.WithValue(ctx, "org", key.Org)
+    ctx = context.WithValue(ctx, "scopes", key.Scopes)
+    next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// require rejects callers whose role does not grant the permission. It runs
+// after authMiddleware.
+func require(permission string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if !can(r, permission) {
+                writeError(w, r, http.StatusForbidden, "Forbidden")
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// currentUser returns the username set by authMiddleware.
+func currentUser(r *http.Request) string {
+    username, _ := r.Context().Value("username").(string)
+    return username
+}
+
+// currentOrg returns the organization set by authMiddleware. Every task the
+// caller can reach belongs to it.
+func currentOrg(r *http.Request) string {
+    org, _ := r.Context().Value("org").(string)
+    return org
+}
+
+// can reports whether the caller's role, or for API keys its scopes, grants
+// the permission.
+func can(r *http.Request, permission string) bool {
+    if scopes, ok := r.Context().Value("scopes").([]string); ok {
+        return auth.ScopesPermit(scopes, permission)
+    }
+    role, _ := r.Context().Value("role").(string)
+    return auth.HasPermission(role, permission)
+}
+
+// visibleTask loads the task named in the URL if it belongs to the caller's
+// organization and the caller owns it or holds allPermission. Other tasks
+// are reported as not found so their IDs do not leak.
+func (s *Server) visibleTask(w http.ResponseWriter, r *http.Request, allPermission string) (*models.Task, bool) {
+    task, err := s.Store.GetTask(chi.URLParam(r, "id"))
+    if err == nil && task.Org != currentOrg(r) {
+        err = db.ErrNotFound
+    }
+    if err == nil && task.Owner != currentUser(r) && !can(r, allPermission) {
+        err = db.ErrNotFound
+    }
+    if err == db.ErrNotFound {
+        writeError(w, r, http.StatusNotFound, "Task not found")
+        return nil, false
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get task")
+        return nil, false
+    }
+    return task, true
+}
+
 func (s *Server) RegisterUser(w http.ResponseWriter, r *http.Request) {
     var creds models.Credentials
-    err := json.NewDecoder(r.Body).Decode(&creds)
-    if err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    if !decodeJSON(w, r, &creds) {
         return
     }
 
+    setAuditActor(r, creds.Username, "")
+
     // Validate credentials
-    err = validate.Struct(creds)
+    err := validate.Struct(creds)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+        validationError(w, r, err)
         return
     }
 
-    err = auth.RegisterUser(s.DB, creds.Username, creds.Password)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+    err = auth.RegisterUser(s.Store, creds.Username, creds.Password, creds.Org)
+    if err == auth.ErrOrgExists {
+        writeError(w, r, http.StatusForbidden, err.Error())
+        return
+    } else if err != nil {
+        userCreationError(w, r, err, "Failed to register user")
         return
     }
 
@@ -100,15 +242,26 @@ func (s *Server) RegisterUser(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
     var creds models.Credentials
-    err := json.NewDecoder(r.Body).Decode(&creds)
-    if err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    if !decodeJSON(w, r, &creds) {
         return
     }
 
-    accessToken, refreshToken, err := auth.AuthenticateUser(s.DB, creds.Username, creds.Password)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusUnauthorized)
+    setAuditActor(r, creds.Username, "")
+    accessToken, refreshToken, challenge, err := auth.AuthenticateUser(s.Store, creds.Username, creds.Password)
+    if err == auth.ErrInvalidCredentials {
+        writeErrorCode(w, r, http.StatusUnauthorized, CodeInvalidCredentials, err.Error())
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to log in")
+        return
+    }
+
+    // Users with two-factor authentication continue at /login/totp
+    if challenge != "" {
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "totp_required": true,
+            "challenge":     challenge,
+        })
         return
     }
 
@@ -119,24 +272,28 @@ func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) RefreshToken(w http.ResponseWriter, r *http.Request) {
-    var request map[string]string
-    err := json.NewDecoder(r.Body).Decode(&request)
-    if err != nil {
-        http.Error(w, "Invalid request payload", http.StatusBadRequest)
+    var request struct {
+        RefreshToken string `json:"refresh_token"`
+    }
+    if !decodeJSON(w, r, &request) {
         return
     }
 
-    refreshToken := request["refresh_token"]
-    claims, err := auth.ValidateToken(refreshToken)
-    if err != nil {
-        http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
-        return
+    // The audit log names the user even when the exchange fails
+    if claims, err := auth.ValidateToken(request.RefreshToken, auth.TokenRefresh); err == nil {
+        setAuditActor(r, claims.Username, claims.Org)
     }
 
-    // Generate new tokens
-    accessToken, newRefreshToken, err := auth.GenerateTokens(claims.Username)
-    if err != nil {
-        http.Error(w, "Failed to generate tokens", http.StatusInternalServerError)
+    // Rotate the refresh token; each one can be exchanged only once
+    accessToken, newRefreshToken, err := auth.RefreshTokens(s.Store, s.Denylist, request.RefreshToken)
+    if err == auth.ErrTokenReuse {
+        writeErrorCode(w, r, http.StatusUnauthorized, CodeTokenRevoked, err.Error())
+        return
+    } else if err == auth.ErrInvalidToken {
+        writeErrorCode(w, r, http.StatusUnauthorized, CodeInvalidToken, "Invalid refresh token")
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to generate tokens")
         return
     }
 
@@ -146,37 +303,105 @@ func (s *Server) RefreshToken(w http.ResponseWriter, r *http.Request) {
     })
 }
 
+// Logout ends the caller's session, including its refresh tokens.
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+    session, _ := r.Context().Value("session").(string)
+    if session == "" {
+        writeError(w, r, http.StatusBadRequest, "API keys are revoked, not logged out")
+        return
+    }
+    if err := auth.RevokeSession(s.Store, s.Denylist, session); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to log out")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
+}
+
+// JWKS publishes the public keys that verify our tokens, so other services
+// can validate them without sharing a secret.
+func (s *Server) JWKS(w http.ResponseWriter, r *http.Request) {
+    jwks := []auth.JWK{}
+    if ks := auth.Keys(); ks != nil {
+        jwks = ks.JWKS()
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Cache-Control", "public, max-age=300")
+    json.NewEncoder(w).Encode(map[string][]auth.JWK{"keys": jwks})
+}
+
 func (s *Server) CreateTask(w http.ResponseWriter, r *http.Request) {
     startTime := time.Now()
 
+    // Submissions are retried elsewhere rather than queued behind workers
+    // that are stopping
+    if s.ShuttingDown() {
+        writeErrorCode(w, r, http.StatusServiceUnavailable, CodeShuttingDown, "Server is shutting down, retry the request")
+        return
+    }
+
     var task models.Task
-    if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+    if !decodeJSON(w, r, &task) {
         return
     }
 
     // Validate task
     err := validate.Struct(task)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
+        validationError(w, r, err)
         return
     }
 
-    task.ID = uuid.New().String()
-    task.Status = "pending"
-    task.Created = time.Now()
-    task.Retries = 0
+    // API keys may be limited to some task types
+    if scopes, ok := r.Context().Value("scopes").([]string); ok {
+        taskType := task.Type
+        if taskType == "" {
+            taskType = queue.DefaultTaskType
+        }
+        if !auth.ScopesAllowType(scopes, taskType) {
+            writeError(w, r, http.StatusForbidden, "API key may not submit tasks of type "+taskType)
+            return
+        }
+    }
 
-    // Set default priority if not provided
-    if task.Priority == 0 {
-        task.Priority = 1
+    // Task IDs are assigned by the server. With an Idempotency-Key the ID is
+    // derived from the key, so a retried request returns the original task.
+    task.ID = ""
+    task.Owner = currentUser(r)
+    task.Org = currentOrg(r)
+    if key := r.Header.Get("Idempotency-Key"); key != "" {
+        task.ID = uuid.NewSHA1(idempotencyNamespace, []byte(task.Owner+"\x00"+key)).String()
     }
 
-    if err := s.Queue.Enqueue(task); err != nil {
-        http.Error(w, "Failed to enqueue task", http.StatusInternalServerError)
+    task, created, err := s.Queue.Submit(r.Context(), task)
+    var sizeErr *queue.DataSizeError
+    var quotaErr *queue.QuotaError
+    if errors.As(err, &sizeErr) {
+        writeErrorResponse(w, r, http.StatusRequestEntityTooLarge, ErrorResponse{
+            Code:    CodeDataTooLarge,
+            Message: sizeErr.Error(),
+            Details: sizeErr,
+        })
+        return
+    } else if errors.As(err, &quotaErr) {
+        writeErrorResponse(w, r, http.StatusTooManyRequests, ErrorResponse{
+            Code:    CodeQuotaExceeded,
+            Message: quotaErr.Error(),
+            Details: quotaErr,
+        })
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to enqueue task")
         return
     }
 
+    setAuditTarget(r, "id="+task.ID)
+    // A replayed Idempotency-Key gets the original task back
+    if !created {
+        json.NewEncoder(w).Encode(task)
+        return
+    }
     tasksReceived.Inc()
     duration := time.Since(startTime).Seconds()
     taskRequestDuration.Observe(duration)
@@ -185,67 +410,193 @@ func (s *Server) CreateTask(w http.ResponseWriter, r *http.Request) {
     json.NewEncoder(w).Encode(task)
 }
 
+func (s *Server) GetTask(w http.ResponseWriter, r *http.Request) {
+    task, ok := s.visibleTask(w, r, auth.PermReadAllTasks)
+    if !ok {
+        return
+    }
+
+    json.NewEncoder(w).Encode(task)
+}
+
+func (s *Server) CancelTask(w http.ResponseWriter, r *http.Request) {
+    task, ok := s.visibleTask(w, r, auth.PermManageAllTasks)
+    if !ok {
+        return
+    }
+
+    err := s.Queue.Cancel(r.Context(), task.ID)
+    if err == queue.ErrInvalidTransition {
+        writeError(w, r, http.StatusConflict, "Only pending tasks can be cancelled")
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to cancel task")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{"message": "Task cancelled"})
+}
+
+func (s *Server) RetryTask(w http.ResponseWriter, r *http.Request) {
+    task, ok := s.visibleTask(w, r, auth.PermManageAllTasks)
+    if !ok {
+        return
+    }
+
+    task, err := s.Queue.Retry(r.Context(), task.ID)
+    if err == queue.ErrInvalidTransition {
+        writeError(w, r, http.StatusConflict, "Only failed tasks can be retried")
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to retry task")
+        return
+    }
+
+    json.NewEncoder(w).Encode(task)
+}
+
+func (s *Server) GetQueues(w http.ResponseWriter, r *http.Request) {
+    depths, err := s.Queue.Depths(r.Context(), currentOrg(r))
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get queue depths")
+        return
+    }
+
+    json.NewEncoder(w).Encode(depths)
+}
+
 func (s *Server) GetActiveWorkers(w http.ResponseWriter, r *http.Request) {
-    ctx := context.Background()
-    workers, err := s.Queue.Client.HGetAll(ctx, "workers").Result()
+    workers, err := s.Queue.Workers(currentOrg(r))
     if err != nil {
-        http.Error(w, "Failed to get active workers", http.StatusInternalServerError)
+        writeError(w, r, http.StatusInternalServerError, "Failed to get active workers")
         return
     }
 
     json.NewEncoder(w).Encode(workers)
 }
 
+// TaskPage is one page of GET /tasks. NextCursor is empty on the last page.
+type TaskPage struct {
+    Tasks      []models.Task `json:"tasks"`
+    NextCursor string        `json:"next_cursor,omitempty"`
+}
+
 func (s *Server) GetTasks(w http.ResponseWriter, r *http.Request) {
-    rows, err := s.DB.Query("SELECT task_id, data, status, created, retries, priority FROM tasks")
+    filter, err := parseTaskFilter(r)
     if err != nil {
-        http.Error(w, "Failed to get tasks", http.StatusInternalServerError)
+        writeError(w, r, http.StatusBadRequest, err.Error())
         return
     }
-    defer rows.Close()
 
-    var tasks []models.Task
-    for rows.Next() {
-        var task models.Task
-        err := rows.Scan(&task.ID, &task.Data, &task.Status, &task.Created, &task.Retries, &task.Priority)
-        if err != nil {
-            http.Error(w, "Failed to parse tasks", http.StatusInternalServerError)
+    // Without tasks:read_all the listing is limited to the caller's tasks
+    if !can(r, auth.PermReadAllTasks) {
+        if filter.Owner != "" && filter.Owner != currentUser(r) {
+            writeError(w, r, http.StatusForbidden, "Cannot list other users' tasks")
             return
         }
-        tasks = append(tasks, task)
+        filter.Owner = currentUser(r)
+    }
+    filter.Org = currentOrg(r)
+
+    // Fetch one extra row to learn whether another page follows
+    pageSize := filter.Limit
+    filter.Limit++
+    tasks, err := s.Store.ListTasks(filter)
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get tasks")
+        return
+    }
+
+    page := TaskPage{Tasks: tasks}
+    if len(tasks) > pageSize {
+        page.Tasks = tasks[:pageSize]
+        page.NextCursor = encodeCursor(filter, filter.CursorFor(page.Tasks[pageSize-1]))
+    }
+    if page.Tasks == nil {
+        page.Tasks = []models.Task{}
     }
 
-    json.NewEncoder(w).Encode(tasks)
+    json.NewEncoder(w).Encode(page)
 }
 
 func (s *Server) Routes() http.Handler {
     r := chi.NewRouter()
 
     // Apply global middleware
-    r.Use(middleware.RateLimiter)
-    r.Use(middleware.SecurityHeaders)
-
-    // CORS configuration
-    c := cors.New(cors.Options{
-        AllowedOrigins:   []string{"*"}, // Adjust as needed
-        AllowedMethods:   []string{"GET", "POST"},
-        AllowCredentials: true,
-    })
+    r.Use(middleware.RealIP(s.TrustedProxies))
+    r.Use(middleware.AssignRequestID)
+    r.Use(accessLog)
+    r.Use(recoverPanics)
+    r.Use(s.rateLimit(LimitIP))
+    r.Use(middleware.SecurityHeaders(s.Security))
+    r.Use(s.auditLog)
+    r.NotFound(notFound)
+    r.MethodNotAllowed(methodNotAllowed)
 
     // Public endpoints
-    r.Post("/register", s.RegisterUser)
-    r.Post("/login", s.Login)
-    r.Post("/refresh", s.RefreshToken)
-    r.Handle("/metrics", prometheus.Handler())
+    r.Group(func(r chi.Router) {
+        r.Use(s.rateLimit(LimitAuth))
+        r.Use(s.bodyLimit(LimitAuth))
+        r.Post("/register", s.RegisterUser)
+        r.Post("/login", s.Login)
+        r.Post("/login/totp", s.LoginTOTP)
+        r.Post("/refresh", s.RefreshToken)
+        if s.OIDC != nil {
+            r.Get("/oidc/login", s.OIDCLogin)
+            r.Get("/oidc/callback", s.OIDCCallback)
+        }
+    })
+    r.Group(func(r chi.Router) {
+        r.Use(s.rateLimit(LimitAPI))
+        r.Get("/.well-known/jwks.json", s.JWKS)
+        r.Handle("/metrics", promhttp.Handler())
+    })
 
-    // Protected endpoints
+    // Protected endpoints, limited per account
+    r.Group(func(r chi.Router) {
+        r.Use(s.authMiddleware)
+        r.Use(s.rateLimit(LimitAPI))
+        r.Use(s.bodyLimit(LimitAPI))
+        r.Post("/logout", s.Logout)
+        r.Put("/me/password", s.ChangePassword)
+        r.Post("/me/totp", s.BeginTOTPEnrollment)
+        r.Post("/me/totp/confirm", s.ConfirmTOTPEnrollment)
+        r.Delete("/me/totp", s.DisableTOTP)
+        r.Get("/me/quota", s.GetMyQuota)
+        r.With(s.bodyLimit(BodyTasks), require(auth.PermSubmitTasks)).Post("/tasks", s.CreateTask)
+        r.With(require(auth.PermReadTasks)).Get("/tasks", s.GetTasks)
+        r.With(require(auth.PermReadTasks)).Get("/tasks/{id}", s.GetTask)
+        r.With(require(auth.PermManageTasks)).Post("/tasks/{id}/cancel", s.CancelTask)
+        r.With(require(auth.PermManageTasks)).Post("/tasks/{id}/retry", s.RetryTask)
+        r.With(require(auth.PermReadSystem)).Get("/queues", s.GetQueues)
+        r.With(require(auth.PermReadSystem)).Get("/workers", s.GetActiveWorkers)
+
+        r.With(require(auth.PermManageUsers)).Get("/users", s.GetUsers)
+        r.With(require(auth.PermManageUsers)).Post("/users", s.CreateUser)
+        r.With(require(auth.PermManageUsers)).Put("/users/{username}/role", s.SetUserRole)
+        r.With(require(auth.PermManageUsers)).Delete("/users/{username}/sessions", s.RevokeSessions)
+        r.With(require(auth.PermManageUsers)).Put("/users/{username}/password", s.ResetPassword)
+        r.With(require(auth.PermManageUsers)).Put("/users/{username}/disabled", s.SetUserDisabled)
+        r.With(require(auth.PermManageUsers)).Delete("/users/{username}/totp", s.ResetTOTP)
+        r.With(require(auth.PermManageUsers)).Get("/service-accounts", s.GetServiceAccounts)
+        r.With(require(auth.PermManageUsers)).Post("/service-accounts", s.CreateServiceAccount)
+        r.With(require(auth.PermManageUsers)).Get("/service-accounts/{name}/keys", s.GetAPIKeys)
+        r.With(require(auth.PermManageUsers)).Post("/service-accounts/{name}/keys", s.CreateAPIKey)
+        r.With(require(auth.PermManageUsers)).Put("/service-accounts/{name}/keys/{id}", s.SetAPIKeyExpiry)
+        r.With(require(auth.PermManageUsers)).Delete("/service-accounts/{name}/keys/{id}", s.RevokeAPIKey)
+
+        r.With(require(auth.PermManageOrgs)).Get("/orgs/{org}/quota", s.GetOrgQuota)
+        r.With(require(auth.PermManageOrgs)).Put("/orgs/{org}/quota", s.SetOrgQuota)
+
+        r.With(require(auth.PermReadAudit)).Get("/audit", s.GetAuditEvents)
+    })
     r.Group(func(r chi.Router) {
         r.Use(s.authMiddleware)
-        r.Post("/tasks", s.CreateTask)
-        r.Get("/tasks", s.GetTasks)
-        r.Get("/workers", s.GetActiveWorkers)
+        r.Use(s.rateLimit(LimitWorker))
+        r.Use(s.bodyLimit(LimitWorker))
+        r.With(skipAudit, require(auth.PermProcessTasks)).Post("/worker/dequeue", s.DequeueTask)
+        r.With(skipAudit, require(auth.PermProcessTasks)).Post("/worker/tasks/{id}/ack", s.AckTask)
     })
 
-    handler := c.Handler(r)
-    return handler
+    return s.CORS.Handler(r)
 }
@@ -0,0 +1,270 @@
+package api
+
+import (
+    "context"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "strconv"
+    "strings"
+    "task_queue_system/db"
+    "task_queue_system/middleware"
+    "task_queue_system/models"
+    "time"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/google/uuid"
+    logrus "github.com/sirupsen/logrus"
+)
+
+// Audit results, derived from the response status.
+const (
+    auditSuccess = "success"
+    auditDenied  = "denied"
+    auditFailure = "failure"
+)
+
+// auditEntry collects what the handlers of a request learn for its audit
+// event. auditLog puts it in the request context.
+type auditEntry struct {
+    actor string
+    org   string
+    // target names what the request created, which the URL cannot
+    target string
+    // force records a request with a safe method, such as an OIDC login;
+    // skip drops a mutating one, such as a worker's dequeue.
+    force bool
+    skip  bool
+}
+
+func auditEntryOf(r *http.Request) *auditEntry {
+    entry, _ := r.Context().Value("audit").(*auditEntry)
+    if entry == nil {
+        entry = &auditEntry{}
+    }
+    return entry
+}
+
+// setAuditActor names who the request acts for. An empty org is looked up
+// when the event is written.
+func setAuditActor(r *http.Request, username, org string) {
+    entry := auditEntryOf(r)
+    entry.actor, entry.org = username, org
+}
+
+// setAuditTarget names what the request created, such as a new task.
+func setAuditTarget(r *http.Request, target string) {
+    auditEntryOf(r).target = target
+}
+
+// forceAudit records the request even though its method is safe.
+func forceAudit(r *http.Request) {
+    auditEntryOf(r).force = true
+}
+
+// skipAudit leaves routes out of the audit log that mutate nothing but task
+// processing state, which the task statuses already show.
+func skipAudit(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        auditEntryOf(r).skip = true
+        next.ServeHTTP(w, r)
+    })
+}
+
+// statusRecorder remembers the status a handler responded with and how
+// much it wrote.
+type statusRecorder struct {
+    http.ResponseWriter
+    status      int
+    wroteHeader bool
+    bytes       int64
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+    if !w.wroteHeader {
+        w.status, w.wroteHeader = status, true
+    }
+    w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+    w.wroteHeader = true
+    n, err := w.ResponseWriter.Write(b)
+    w.bytes += int64(n)
+    return n, err
+}
+
+// auditLog records every mutating request, whether it succeeded or not,
+// once the handler is done.
+func (s *Server) auditLog(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        // Behind accessLog the request already has its entry
+        entry, ok := r.Context().Value("audit").(*auditEntry)
+        if !ok {
+            entry = &auditEntry{}
+            r = r.WithContext(context.WithValue(r.Context(), "audit", entry))
+        }
+        recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        next.ServeHTTP(recorder, r)
+
+        safe := r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions
+        if entry.skip || (safe && !entry.force) {
+            return
+        }
+        // Requests that matched no route act on nothing
+        routeContext := chi.RouteContext(r.Context())
+        if routeContext == nil || routeContext.RoutePattern() == "" {
+            return
+        }
+
+        var target []string
+        for i, key := range routeContext.URLParams.Keys {
+            if key != "*" {
+                target = append(target, key+"="+routeContext.URLParams.Values[i])
+            }
+        }
+        if entry.target != "" {
+            target = append(target, entry.target)
+        }
+        event := models.AuditEvent{
+            ID:        uuid.New().String(),
+            Time:      time.Now().UTC(),
+            Actor:     entry.actor,
+            Org:       entry.org,
+            Action:    r.Method + " " + routeContext.RoutePattern(),
+            Target:    strings.Join(target, " "),
+            IP:        middleware.ClientIP(r),
+            UserAgent: r.UserAgent(),
+            Result:    auditResult(recorder.status),
+            Status:    recorder.status,
+        }
+        if err := s.writeAudit(event); err != nil {
+            logrus.WithField("action", event.Action).Errorf("Failed to write audit event: %v", err)
+        }
+    })
+}
+
+func auditResult(status int) string {
+    switch {
+    case status < 400:
+        return auditSuccess
+    case status == http.StatusUnauthorized || status == http.StatusForbidden:
+        return auditDenied
+    }
+    return auditFailure
+}
+
+// writeAudit stores the event and appends it to AuditFile. Events of
+// unknown users, such as failed logins, go to the default organization,
+// whose admins operate the deployment.
+func (s *Server) writeAudit(event models.AuditEvent) error {
+    if event.Org == "" && event.Actor != "" {
+        if user, err := s.Store.GetUser(event.Actor); err == nil {
+            event.Org = user.Org
+        }
+    }
+    if event.Org == "" {
+        event.Org = db.DefaultOrg
+    }
+
+    if err := s.Store.InsertAuditEvent(event); err != nil {
+        return err
+    }
+    if s.AuditFile == nil {
+        return nil
+    }
+    line, err := json.Marshal(event)
+    if err != nil {
+        return err
+    }
+    s.auditMu.Lock()
+    defer s.auditMu.Unlock()
+    _, err = s.AuditFile.Write(append(line, '\n'))
+    return err
+}
+
+// AuditPage is one page of GET /audit. NextCursor is empty on the last page.
+type AuditPage struct {
+    Events     []models.AuditEvent `json:"events"`
+    NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// GetAuditEvents lists the audit log of the caller's organization, newest
+// first. The query parameters are:
+//
+//     actor, action, result   exact matches
+//     since, until            RFC 3339 timestamps (until is exclusive)
+//     limit                   page size, 1 to 500
+//     cursor                  next_cursor from the previous page
+func (s *Server) GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    filter := db.AuditFilter{
+        Org:    currentOrg(r),
+        Actor:  query.Get("actor"),
+        Action: query.Get("action"),
+        Result: query.Get("result"),
+        Limit:  defaultPageSize,
+    }
+
+    var err error
+    for name, field := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+        if value := query.Get(name); value != "" {
+            if *field, err = time.Parse(time.RFC3339, value); err != nil {
+                writeError(w, r, http.StatusBadRequest, name+" must be an RFC 3339 timestamp")
+                return
+            }
+        }
+    }
+    if value := query.Get("limit"); value != "" {
+        filter.Limit, err = strconv.Atoi(value)
+        if err != nil || filter.Limit < 1 || filter.Limit > maxPageSize {
+            writeError(w, r, http.StatusBadRequest, "limit must be between 1 and 500")
+            return
+        }
+    }
+    if value := query.Get("cursor"); value != "" {
+        if filter.Before, err = decodeAuditCursor(value); err != nil {
+            writeError(w, r, http.StatusBadRequest, err.Error())
+            return
+        }
+    }
+
+    // Fetch one extra row to learn whether another page follows
+    pageSize := filter.Limit
+    filter.Limit++
+    events, err := s.Store.ListAuditEvents(filter)
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get audit events")
+        return
+    }
+
+    page := AuditPage{Events: events}
+    if len(events) > pageSize {
+        page.Events = events[:pageSize]
+        last := page.Events[pageSize-1]
+        page.NextCursor = encodeAuditCursor(db.AuditCursor{Time: last.Time, ID: last.ID})
+    }
+    if page.Events == nil {
+        page.Events = []models.AuditEvent{}
+    }
+
+    json.NewEncoder(w).Encode(page)
+}
+
+func encodeAuditCursor(position db.AuditCursor) string {
+    data, _ := json.Marshal(position)
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeAuditCursor(value string) (*db.AuditCursor, error) {
+    data, err := base64.RawURLEncoding.DecodeString(value)
+    if err != nil {
+        return nil, errors.New("invalid cursor")
+    }
+    var cursor db.AuditCursor
+    if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID == "" {
+        return nil, errors.New("invalid cursor")
+    }
+    return &cursor, nil
+}
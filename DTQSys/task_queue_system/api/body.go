@@ -0,0 +1,143 @@
+package api
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "reflect"
+    "strings"
+)
+
+// BodyTasks is the body limit class of task submissions, which carry the
+// task data. The other routes use the body limit of their rate limit class.
+const BodyTasks = "tasks"
+
+// defaultBodyLimit applies to routes without a class.
+const defaultBodyLimit = 64 << 10
+
+// DefaultBodyLimits returns the request body limits, in bytes, NewServer
+// starts with. The task limit leaves room for the JSON escaping of
+// queue.DefaultMaxDataBytes of data.
+func DefaultBodyLimits() map[string]int64 {
+    return map[string]int64{
+        LimitAuth:   16 << 10,
+        LimitAPI:    defaultBodyLimit,
+        LimitWorker: 1 << 20,
+        BodyTasks:   4 << 20,
+    }
+}
+
+var (
+    // errBodyTooLarge is returned by limitedBody once the body passes its
+    // limit.
+    errBodyTooLarge = errors.New("request body too large")
+    errTrailingData = errors.New("trailing data after JSON value")
+)
+
+// limitedBody reads at most limit bytes of a request body and fails on the
+// first byte past it, and on every read after that.
+type limitedBody struct {
+    body     io.Reader
+    limit    int64
+    exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+    if b.exceeded {
+        return 0, errBodyTooLarge
+    }
+    if int64(len(p)) > b.limit+1 {
+        p = p[:b.limit+1]
+    }
+    n, err := b.body.Read(p)
+    if int64(n) > b.limit {
+        b.exceeded = true
+        return int(b.limit), errBodyTooLarge
+    }
+    b.limit -= int64(n)
+    return n, err
+}
+
+// bodyLimit sets the body limit of the class for the routes it wraps. An
+// inner bodyLimit overrides the one of the group.
+func (s *Server) bodyLimit(class string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            if limit, ok := s.BodyLimits[class]; ok {
+                r = r.WithContext(context.WithValue(r.Context(), "body_limit", limit))
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// decodeJSON decodes the request body into v, or responds with an error
+// and returns false. The body must be a single JSON value of type
+// application/json within the route's body limit, with no fields v lacks.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if mediaType != "application/json" {
+        writeErrorCode(w, r, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Content-Type must be application/json")
+        return false
+    }
+
+    limit, ok := r.Context().Value("body_limit").(int64)
+    if !ok {
+        limit = defaultBodyLimit
+    }
+    decoder := json.NewDecoder(&limitedBody{body: r.Body, limit: limit})
+    decoder.DisallowUnknownFields()
+
+    err := decoder.Decode(v)
+    if err == nil {
+        // Anything after the value is a malformed or smuggled request
+        if extra := decoder.Decode(&json.RawMessage{}); extra == errBodyTooLarge {
+            err = extra
+        } else if extra != io.EOF {
+            err = errTrailingData
+        }
+    }
+    if err == nil {
+        return true
+    }
+
+    var syntaxErr *json.SyntaxError
+    var typeErr *json.UnmarshalTypeError
+    switch {
+    case err == errBodyTooLarge:
+        writeErrorCode(w, r, http.StatusRequestEntityTooLarge, CodeBodyTooLarge,
+            fmt.Sprintf("Request body must be at most %d bytes", limit))
+    case err == io.EOF:
+        writeError(w, r, http.StatusBadRequest, "Request body is required")
+    case err == errTrailingData:
+        writeError(w, r, http.StatusBadRequest, "Request body must contain a single JSON value")
+    case errors.As(err, &syntaxErr) || err == io.ErrUnexpectedEOF:
+        writeError(w, r, http.StatusBadRequest, "Request body is not valid JSON")
+    case errors.As(err, &typeErr) && typeErr.Field != "":
+        writeError(w, r, http.StatusBadRequest, fmt.Sprintf("%s must be a JSON %s", typeErr.Field, jsonType(typeErr.Type)))
+    case strings.HasPrefix(err.Error(), "json: unknown field "):
+        writeError(w, r, http.StatusBadRequest, "Unknown field "+strings.TrimPrefix(err.Error(), "json: unknown field "))
+    default:
+        writeError(w, r, http.StatusBadRequest, "Invalid request payload")
+    }
+    return false
+}
+
+// jsonType names the JSON type that decodes into a Go type.
+func jsonType(t reflect.Type) string {
+    switch t.Kind() {
+    case reflect.String:
+        return "string"
+    case reflect.Bool:
+        return "boolean"
+    case reflect.Slice, reflect.Array:
+        return "array"
+    case reflect.Map, reflect.Struct:
+        return "object"
+    }
+    return "number"
+}
@@ -0,0 +1,168 @@
+package api
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "reflect"
+    "strings"
+    "task_queue_system/middleware"
+
+    "github.com/go-playground/validator/v10"
+)
+
+// Error codes. Clients branch on these rather than on messages, so a
+// published code never changes meaning.
+const (
+    CodeInvalidRequest       = "invalid_request"
+    CodeValidationFailed     = "validation_failed"
+    CodePasswordRejected     = "password_rejected"
+    CodeUnsupportedMediaType = "unsupported_media_type"
+    CodeBodyTooLarge         = "body_too_large"
+    CodeDataTooLarge         = "data_too_large"
+    CodeUnauthorized         = "unauthorized"
+    CodeInvalidCredentials   = "invalid_credentials"
+    CodeInvalidToken         = "invalid_token"
+    CodeTokenRevoked         = "token_revoked"
+    CodeInvalidTOTPCode      = "invalid_totp_code"
+    CodeForbidden            = "forbidden"
+    CodeNotFound             = "not_found"
+    CodeMethodNotAllowed     = "method_not_allowed"
+    CodeConflict             = "conflict"
+    CodeUserExists           = "user_exists"
+    CodeRateLimited          = "rate_limited"
+    CodeQuotaExceeded        = "quota_exceeded"
+    CodeShuttingDown         = "shutting_down"
+    CodeInternal             = "internal_error"
+)
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+    Code    string      `json:"code"`
+    Message string      `json:"message"`
+    Details interface{} `json:"details,omitempty"`
+    // RequestID identifies the request in the server's logs.
+    RequestID string `json:"request_id,omitempty"`
+}
+
+// FieldError is the detail of a validation error for one field.
+type FieldError struct {
+    // Field is the JSON name of the field, dotted for nested ones.
+    Field string `json:"field"`
+    // Rule is the validation tag that failed, e.g. "required" or "max".
+    Rule    string `json:"rule"`
+    Param   string `json:"param,omitempty"`
+    Message string `json:"message"`
+}
+
+// statusCodes are the codes of errors without a more specific one.
+var statusCodes = map[int]string{
+    http.StatusBadRequest:            CodeInvalidRequest,
+    http.StatusUnauthorized:          CodeUnauthorized,
+    http.StatusForbidden:             CodeForbidden,
+    http.StatusNotFound:              CodeNotFound,
+    http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+    http.StatusConflict:              CodeConflict,
+    http.StatusRequestEntityTooLarge: CodeBodyTooLarge,
+    http.StatusUnsupportedMediaType:  CodeUnsupportedMediaType,
+    http.StatusTooManyRequests:       CodeRateLimited,
+    http.StatusInternalServerError:   CodeInternal,
+}
+
+func init() {
+    // Name invalid fields as clients send them
+    validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+        name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+        if name == "-" {
+            return ""
+        }
+        return name
+    })
+}
+
+// writeError responds with the error envelope and the code of the status.
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+    code, ok := statusCodes[status]
+    if !ok {
+        code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+    }
+    writeErrorResponse(w, r, status, ErrorResponse{Code: code, Message: message})
+}
+
+// writeErrorCode responds with the error envelope and a specific code.
+func writeErrorCode(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+    writeErrorResponse(w, r, status, ErrorResponse{Code: code, Message: message})
+}
+
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, response ErrorResponse) {
+    response.RequestID = middleware.RequestID(r)
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(response)
+}
+
+// validationError responds 400 to a failed validate.Struct, listing each
+// invalid field with its JSON name.
+func validationError(w http.ResponseWriter, r *http.Request, err error) {
+    var validationErrs validator.ValidationErrors
+    if !errors.As(err, &validationErrs) {
+        writeError(w, r, http.StatusBadRequest, "Invalid request payload")
+        return
+    }
+
+    fields := make([]FieldError, 0, len(validationErrs))
+    for _, fieldErr := range validationErrs {
+        field := fieldName(fieldErr.Namespace())
+        fields = append(fields, FieldError{
+            Field:   field,
+            Rule:    fieldErr.Tag(),
+            Param:   fieldErr.Param(),
+            Message: fieldMessage(field, fieldErr),
+        })
+    }
+    writeErrorResponse(w, r, http.StatusBadRequest, ErrorResponse{
+        Code:    CodeValidationFailed,
+        Message: "Request has invalid fields",
+        Details: fields,
+    })
+}
+
+// fieldName drops the struct name from a validator namespace such as
+// "Quota.user.max_queued".
+func fieldName(namespace string) string {
+    if i := strings.Index(namespace, "."); i >= 0 {
+        return namespace[i+1:]
+    }
+    return namespace
+}
+
+func fieldMessage(field string, err validator.FieldError) string {
+    unit := ""
+    if err.Kind() == reflect.String {
+        unit = " characters"
+    }
+    switch err.Tag() {
+    case "required":
+        return field + " is required"
+    case "min":
+        return fmt.Sprintf("%s must be at least %s%s", field, err.Param(), unit)
+    case "max":
+        return fmt.Sprintf("%s must be at most %s%s", field, err.Param(), unit)
+    case "oneof":
+        return fmt.Sprintf("%s must be one of: %s", field, err.Param())
+    case "alphanum":
+        return field + " may only contain letters and digits"
+    }
+    return fmt.Sprintf("%s is invalid (%s)", field, err.Tag())
+}
+
+// notFound and methodNotAllowed answer requests that match no route.
+func notFound(w http.ResponseWriter, r *http.Request) {
+    writeError(w, r, http.StatusNotFound, "No such endpoint")
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+    writeError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+    "fmt"
+    "net/http"
+    "os"
+    "sync/atomic"
+    "time"
+)
+
+// HTTPConfig sets the timeouts of the HTTPS server and of its shutdown.
+type HTTPConfig struct {
+    // ReadHeaderTimeout bounds reading the request headers, so idle
+    // clients cannot hold connections open before sending a request.
+    ReadHeaderTimeout time.Duration
+    // ReadTimeout and WriteTimeout bound reading the whole request and
+    // writing the response.
+    ReadTimeout  time.Duration
+    WriteTimeout time.Duration
+    // IdleTimeout is how long a keep-alive connection waits for the next
+    // request.
+    IdleTimeout time.Duration
+    // ShutdownDelay keeps serving, with task submissions refused, for
+    // load balancers to stop sending requests before connections close.
+    ShutdownDelay time.Duration
+    // ShutdownTimeout bounds how long in-flight requests and the workers'
+    // current tasks may take to finish once shutdown begins.
+    ShutdownTimeout time.Duration
+}
+
+func DefaultHTTPConfig() HTTPConfig {
+    return HTTPConfig{
+        ReadHeaderTimeout: 5 * time.Second,
+        ReadTimeout:       30 * time.Second,
+        WriteTimeout:      60 * time.Second,
+        IdleTimeout:       120 * time.Second,
+        ShutdownTimeout:   30 * time.Second,
+    }
+}
+
+// HTTPConfigFromEnv adjusts the default configuration with
+// HTTP_READ_HEADER_TIMEOUT, HTTP_READ_TIMEOUT, HTTP_WRITE_TIMEOUT,
+// HTTP_IDLE_TIMEOUT, SHUTDOWN_DELAY and SHUTDOWN_TIMEOUT, all durations.
+func HTTPConfigFromEnv() (HTTPConfig, error) {
+    config := DefaultHTTPConfig()
+    for name, field := range map[string]*time.Duration{
+        "HTTP_READ_HEADER_TIMEOUT": &config.ReadHeaderTimeout,
+        "HTTP_READ_TIMEOUT":        &config.ReadTimeout,
+        "HTTP_WRITE_TIMEOUT":       &config.WriteTimeout,
+        "HTTP_IDLE_TIMEOUT":        &config.IdleTimeout,
+        "SHUTDOWN_TIMEOUT":         &config.ShutdownTimeout,
+    } {
+        if value := os.Getenv(name); value != "" {
+            d, err := time.ParseDuration(value)
+            if err != nil || d <= 0 {
+                return config, fmt.Errorf("%s must be a positive duration, such as 30s", name)
+            }
+            *field = d
+        }
+    }
+    if value := os.Getenv("SHUTDOWN_DELAY"); value != "" {
+        d, err := time.ParseDuration(value)
+        if err != nil || d < 0 {
+            return config, fmt.Errorf("SHUTDOWN_DELAY must be a non-negative duration, such as 5s")
+        }
+        config.ShutdownDelay = d
+    }
+    return config, nil
+}
+
+// HTTPServer returns a server of the API's routes with the configured
+// timeouts.
+func (s *Server) HTTPServer(addr string, config HTTPConfig) *http.Server {
+    return &http.Server{
+        Addr:              addr,
+        Handler:           s.Routes(),
+        ReadHeaderTimeout: config.ReadHeaderTimeout,
+        ReadTimeout:       config.ReadTimeout,
+        WriteTimeout:      config.WriteTimeout,
+        IdleTimeout:       config.IdleTimeout,
+    }
+}
+
+// BeginShutdown makes the server refuse new task submissions with 503, so
+// clients retry them on another instance while in-flight requests and
+// tasks finish.
+func (s *Server) BeginShutdown() {
+    atomic.StoreInt32(&s.shuttingDown, 1)
+}
+
+// ShuttingDown reports whether BeginShutdown was called.
+func (s *Server) ShuttingDown() bool {
+    return atomic.LoadInt32(&s.shuttingDown) == 1
+}
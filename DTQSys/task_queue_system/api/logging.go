@@ -0,0 +1,66 @@
+package api
+
+import (
+    "context"
+    "net/http"
+    "runtime/debug"
+    "task_queue_system/middleware"
+    "time"
+
+    logrus "github.com/sirupsen/logrus"
+)
+
+// accessLog logs every request once it is answered, or aborted. The user
+// is learned from the request's audit entry, which the handlers fill in, so
+// the entry is created here and shared with auditLog.
+func accessLog(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        entry := &auditEntry{}
+        recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        defer func() {
+            logrus.WithFields(logrus.Fields{
+                "request_id": middleware.RequestID(r),
+                "method":     r.Method,
+                "path":       r.URL.Path,
+                "status":     recorder.status,
+                "latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+                "bytes":      recorder.bytes,
+                "user":       entry.actor,
+                "client_ip":  middleware.ClientIP(r),
+            }).Info("request")
+        }()
+        next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), "audit", entry)))
+    })
+}
+
+// recoverPanics answers a request whose handler panicked with a 500 and
+// logs the panic with the request ID, instead of dropping the connection.
+func recoverPanics(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        defer func() {
+            value := recover()
+            if value == nil {
+                return
+            }
+            // The server's way of aborting a response on purpose
+            if value == http.ErrAbortHandler {
+                panic(value)
+            }
+            logrus.WithFields(logrus.Fields{
+                "request_id": middleware.RequestID(r),
+                "method":     r.Method,
+                "path":       r.URL.Path,
+                "stack":      string(debug.Stack()),
+            }).Errorf("Handler panicked: %v", value)
+
+            // A response already started cannot be replaced
+            if recorder.wroteHeader {
+                panic(http.ErrAbortHandler)
+            }
+            writeError(recorder, r, http.StatusInternalServerError, "Internal server error")
+        }()
+        next.ServeHTTP(recorder, r)
+    })
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "task_queue_system/auth"
+
+    logrus "github.com/sirupsen/logrus"
+)
+
+// oidcCookie keeps the login state between /oidc/login and /oidc/callback.
+const oidcCookie = "dtq_oidc_login"
+
+// OIDCLogin sends the user to the identity provider.
+func (s *Server) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+    authURL, loginState, err := s.OIDC.BeginLogin()
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to start login")
+        return
+    }
+
+    http.SetCookie(w, &http.Cookie{
+        Name:     oidcCookie,
+        Value:    loginState,
+        Path:     "/oidc",
+        MaxAge:   int(auth.OIDCLoginTTL.Seconds()),
+        HttpOnly: true,
+        Secure:   r.TLS != nil,
+        // Lax, so the cookie comes back on the provider's redirect
+        SameSite: http.SameSiteLaxMode,
+    })
+    http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// OIDCCallback completes the login when the provider redirects back and
+// issues our own tokens, as /login does.
+func (s *Server) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+    forceAudit(r)
+    query := r.URL.Query()
+    if providerErr := query.Get("error"); providerErr != "" {
+        writeError(w, r, http.StatusUnauthorized, "Identity provider refused the login: "+providerErr+" "+query.Get("error_description"))
+        return
+    }
+    cookie, err := r.Cookie(oidcCookie)
+    if err != nil {
+        writeError(w, r, http.StatusBadRequest, auth.ErrOIDCState.Error())
+        return
+    }
+    // The login state is single-use
+    http.SetCookie(w, &http.Cookie{Name: oidcCookie, Path: "/oidc", MaxAge: -1})
+
+    user, err := s.OIDC.CompleteLogin(r.Context(), s.Store, cookie.Value, query.Get("state"), query.Get("code"))
+    if err == auth.ErrOIDCState {
+        writeError(w, r, http.StatusBadRequest, err.Error())
+        return
+    } else if err == auth.ErrOIDCNoRole || err == auth.ErrUserDisabled {
+        writeError(w, r, http.StatusForbidden, err.Error())
+        return
+    } else if err == auth.ErrOIDCUserExists {
+        writeError(w, r, http.StatusConflict, err.Error())
+        return
+    } else if err != nil {
+        // The provider's error may describe its configuration
+        logrus.Warnf("OIDC login failed: %v", err)
+        writeError(w, r, http.StatusUnauthorized, "Login failed")
+        return
+    }
+
+    setAuditActor(r, user.Username, user.Org)
+    accessToken, refreshToken, err := auth.GenerateTokens(s.Store, *user)
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to generate tokens")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{
+        "access_token":  accessToken,
+        "refresh_token": refreshToken,
+    })
+}
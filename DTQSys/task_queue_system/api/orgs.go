@@ -0,0 +1,70 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "task_queue_system/db"
+    "task_queue_system/models"
+
+    "github.com/go-chi/chi/v5"
+)
+
+// operator rejects callers outside the default organization. Its admins run
+// the deployment and are the only ones who manage other organizations.
+func operator(w http.ResponseWriter, r *http.Request) bool {
+    if currentOrg(r) != db.DefaultOrg {
+        writeError(w, r, http.StatusForbidden, "Forbidden")
+        return false
+    }
+    return true
+}
+
+func (s *Server) GetOrgQuota(w http.ResponseWriter, r *http.Request) {
+    if !operator(w, r) {
+        return
+    }
+
+    quota, err := s.Queue.Quota(chi.URLParam(r, "org"))
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get quota")
+        return
+    }
+
+    json.NewEncoder(w).Encode(quota)
+}
+
+// SetOrgQuota replaces the organization's quota. Zero fields mean no limit.
+func (s *Server) SetOrgQuota(w http.ResponseWriter, r *http.Request) {
+    if !operator(w, r) {
+        return
+    }
+
+    var quota models.Quota
+    if !decodeJSON(w, r, &quota) {
+        return
+    }
+    if err := validate.Struct(quota); err != nil {
+        validationError(w, r, err)
+        return
+    }
+
+    if err := s.Store.SetOrgQuota(chi.URLParam(r, "org"), quota); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to set quota")
+        return
+    }
+
+    json.NewEncoder(w).Encode(quota)
+}
+
+// GetMyQuota shows the caller's organization quota, including the limits
+// of each member, and how much of it the organization and the caller have
+// used.
+func (s *Server) GetMyQuota(w http.ResponseWriter, r *http.Request) {
+    report, err := s.Queue.Usage(currentOrg(r), currentUser(r))
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get quota")
+        return
+    }
+
+    json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "task_queue_system/db"
+    "time"
+)
+
+const (
+    defaultPageSize = 50
+    maxPageSize     = 500
+)
+
+// pageCursor is the opaque next_cursor handed to clients. It remembers the
+// sort order so a cursor cannot be replayed against a different one.
+type pageCursor struct {
+    Sort string `json:"sort"`
+    Desc bool   `json:"desc,omitempty"`
+    db.TaskCursor
+}
+
+func encodeCursor(filter db.TaskFilter, position db.TaskCursor) string {
+    data, _ := json.Marshal(pageCursor{Sort: filter.Sort, Desc: filter.Desc, TaskCursor: position})
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(filter db.TaskFilter, value string) (*db.TaskCursor, error) {
+    data, err := base64.RawURLEncoding.DecodeString(value)
+    if err != nil {
+        return nil, errors.New("invalid cursor")
+    }
+    var cursor pageCursor
+    if err := json.Unmarshal(data, &cursor); err != nil || cursor.ID == "" {
+        return nil, errors.New("invalid cursor")
+    }
+    if cursor.Sort != filter.Sort || cursor.Desc != filter.Desc {
+        return nil, errors.New("cursor does not match the requested sort order")
+    }
+    return &cursor.TaskCursor, nil
+}
+
+// parseTaskFilter reads the GET /tasks query parameters:
+//
+//     status, type, priority       exact matches
+//     owner                        exact match; admins only, others see their own
+//     created_after, created_before RFC 3339 timestamps (exclusive)
+//     sort                         created or priority, "-" prefix for descending
+//     limit                        page size, 1 to 500
+//     cursor                       next_cursor from the previous page
+func parseTaskFilter(r *http.Request) (db.TaskFilter, error) {
+    query := r.URL.Query()
+    filter := db.TaskFilter{
+        Status: query.Get("status"),
+        Type:   query.Get("type"),
+        Owner:  query.Get("owner"),
+        Sort:   db.SortCreated,
+        Limit:  defaultPageSize,
+    }
+
+    if value := query.Get("priority"); value != "" {
+        priority, err := strconv.Atoi(value)
+        if err != nil || priority < 1 || priority > 3 {
+            return filter, errors.New("priority must be 1, 2 or 3")
+        }
+        filter.Priority = priority
+    }
+
+    for name, target := range map[string]*time.Time{
+        "created_after":  &filter.CreatedAfter,
+        "created_before": &filter.CreatedBefore,
+    } {
+        if value := query.Get(name); value != "" {
+            t, err := time.Parse(time.RFC3339, value)
+            if err != nil {
+                return filter, fmt.Errorf("%s must be an RFC 3339 timestamp", name)
+            }
+            *target = t
+        }
+    }
+
+    if value := query.Get("sort"); value != "" {
+        filter.Desc = strings.HasPrefix(value, "-")
+        switch strings.TrimPrefix(value, "-") {
+        case db.SortCreated:
+            filter.Sort = db.SortCreated
+        case db.SortPriority:
+            filter.Sort = db.SortPriority
+        default:
+            return filter, errors.New("sort must be created or priority, optionally prefixed with -")
+        }
+    }
+
+    if value := query.Get("limit"); value != "" {
+        limit, err := strconv.Atoi(value)
+        if err != nil || limit < 1 || limit > maxPageSize {
+            return filter, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+        }
+        filter.Limit = limit
+    }
+
+    if value := query.Get("cursor"); value != "" {
+        cursor, err := decodeCursor(filter, value)
+        if err != nil {
+            return filter, err
+        }
+        filter.After = cursor
+    }
+    return filter, nil
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+    "math"
+    "net/http"
+    "strconv"
+    "task_queue_system/middleware"
+    "time"
+
+    logrus "github.com/sirupsen/logrus"
+)
+
+// Rate limit classes. Each route belongs to one and every caller has a
+// separate budget per class.
+const (
+    // LimitIP bounds all requests from one address, before authentication
+    LimitIP = "ip"
+    // LimitAuth covers registration, login and token refresh, per address
+    LimitAuth = "auth"
+    // LimitAPI covers the authenticated API, per user or service account,
+    // and the other public endpoints per address
+    LimitAPI = "api"
+    // LimitWorker covers the routes remote workers poll, per account
+    LimitWorker = "worker"
+)
+
+// DefaultLimits returns the limits NewServer starts with.
+func DefaultLimits() map[string]middleware.Limit {
+    return map[string]middleware.Limit{
+        LimitIP:     {Requests: 100, Period: time.Second, Burst: 200},
+        LimitAuth:   {Requests: 10, Period: time.Minute, Burst: 5},
+        LimitAPI:    {Requests: 10, Period: time.Second, Burst: 20},
+        LimitWorker: {Requests: 50, Period: time.Second, Burst: 100},
+    }
+}
+
+// rateLimit rejects requests over the limit of the class with 429. Requests
+// of authenticated callers count against their account, others against
+// their address. The RateLimit-Limit, RateLimit-Remaining and
+// RateLimit-Reset headers tell clients their budget, and Retry-After how
+// long to back off once it is spent.
+//
+// Requests are let through when the limiter fails, so an outage of Redis
+// does not take the API down with it.
+func (s *Server) rateLimit(class string) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            limit, ok := s.Limits[class]
+            if s.Limiter == nil || !ok {
+                next.ServeHTTP(w, r)
+                return
+            }
+
+            key := class + ":ip:" + middleware.ClientIP(r)
+            if username := currentUser(r); username != "" {
+                key = class + ":user:" + currentOrg(r) + "/" + username
+            }
+            decision, err := s.Limiter.Allow(r.Context(), key, limit)
+            if err != nil {
+                logrus.WithField("key", key).Errorf("Failed to check rate limit: %v", err)
+                next.ServeHTTP(w, r)
+                return
+            }
+
+            header := w.Header()
+            header.Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+            header.Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+            header.Set("RateLimit-Reset", strconv.Itoa(seconds(decision.ResetAfter)))
+            if !decision.Allowed {
+                header.Set("Retry-After", strconv.Itoa(seconds(decision.RetryAfter)))
+                writeError(w, r, http.StatusTooManyRequests, "Too many requests, retry later")
+                return
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
+}
+
+// seconds rounds a wait up to the whole seconds the headers take.
+func seconds(d time.Duration) int {
+    return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "task_queue_system/auth"
+    "task_queue_system/db"
+    "task_queue_system/models"
+    "time"
+
+    "github.com/go-chi/chi/v5"
+)
+
+// GetServiceAccounts lists the service accounts of the caller's
+// organization.
+func (s *Server) GetServiceAccounts(w http.ResponseWriter, r *http.Request) {
+    users, err := s.Store.ListUsers(currentOrg(r))
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get service accounts")
+        return
+    }
+
+    accounts := []models.User{}
+    for _, user := range users {
+        if user.Role == auth.RoleService {
+            accounts = append(accounts, user)
+        }
+    }
+    json.NewEncoder(w).Encode(accounts)
+}
+
+// CreateServiceAccount adds a service account to the caller's organization.
+// It authenticates only with API keys issued through CreateAPIKey.
+func (s *Server) CreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Name string `json:"name" validate:"required,alphanum,min=3,max=30"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+    if err := validate.Struct(request); err != nil {
+        validationError(w, r, err)
+        return
+    }
+
+    setAuditTarget(r, "name="+request.Name)
+    account, err := auth.CreateServiceAccount(s.Store, request.Name, currentOrg(r))
+    if err != nil {
+        userCreationError(w, r, err, "Failed to create service account")
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(account)
+}
+
+// GetAPIKeys lists a service account's keys, including revoked and expired
+// ones. Secrets are never returned.
+func (s *Server) GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+    account, ok := s.serviceAccount(w, r)
+    if !ok {
+        return
+    }
+
+    keys, err := s.Store.ListAPIKeys(account.Username)
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get API keys")
+        return
+    }
+    if keys == nil {
+        keys = []models.APIKey{}
+    }
+    json.NewEncoder(w).Encode(keys)
+}
+
+// CreateAPIKey issues a key with the requested scopes. The response is the
+// only time the secret is shown.
+func (s *Server) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Scopes  []string   `json:"scopes" validate:"required,min=1"`
+        Expires *time.Time `json:"expires"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+    if err := validate.Struct(request); err != nil {
+        validationError(w, r, err)
+        return
+    }
+    for _, scope := range request.Scopes {
+        if !auth.ValidScope(scope) {
+            writeError(w, r, http.StatusBadRequest, "Unknown scope "+scope)
+            return
+        }
+    }
+    if request.Expires != nil && !request.Expires.After(time.Now()) {
+        writeError(w, r, http.StatusBadRequest, "expires must be in the future")
+        return
+    }
+
+    account, ok := s.serviceAccount(w, r)
+    if !ok {
+        return
+    }
+
+    secret, key, err := auth.CreateAPIKey(s.Store, *account, request.Scopes, request.Expires)
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to create API key")
+        return
+    }
+    setAuditTarget(r, "id="+key.ID)
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{"key": secret, "api_key": key})
+}
+
+// SetAPIKeyExpiry moves a key's expiry, e.g. to retire it a while after its
+// replacement was deployed. A time in the past expires it at once and null
+// removes the expiry.
+func (s *Server) SetAPIKeyExpiry(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Expires *time.Time `json:"expires"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+
+    key, ok := s.accountKey(w, r)
+    if !ok {
+        return
+    }
+
+    if err := s.Store.SetAPIKeyExpiry(key.ID, request.Expires); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to set expiry")
+        return
+    }
+
+    key.Expires = request.Expires
+    json.NewEncoder(w).Encode(key)
+}
+
+// RevokeAPIKey disables a key for good.
+func (s *Server) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+    key, ok := s.accountKey(w, r)
+    if !ok {
+        return
+    }
+
+    if err := s.Store.RevokeAPIKey(key.ID); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to revoke API key")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked"})
+}
+
+// serviceAccount loads the service account named in the URL if it belongs
+// to the caller's organization.
+func (s *Server) serviceAccount(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+    account, err := s.Store.GetUser(chi.URLParam(r, "name"))
+    if err == nil && (account.Org != currentOrg(r) || account.Role != auth.RoleService) {
+        err = db.ErrNotFound
+    }
+    if err == db.ErrNotFound {
+        writeError(w, r, http.StatusNotFound, "Service account not found")
+        return nil, false
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get service account")
+        return nil, false
+    }
+    return account, true
+}
+
+// accountKey loads the key named in the URL if it belongs to the service
+// account named in the URL.
+func (s *Server) accountKey(w http.ResponseWriter, r *http.Request) (*models.APIKey, bool) {
+    account, ok := s.serviceAccount(w, r)
+    if !ok {
+        return nil, false
+    }
+
+    key, err := s.Store.GetAPIKey(chi.URLParam(r, "id"))
+    if err == nil && key.Account != account.Username {
+        err = db.ErrNotFound
+    }
+    if err == db.ErrNotFound {
+        writeError(w, r, http.StatusNotFound, "API key not found")
+        return nil, false
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get API key")
+        return nil, false
+    }
+    return key, true
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+    "encoding/json"
+    "net/http"
+    "task_queue_system/auth"
+    "task_queue_system/models"
+)
+
+// LoginTOTP completes a password login of a user with two-factor
+// authentication: the challenge /login returned, with a TOTP or recovery
+// code, is exchanged for tokens.
+func (s *Server) LoginTOTP(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Challenge string `json:"challenge" validate:"required"`
+        Code      string `json:"code" validate:"required"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+    if err := validate.Struct(request); err != nil {
+        validationError(w, r, err)
+        return
+    }
+
+    // The audit log names the user even when the code is wrong
+    if claims, err := auth.ValidateToken(request.Challenge, auth.TokenTOTPChallenge); err == nil {
+        setAuditActor(r, claims.Username, "")
+    }
+
+    accessToken, refreshToken, err := auth.CompleteTOTPLogin(s.Store, request.Challenge, request.Code)
+    if err == auth.ErrInvalidToken {
+        writeErrorCode(w, r, http.StatusUnauthorized, CodeInvalidToken, "Invalid or expired challenge, log in again")
+        return
+    } else if err == auth.ErrInvalidTOTPCode {
+        writeErrorCode(w, r, http.StatusUnauthorized, CodeInvalidTOTPCode, err.Error())
+        return
+    } else if err == auth.ErrInvalidCredentials {
+        writeErrorCode(w, r, http.StatusUnauthorized, CodeInvalidCredentials, err.Error())
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to log in")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{
+        "access_token":  accessToken,
+        "refresh_token": refreshToken,
+    })
+}
+
+// BeginTOTPEnrollment generates a TOTP secret for the caller. It is not
+// asked for at login until confirmed with a code.
+func (s *Server) BeginTOTPEnrollment(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Password string `json:"password" validate:"required"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+    if err := validate.Struct(request); err != nil {
+        validationError(w, r, err)
+        return
+    }
+
+    enrollment, err := auth.BeginTOTPEnrollment(s.Store, currentUser(r), request.Password)
+    if err == auth.ErrInvalidCredentials {
+        writeError(w, r, http.StatusForbidden, "Password is incorrect")
+        return
+    } else if err == auth.ErrTOTPEnabled {
+        writeError(w, r, http.StatusConflict, err.Error())
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to start enrollment")
+        return
+    }
+
+    json.NewEncoder(w).Encode(enrollment)
+}
+
+// ConfirmTOTPEnrollment enables two-factor authentication with a first
+// code and returns the recovery codes, which are not shown again.
+func (s *Server) ConfirmTOTPEnrollment(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Code string `json:"code" validate:"required"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+    if err := validate.Struct(request); err != nil {
+        validationError(w, r, err)
+        return
+    }
+
+    codes, err := auth.ConfirmTOTPEnrollment(s.Store, currentUser(r), request.Code)
+    if err == auth.ErrInvalidTOTPCode {
+        writeErrorCode(w, r, http.StatusBadRequest, CodeInvalidTOTPCode, err.Error())
+        return
+    } else if err == auth.ErrTOTPEnabled || err == auth.ErrTOTPNotEnrolled {
+        writeError(w, r, http.StatusConflict, err.Error())
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to enable two-factor authentication")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTOTP turns the caller's two-factor authentication off. It takes
+// the password and a code, like a login.
+func (s *Server) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Password string `json:"password" validate:"required"`
+        Code     string `json:"code" validate:"required"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+    if err := validate.Struct(request); err != nil {
+        validationError(w, r, err)
+        return
+    }
+
+    err := auth.DisableTOTP(s.Store, currentUser(r), request.Password, request.Code)
+    if err == auth.ErrInvalidCredentials {
+        writeError(w, r, http.StatusForbidden, "Password is incorrect")
+        return
+    } else if err == auth.ErrInvalidTOTPCode {
+        writeErrorCode(w, r, http.StatusForbidden, CodeInvalidTOTPCode, err.Error())
+        return
+    } else if err == auth.ErrTOTPNotEnabled {
+        writeError(w, r, http.StatusConflict, err.Error())
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to disable two-factor authentication")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication disabled"})
+}
+
+// ResetTOTP removes a member's two-factor enrollment, for members who lost
+// both their authenticator and their recovery codes. They log in with the
+// password alone until they enroll again.
+func (s *Server) ResetTOTP(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.orgUser(w, r)
+    if !ok {
+        return
+    }
+
+    if err := s.Store.SetUserTOTP(user.Username, models.TOTP{}); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to reset two-factor authentication")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{"message": "Two-factor authentication reset"})
+}
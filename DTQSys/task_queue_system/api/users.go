@@ -0,0 +1,236 @@
+package api
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "task_queue_system/auth"
+    "task_queue_system/db"
+    "task_queue_system/models"
+
+    "github.com/go-chi/chi/v5"
+)
+
+// GetUsers lists the members of the caller's organization.
+func (s *Server) GetUsers(w http.ResponseWriter, r *http.Request) {
+    users, err := s.Store.ListUsers(currentOrg(r))
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get users")
+        return
+    }
+    if users == nil {
+        users = []models.User{}
+    }
+
+    json.NewEncoder(w).Encode(users)
+}
+
+// CreateUser adds a member to the caller's organization. Self-registration
+// cannot join an existing organization, so this is how admins add people.
+func (s *Server) CreateUser(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        models.Credentials
+        Role string `json:"role"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+    if err := validate.Struct(request.Credentials); err != nil {
+        validationError(w, r, err)
+        return
+    }
+    if request.Role == "" {
+        request.Role = auth.DefaultRole
+    }
+    if !auth.ValidRole(request.Role) {
+        writeError(w, r, http.StatusBadRequest, "Unknown role")
+        return
+    }
+
+    user := models.User{Username: request.Username, Role: request.Role, Org: currentOrg(r)}
+    setAuditTarget(r, "username="+user.Username)
+    if err := auth.CreateUser(s.Store, user, request.Password); err != nil {
+        userCreationError(w, r, err, "Failed to create user")
+        return
+    }
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(user)
+}
+
+// userCreationError responds to a failure to create a user or service
+// account. Only the errors meant for the caller are passed on.
+func userCreationError(w http.ResponseWriter, r *http.Request, err error, failure string) {
+    var policyErr *auth.PasswordError
+    if err == auth.ErrUserExists {
+        writeErrorCode(w, r, http.StatusConflict, CodeUserExists, "Username is taken")
+    } else if errors.As(err, &policyErr) {
+        writeErrorCode(w, r, http.StatusBadRequest, CodePasswordRejected, err.Error())
+    } else {
+        writeError(w, r, http.StatusInternalServerError, failure)
+    }
+}
+
+// SetUserRole assigns a role. It takes effect when the user's tokens are
+// next issued, at login or refresh.
+func (s *Server) SetUserRole(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Role string `json:"role"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+    if !auth.ValidRole(request.Role) {
+        writeError(w, r, http.StatusBadRequest, "Unknown role")
+        return
+    }
+
+    user, ok := s.orgUser(w, r)
+    if !ok {
+        return
+    }
+    if user.Role == auth.RoleService {
+        writeError(w, r, http.StatusConflict, "Service accounts are limited by their API key scopes, not roles")
+        return
+    }
+    if user.Username == currentUser(r) && request.Role != auth.RoleAdmin {
+        writeError(w, r, http.StatusConflict, "Admins cannot remove their own admin role")
+        return
+    }
+
+    if err := s.Store.SetUserRole(user.Username, request.Role); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to set role")
+        return
+    }
+
+    user.Role = request.Role
+    json.NewEncoder(w).Encode(user)
+}
+
+// RevokeSessions logs the user out everywhere: refresh tokens stop working
+// at once and access tokens are rejected until they expire.
+func (s *Server) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+    user, ok := s.orgUser(w, r)
+    if !ok {
+        return
+    }
+
+    if err := auth.RevokeUser(s.Store, s.Denylist, user.Username); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to revoke sessions")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{"message": "Sessions revoked"})
+}
+
+// ChangePassword replaces the caller's password. All of the caller's
+// sessions end, including the current one, so the caller logs in again.
+func (s *Server) ChangePassword(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        CurrentPassword string `json:"current_password" validate:"required"`
+        NewPassword     string `json:"new_password" validate:"required"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+    if err := validate.Struct(request); err != nil {
+        validationError(w, r, err)
+        return
+    }
+
+    err := auth.ChangePassword(s.Store, s.Denylist, currentUser(r), request.CurrentPassword, request.NewPassword)
+    var policyErr *auth.PasswordError
+    if err == auth.ErrInvalidCredentials {
+        writeError(w, r, http.StatusForbidden, "Current password is incorrect")
+        return
+    } else if errors.As(err, &policyErr) {
+        writeErrorCode(w, r, http.StatusBadRequest, CodePasswordRejected, err.Error())
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to change password")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{"message": "Password changed, log in again"})
+}
+
+// ResetPassword sets a member's password, e.g. when they forgot it or are
+// locked out, and ends their sessions.
+func (s *Server) ResetPassword(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Password string `json:"password" validate:"required"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+    if err := validate.Struct(request); err != nil {
+        validationError(w, r, err)
+        return
+    }
+
+    user, ok := s.orgUser(w, r)
+    if !ok {
+        return
+    }
+    if user.Role == auth.RoleService {
+        writeError(w, r, http.StatusConflict, "Service accounts authenticate with API keys, not passwords")
+        return
+    }
+
+    err := auth.ResetPassword(s.Store, s.Denylist, user.Username, request.Password)
+    var policyErr *auth.PasswordError
+    if errors.As(err, &policyErr) {
+        writeErrorCode(w, r, http.StatusBadRequest, CodePasswordRejected, err.Error())
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to reset password")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]string{"message": "Password reset"})
+}
+
+// SetUserDisabled disables a member, ending their sessions and stopping
+// their API keys, or enables them again.
+func (s *Server) SetUserDisabled(w http.ResponseWriter, r *http.Request) {
+    var request struct {
+        Disabled bool `json:"disabled"`
+    }
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+
+    user, ok := s.orgUser(w, r)
+    if !ok {
+        return
+    }
+    if user.Username == currentUser(r) {
+        writeError(w, r, http.StatusConflict, "Admins cannot disable themselves")
+        return
+    }
+
+    if err := auth.SetUserDisabled(s.Store, s.Denylist, user.Username, request.Disabled); err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to update user")
+        return
+    }
+
+    user.Disabled = request.Disabled
+    json.NewEncoder(w).Encode(user)
+}
+
+// orgUser loads the user named in the URL if they belong to the caller's
+// organization. Members of other organizations are reported as not found.
+func (s *Server) orgUser(w http.ResponseWriter, r *http.Request) (*models.User, bool) {
+    user, err := s.Store.GetUser(chi.URLParam(r, "username"))
+    if err == nil && user.Org != currentOrg(r) {
+        err = db.ErrNotFound
+    }
+    if err == db.ErrNotFound {
+        writeError(w, r, http.StatusNotFound, "User not found")
+        return nil, false
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get user")
+        return nil, false
+    }
+    return user, true
+}
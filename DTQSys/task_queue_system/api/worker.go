@@ -0,0 +1,109 @@
+package api
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "task_queue_system/db"
+    "task_queue_system/models"
+    "task_queue_system/queue"
+    "task_queue_system/workers"
+
+    "github.com/go-chi/chi/v5"
+)
+
+// Delivery is a task handed to a remote worker. The receipt must be sent
+// back with the acknowledgement.
+type Delivery struct {
+    Task    *models.Task `json:"task"`
+    Receipt string       `json:"receipt"`
+}
+
+// AckRequest reports the outcome of a delivery. A non-empty Error marks the
+// attempt as failed and the task is retried like an in-process failure.
+type AckRequest struct {
+    Receipt string `json:"receipt"`
+    Error   string `json:"error,omitempty"`
+}
+
+// remoteWorker acts for the caller as a queue consumer, so remote workers
+// share the claim and retry logic of in-process ones.
+func (s *Server) remoteWorker(r *http.Request) *workers.Worker {
+    return workers.NewWorker("remote-"+currentUser(r), currentOrg(r), s.Queue, s.Store, nil)
+}
+
+// DequeueTask hands the next task of the caller's organization to a remote
+// worker, or answers 204 when its queues are empty.
+func (s *Server) DequeueTask(w http.ResponseWriter, r *http.Request) {
+    worker := s.remoteWorker(r)
+    for {
+        task, err := s.Queue.Dequeue(worker.Org, worker.ID)
+        if err == queue.ErrEmpty {
+            w.WriteHeader(http.StatusNoContent)
+            return
+        } else if err != nil {
+            writeError(w, r, http.StatusInternalServerError, "Failed to dequeue task")
+            return
+        }
+
+        if worker.Claim(task) {
+            // The acknowledgement must come from this caller with this
+            // receipt; the backend trusts the receipt it is given
+            if err := s.Store.SetTaskDelivery(task.ID, worker.ID, task.Receipt); err != nil {
+                writeError(w, r, http.StatusInternalServerError, "Failed to record delivery")
+                return
+            }
+            json.NewEncoder(w).Encode(Delivery{Task: task, Receipt: task.Receipt})
+            return
+        }
+        // Deliveries of cancelled tasks are dropped
+        worker.Acknowledge(task)
+    }
+}
+
+func (s *Server) AckTask(w http.ResponseWriter, r *http.Request) {
+    var request AckRequest
+    if !decodeJSON(w, r, &request) {
+        return
+    }
+
+    task, err := s.Store.GetTask(chi.URLParam(r, "id"))
+    if err == nil && task.Org != currentOrg(r) {
+        err = db.ErrNotFound
+    }
+    if err == db.ErrNotFound {
+        writeError(w, r, http.StatusNotFound, "Task not found")
+        return
+    } else if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to get task")
+        return
+    }
+    if task.Status != "running" {
+        writeError(w, r, http.StatusConflict, "Task is not running")
+        return
+    }
+
+    // Clearing the delivery checks it in the same step, so of two
+    // concurrent acknowledgements only one records an outcome
+    worker := s.remoteWorker(r)
+    cleared, err := s.Store.ClearTaskDelivery(task.ID, worker.ID, request.Receipt)
+    if err != nil {
+        writeError(w, r, http.StatusInternalServerError, "Failed to record delivery")
+        return
+    }
+    if !cleared {
+        writeError(w, r, http.StatusConflict, "Receipt does not match the task's delivery")
+        return
+    }
+
+    var taskErr error
+    if request.Error != "" {
+        taskErr = errors.New(request.Error)
+    }
+    task.Receipt = request.Receipt
+
+    worker.Finish(task, taskErr)
+    worker.Acknowledge(task)
+
+    json.NewEncoder(w).Encode(task)
+}
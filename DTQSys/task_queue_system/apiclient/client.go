@@ -0,0 +1,754 @@
+// Package apiclient is a typed Go client for the task queue REST API. It
+// logs in, refreshes the access token through /refresh when the server
+// rejects it, and retries throttled or failed requests with backoff when
+// sending them twice is safe.
+package apiclient
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "math/rand"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+    "task_queue_system/models"
+    "time"
+
+    "github.com/google/uuid"
+)
+
+// Error is returned for every non-2xx response that is not retried away.
+// Code, Details and RequestID come from the API's error envelope; responses
+// without one, e.g. from a proxy, only have their body as Message.
+type Error struct {
+    StatusCode int
+    Code       string
+    Message    string
+    // Details is the raw JSON of the details, such as the invalid fields
+    // of a validation_failed error.
+    Details   json.RawMessage
+    RequestID string
+}
+
+func (e *Error) Error() string {
+    if e.Code == "" {
+        return fmt.Sprintf("apiclient: %d %s", e.StatusCode, e.Message)
+    }
+    return fmt.Sprintf("apiclient: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// parseError reads the error envelope of a response body.
+func parseError(statusCode int, body []byte) *Error {
+    var envelope struct {
+        Code      string          `json:"code"`
+        Message   string          `json:"message"`
+        Details   json.RawMessage `json:"details"`
+        RequestID string          `json:"request_id"`
+    }
+    if err := json.Unmarshal(body, &envelope); err != nil || envelope.Code == "" {
+        return &Error{StatusCode: statusCode, Message: strings.TrimSpace(string(body))}
+    }
+    return &Error{
+        StatusCode: statusCode,
+        Code:       envelope.Code,
+        Message:    envelope.Message,
+        Details:    envelope.Details,
+        RequestID:  envelope.RequestID,
+    }
+}
+
+// ErrTOTPRequired is returned by Login for users with two-factor
+// authentication; finish the login with LoginTOTP.
+var ErrTOTPRequired = errors.New("apiclient: two-factor code required, call LoginTOTP")
+
+// IsNotFound reports whether err is a 404 from the API.
+func IsNotFound(err error) bool {
+    var apiErr *Error
+    return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+type Client struct {
+    BaseURL    string
+    HTTPClient *http.Client
+
+    // MaxRetries bounds the retries after a 429, a 5xx or a transport error.
+    // Only requests that may be sent twice are retried: GET, HEAD, PUT and
+    // DELETE, and requests with an Idempotency-Key. Backoff is the first
+    // delay; it doubles on every retry up to MaxBackoff.
+    MaxRetries int
+    Backoff    time.Duration
+    MaxBackoff time.Duration
+
+    mu           sync.Mutex
+    accessToken  string
+    refreshToken string
+    // challenge is the pending two-factor login after ErrTOTPRequired
+    challenge string
+
+    // refreshMu serializes refreshes: the server accepts each refresh token
+    // once and revokes the session when one is presented twice
+    refreshMu sync.Mutex
+}
+
+func New(baseURL string, httpClient *http.Client) *Client {
+    if httpClient == nil {
+        httpClient = http.DefaultClient
+    }
+    return &Client{
+        BaseURL:    strings.TrimRight(baseURL, "/"),
+        HTTPClient: httpClient,
+        MaxRetries: 3,
+        Backoff:    200 * time.Millisecond,
+        MaxBackoff: 5 * time.Second,
+    }
+}
+
+// SetTokens installs tokens obtained earlier, e.g. from a cache.
+func (c *Client) SetTokens(accessToken, refreshToken string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.accessToken, c.refreshToken = accessToken, refreshToken
+}
+
+// SetAPIKey authenticates as a service account. API keys do not expire
+// every few minutes, so there is nothing to refresh.
+func (c *Client) SetAPIKey(apiKey string) {
+    c.SetTokens(apiKey, "")
+}
+
+// Tokens returns the current tokens, which change after a refresh.
+func (c *Client) Tokens() (accessToken, refreshToken string) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    return c.accessToken, c.refreshToken
+}
+
+func (c *Client) Register(ctx context.Context, username, password string) error {
+    return c.RegisterOrg(ctx, username, password, "")
+}
+
+// RegisterOrg signs up into a new organization, making the user its admin.
+// An empty org joins the default organization.
+func (c *Client) RegisterOrg(ctx context.Context, username, password, org string) error {
+    creds := models.Credentials{Username: username, Password: password, Org: org}
+    return c.do(ctx, http.MethodPost, "/register", nil, creds, nil, false)
+}
+
+// Login logs in with a password. It returns ErrTOTPRequired when the user
+// also has to enter a two-factor code.
+func (c *Client) Login(ctx context.Context, username, password string) error {
+    creds := models.Credentials{Username: username, Password: password}
+    var response struct {
+        AccessToken  string `json:"access_token"`
+        RefreshToken string `json:"refresh_token"`
+        TOTPRequired bool   `json:"totp_required"`
+        Challenge    string `json:"challenge"`
+    }
+    if err := c.do(ctx, http.MethodPost, "/login", nil, creds, &response, false); err != nil {
+        return err
+    }
+    if response.TOTPRequired {
+        c.mu.Lock()
+        c.challenge = response.Challenge
+        c.mu.Unlock()
+        return ErrTOTPRequired
+    }
+    c.SetTokens(response.AccessToken, response.RefreshToken)
+    return nil
+}
+
+// LoginTOTP finishes a login that returned ErrTOTPRequired with a code from
+// the authenticator, or with one of the recovery codes.
+func (c *Client) LoginTOTP(ctx context.Context, code string) error {
+    c.mu.Lock()
+    challenge := c.challenge
+    c.mu.Unlock()
+    if challenge == "" {
+        return errors.New("apiclient: no two-factor login pending, call Login first")
+    }
+
+    var tokens map[string]string
+    body := map[string]string{"challenge": challenge, "code": code}
+    if err := c.do(ctx, http.MethodPost, "/login/totp", nil, body, &tokens, false); err != nil {
+        return err
+    }
+    c.mu.Lock()
+    c.challenge = ""
+    c.mu.Unlock()
+    c.SetTokens(tokens["access_token"], tokens["refresh_token"])
+    return nil
+}
+
+// Refresh trades the refresh token for a new token pair.
+func (c *Client) Refresh(ctx context.Context) error {
+    c.refreshMu.Lock()
+    defer c.refreshMu.Unlock()
+
+    return c.refresh(ctx)
+}
+
+// refreshAfter refreshes unless another request already replaced the
+// rejected access token.
+func (c *Client) refreshAfter(ctx context.Context, rejected string) error {
+    c.refreshMu.Lock()
+    defer c.refreshMu.Unlock()
+
+    if accessToken, _ := c.Tokens(); accessToken != rejected {
+        return nil
+    }
+    return c.refresh(ctx)
+}
+
+func (c *Client) refresh(ctx context.Context) error {
+    _, refreshToken := c.Tokens()
+    if refreshToken == "" {
+        return errors.New("apiclient: no refresh token, log in first")
+    }
+
+    // Sent once, as a POST without an Idempotency-Key: a refresh token
+    // presented twice revokes the session
+    var tokens map[string]string
+    body := map[string]string{"refresh_token": refreshToken}
+    if err := c.do(ctx, http.MethodPost, "/refresh", nil, body, &tokens, false); err != nil {
+        return err
+    }
+    c.SetTokens(tokens["access_token"], tokens["refresh_token"])
+    return nil
+}
+
+// CreateTask submits a task. The idempotency key makes retries safe: the
+// server returns the original task for a key it has already seen. An empty
+// key is replaced by a random one, which still protects this call's retries.
+func (c *Client) CreateTask(ctx context.Context, task models.Task, idempotencyKey string) (*models.Task, error) {
+    if idempotencyKey == "" {
+        idempotencyKey = uuid.New().String()
+    }
+    header := http.Header{"Idempotency-Key": []string{idempotencyKey}}
+
+    var created models.Task
+    if err := c.do(ctx, http.MethodPost, "/tasks", header, task, &created, true); err != nil {
+        return nil, err
+    }
+    return &created, nil
+}
+
+func (c *Client) GetTask(ctx context.Context, id string) (*models.Task, error) {
+    var task models.Task
+    if err := c.do(ctx, http.MethodGet, "/tasks/"+url.PathEscape(id), nil, nil, &task, true); err != nil {
+        return nil, err
+    }
+    return &task, nil
+}
+
+// ListOptions are the GET /tasks query parameters. Zero values are omitted.
+type ListOptions struct {
+    Status        string
+    Type          string
+    Owner         string
+    Priority      int
+    CreatedAfter  time.Time
+    CreatedBefore time.Time
+    // Sort is "created" or "priority", prefixed with "-" for descending.
+    Sort   string
+    Limit  int
+    Cursor string
+}
+
+func (o ListOptions) query() string {
+    query := url.Values{}
+    set := func(name, value string) {
+        if value != "" {
+            query.Set(name, value)
+        }
+    }
+    set("status", o.Status)
+    set("type", o.Type)
+    set("owner", o.Owner)
+    set("sort", o.Sort)
+    set("cursor", o.Cursor)
+    if o.Priority != 0 {
+        query.Set("priority", strconv.Itoa(o.Priority))
+    }
+    if o.Limit != 0 {
+        query.Set("limit", strconv.Itoa(o.Limit))
+    }
+    if !o.CreatedAfter.IsZero() {
+        query.Set("created_after", o.CreatedAfter.Format(time.RFC3339))
+    }
+    if !o.CreatedBefore.IsZero() {
+        query.Set("created_before", o.CreatedBefore.Format(time.RFC3339))
+    }
+    if len(query) == 0 {
+        return ""
+    }
+    return "?" + query.Encode()
+}
+
+// TaskPage is one page of tasks; NextCursor is empty on the last page.
+type TaskPage struct {
+    Tasks      []models.Task `json:"tasks"`
+    NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+func (c *Client) ListTasks(ctx context.Context, opts ListOptions) (*TaskPage, error) {
+    var page TaskPage
+    if err := c.do(ctx, http.MethodGet, "/tasks"+opts.query(), nil, nil, &page, true); err != nil {
+        return nil, err
+    }
+    return &page, nil
+}
+
+// ListAllTasks follows next_cursor until the last page.
+func (c *Client) ListAllTasks(ctx context.Context, opts ListOptions) ([]models.Task, error) {
+    var tasks []models.Task
+    for {
+        page, err := c.ListTasks(ctx, opts)
+        if err != nil {
+            return tasks, err
+        }
+        tasks = append(tasks, page.Tasks...)
+        if page.NextCursor == "" {
+            return tasks, nil
+        }
+        opts.Cursor = page.NextCursor
+    }
+}
+
+// AuditOptions are the GET /audit query parameters. Zero values are omitted.
+type AuditOptions struct {
+    Actor  string
+    Action string
+    Result string
+    Since  time.Time
+    Until  time.Time
+    Limit  int
+    Cursor string
+}
+
+func (o AuditOptions) query() string {
+    query := url.Values{}
+    set := func(name, value string) {
+        if value != "" {
+            query.Set(name, value)
+        }
+    }
+    set("actor", o.Actor)
+    set("action", o.Action)
+    set("result", o.Result)
+    set("cursor", o.Cursor)
+    if o.Limit != 0 {
+        query.Set("limit", strconv.Itoa(o.Limit))
+    }
+    if !o.Since.IsZero() {
+        query.Set("since", o.Since.Format(time.RFC3339))
+    }
+    if !o.Until.IsZero() {
+        query.Set("until", o.Until.Format(time.RFC3339))
+    }
+    if len(query) == 0 {
+        return ""
+    }
+    return "?" + query.Encode()
+}
+
+// AuditPage is one page of audit events, newest first; NextCursor is empty
+// on the last page.
+type AuditPage struct {
+    Events     []models.AuditEvent `json:"events"`
+    NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+// ListAuditEvents reads the audit log of the caller's organization. Only
+// admins may call it.
+func (c *Client) ListAuditEvents(ctx context.Context, opts AuditOptions) (*AuditPage, error) {
+    var page AuditPage
+    if err := c.do(ctx, http.MethodGet, "/audit"+opts.query(), nil, nil, &page, true); err != nil {
+        return nil, err
+    }
+    return &page, nil
+}
+
+func (c *Client) CancelTask(ctx context.Context, id string) error {
+    return c.do(ctx, http.MethodPost, "/tasks/"+url.PathEscape(id)+"/cancel", nil, nil, nil, true)
+}
+
+// RetryTask re-enqueues a failed task.
+func (c *Client) RetryTask(ctx context.Context, id string) (*models.Task, error) {
+    var task models.Task
+    if err := c.do(ctx, http.MethodPost, "/tasks/"+url.PathEscape(id)+"/retry", nil, nil, &task, true); err != nil {
+        return nil, err
+    }
+    return &task, nil
+}
+
+// QueueDepths returns the number of queued tasks per priority.
+func (c *Client) QueueDepths(ctx context.Context) (map[string]int64, error) {
+    var depths map[string]int64
+    if err := c.do(ctx, http.MethodGet, "/queues", nil, nil, &depths, true); err != nil {
+        return nil, err
+    }
+    return depths, nil
+}
+
+func (c *Client) Workers(ctx context.Context) (map[string]string, error) {
+    var workers map[string]string
+    if err := c.do(ctx, http.MethodGet, "/workers", nil, nil, &workers, true); err != nil {
+        return nil, err
+    }
+    return workers, nil
+}
+
+// Logout ends the session on the server and forgets the tokens.
+func (c *Client) Logout(ctx context.Context) error {
+    if err := c.do(ctx, http.MethodPost, "/logout", nil, nil, nil, true); err != nil {
+        return err
+    }
+    c.SetTokens("", "")
+    return nil
+}
+
+func (c *Client) ListUsers(ctx context.Context) ([]models.User, error) {
+    var users []models.User
+    if err := c.do(ctx, http.MethodGet, "/users", nil, nil, &users, true); err != nil {
+        return nil, err
+    }
+    return users, nil
+}
+
+// CreateUser adds a member to the caller's organization; an empty role
+// defaults to producer.
+func (c *Client) CreateUser(ctx context.Context, username, password, role string) (*models.User, error) {
+    body := map[string]string{"username": username, "password": password, "role": role}
+    var user models.User
+    if err := c.do(ctx, http.MethodPost, "/users", nil, body, &user, true); err != nil {
+        return nil, err
+    }
+    return &user, nil
+}
+
+// SetUserRole assigns a role; it applies from the user's next login or
+// token refresh.
+func (c *Client) SetUserRole(ctx context.Context, username, role string) error {
+    body := map[string]string{"role": role}
+    return c.do(ctx, http.MethodPut, "/users/"+url.PathEscape(username)+"/role", nil, body, nil, true)
+}
+
+// ChangePassword replaces the caller's password. The server ends all of
+// the caller's sessions, so the client forgets its tokens; log in again.
+func (c *Client) ChangePassword(ctx context.Context, current, password string) error {
+    body := map[string]string{"current_password": current, "new_password": password}
+    if err := c.do(ctx, http.MethodPut, "/me/password", nil, body, nil, true); err != nil {
+        return err
+    }
+    c.SetTokens("", "")
+    return nil
+}
+
+// BeginTOTPEnrollment generates a TOTP secret for the caller, to be added
+// to an authenticator app and confirmed with ConfirmTOTPEnrollment.
+func (c *Client) BeginTOTPEnrollment(ctx context.Context, password string) (secret, uri string, err error) {
+    body := map[string]string{"password": password}
+    var enrollment map[string]string
+    if err := c.do(ctx, http.MethodPost, "/me/totp", nil, body, &enrollment, true); err != nil {
+        return "", "", err
+    }
+    return enrollment["secret"], enrollment["uri"], nil
+}
+
+// ConfirmTOTPEnrollment enables two-factor authentication and returns the
+// recovery codes, which the server does not show again.
+func (c *Client) ConfirmTOTPEnrollment(ctx context.Context, code string) ([]string, error) {
+    body := map[string]string{"code": code}
+    var response map[string][]string
+    if err := c.do(ctx, http.MethodPost, "/me/totp/confirm", nil, body, &response, true); err != nil {
+        return nil, err
+    }
+    return response["recovery_codes"], nil
+}
+
+// DisableTOTP turns the caller's two-factor authentication off.
+func (c *Client) DisableTOTP(ctx context.Context, password, code string) error {
+    body := map[string]string{"password": password, "code": code}
+    return c.do(ctx, http.MethodDelete, "/me/totp", nil, body, nil, true)
+}
+
+// ResetTOTP removes the two-factor enrollment of a user in the caller's
+// organization.
+func (c *Client) ResetTOTP(ctx context.Context, username string) error {
+    return c.do(ctx, http.MethodDelete, "/users/"+url.PathEscape(username)+"/totp", nil, nil, nil, true)
+}
+
+// ResetPassword sets the password of a user in the caller's organization
+// and lifts a lockout.
+func (c *Client) ResetPassword(ctx context.Context, username, password string) error {
+    body := map[string]string{"password": password}
+    return c.do(ctx, http.MethodPut, "/users/"+url.PathEscape(username)+"/password", nil, body, nil, true)
+}
+
+// SetUserDisabled disables a user, ending their sessions, or enables them.
+func (c *Client) SetUserDisabled(ctx context.Context, username string, disabled bool) error {
+    body := map[string]bool{"disabled": disabled}
+    return c.do(ctx, http.MethodPut, "/users/"+url.PathEscape(username)+"/disabled", nil, body, nil, true)
+}
+
+// OrgQuota returns an organization's quota. Only admins of the default
+// organization may call it.
+func (c *Client) OrgQuota(ctx context.Context, org string) (*models.Quota, error) {
+    var quota models.Quota
+    if err := c.do(ctx, http.MethodGet, "/orgs/"+url.PathEscape(org)+"/quota", nil, nil, &quota, true); err != nil {
+        return nil, err
+    }
+    return &quota, nil
+}
+
+// MyQuota returns the quota of the caller's organization and how much of it
+// the organization and the caller have used.
+func (c *Client) MyQuota(ctx context.Context) (*models.QuotaReport, error) {
+    var report models.QuotaReport
+    if err := c.do(ctx, http.MethodGet, "/me/quota", nil, nil, &report, true); err != nil {
+        return nil, err
+    }
+    return &report, nil
+}
+
+func (c *Client) SetOrgQuota(ctx context.Context, org string, quota models.Quota) error {
+    return c.do(ctx, http.MethodPut, "/orgs/"+url.PathEscape(org)+"/quota", nil, quota, nil, true)
+}
+
+// RevokeSessions logs a user of the caller's organization out everywhere.
+func (c *Client) RevokeSessions(ctx context.Context, username string) error {
+    return c.do(ctx, http.MethodDelete, "/users/"+url.PathEscape(username)+"/sessions", nil, nil, nil, true)
+}
+
+// ListServiceAccounts lists the service accounts of the caller's
+// organization.
+func (c *Client) ListServiceAccounts(ctx context.Context) ([]models.User, error) {
+    var accounts []models.User
+    if err := c.do(ctx, http.MethodGet, "/service-accounts", nil, nil, &accounts, true); err != nil {
+        return nil, err
+    }
+    return accounts, nil
+}
+
+func (c *Client) CreateServiceAccount(ctx context.Context, name string) (*models.User, error) {
+    body := map[string]string{"name": name}
+    var account models.User
+    if err := c.do(ctx, http.MethodPost, "/service-accounts", nil, body, &account, true); err != nil {
+        return nil, err
+    }
+    return &account, nil
+}
+
+func (c *Client) ListAPIKeys(ctx context.Context, account string) ([]models.APIKey, error) {
+    var keys []models.APIKey
+    if err := c.do(ctx, http.MethodGet, "/service-accounts/"+url.PathEscape(account)+"/keys", nil, nil, &keys, true); err != nil {
+        return nil, err
+    }
+    return keys, nil
+}
+
+// CreateAPIKey issues a key for a service account and returns its secret,
+// which the server does not show again. A nil expires never expires.
+func (c *Client) CreateAPIKey(ctx context.Context, account string, scopes []string, expires *time.Time) (string, *models.APIKey, error) {
+    body := map[string]interface{}{"scopes": scopes, "expires": expires}
+    var created struct {
+        Key    string        `json:"key"`
+        APIKey models.APIKey `json:"api_key"`
+    }
+    if err := c.do(ctx, http.MethodPost, "/service-accounts/"+url.PathEscape(account)+"/keys", nil, body, &created, true); err != nil {
+        return "", nil, err
+    }
+    return created.Key, &created.APIKey, nil
+}
+
+// SetAPIKeyExpiry moves a key's expiry; a past time expires it at once and
+// nil removes the expiry.
+func (c *Client) SetAPIKeyExpiry(ctx context.Context, account, id string, expires *time.Time) error {
+    body := map[string]interface{}{"expires": expires}
+    return c.do(ctx, http.MethodPut, "/service-accounts/"+url.PathEscape(account)+"/keys/"+url.PathEscape(id), nil, body, nil, true)
+}
+
+func (c *Client) RevokeAPIKey(ctx context.Context, account, id string) error {
+    return c.do(ctx, http.MethodDelete, "/service-accounts/"+url.PathEscape(account)+"/keys/"+url.PathEscape(id), nil, nil, nil, true)
+}
+
+// Delivery is a task handed to a remote worker.
+type Delivery struct {
+    Task    *models.Task `json:"task"`
+    Receipt string       `json:"receipt"`
+}
+
+// Dequeue takes the next task for processing. It returns nil when the queues
+// are empty.
+func (c *Client) Dequeue(ctx context.Context) (*Delivery, error) {
+    var delivery Delivery
+    if err := c.do(ctx, http.MethodPost, "/worker/dequeue", nil, nil, &delivery, true); err != nil {
+        return nil, err
+    }
+    if delivery.Task == nil {
+        return nil, nil
+    }
+    return &delivery, nil
+}
+
+// AckTask reports the outcome of a delivery. A non-nil taskErr fails the
+// attempt and the server retries the task.
+func (c *Client) AckTask(ctx context.Context, delivery *Delivery, taskErr error) (*models.Task, error) {
+    body := map[string]string{"receipt": delivery.Receipt}
+    if taskErr != nil {
+        body["error"] = taskErr.Error()
+    }
+
+    var task models.Task
+    path := "/worker/tasks/" + url.PathEscape(delivery.Task.ID) + "/ack"
+    if err := c.do(ctx, http.MethodPost, path, nil, body, &task, true); err != nil {
+        return nil, err
+    }
+    return &task, nil
+}
+
+// WaitForTask polls the task until it reaches a final status or ctx ends.
+func (c *Client) WaitForTask(ctx context.Context, id string, pollInterval time.Duration) (*models.Task, error) {
+    for {
+        task, err := c.GetTask(ctx, id)
+        if err != nil {
+            return nil, err
+        }
+        if IsFinal(task.Status) {
+            return task, nil
+        }
+
+        select {
+        case <-ctx.Done():
+            return task, ctx.Err()
+        case <-time.After(pollInterval):
+        }
+    }
+}
+
+// IsFinal reports whether a task in this status will not change again.
+func IsFinal(status string) bool {
+    return status == "completed" || status == "failed" || status == "cancelled"
+}
+
+// do sends the request, retrying 429, 5xx and transport errors with backoff
+// when retrySafe allows it. On an authenticated request a 401 triggers one
+// token refresh.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, in, out interface{}, authenticated bool) error {
+    var body []byte
+    if in != nil {
+        var err error
+        if body, err = json.Marshal(in); err != nil {
+            return err
+        }
+    }
+
+    maxRetries := c.MaxRetries
+    if !retrySafe(method, header) {
+        maxRetries = 0
+    }
+
+    refreshed := false
+    for attempt := 0; ; attempt++ {
+        var accessToken string
+        if authenticated {
+            accessToken, _ = c.Tokens()
+        }
+        resp, err := c.send(ctx, method, path, header, body, accessToken)
+        if err == nil && resp.StatusCode == http.StatusUnauthorized && authenticated && !refreshed {
+            resp.Body.Close()
+            refreshed = true
+            if err := c.refreshAfter(ctx, accessToken); err != nil {
+                return err
+            }
+            attempt--
+            continue
+        }
+
+        if attempt < maxRetries && retryable(resp, err) && ctx.Err() == nil {
+            delay := c.backoff(attempt, resp)
+            if resp != nil {
+                resp.Body.Close()
+            }
+            select {
+            case <-ctx.Done():
+                return ctx.Err()
+            case <-time.After(delay):
+            }
+            continue
+        }
+        if err != nil {
+            return err
+        }
+        defer resp.Body.Close()
+
+        if resp.StatusCode < 200 || resp.StatusCode > 299 {
+            body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+            return parseError(resp.StatusCode, body)
+        }
+        if out != nil && resp.StatusCode != http.StatusNoContent {
+            return json.NewDecoder(resp.Body).Decode(out)
+        }
+        return nil
+    }
+}
+
+// send issues one request, authenticated when accessToken is set.
+func (c *Client) send(ctx context.Context, method, path string, header http.Header, body []byte, accessToken string) (*http.Response, error) {
+    req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    for name, values := range header {
+        req.Header[name] = values
+    }
+    if body != nil {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    if accessToken != "" {
+        req.Header.Set("Authorization", "Bearer "+accessToken)
+    }
+    return c.HTTPClient.Do(req)
+}
+
+// retrySafe reports whether a request may be sent again after a failure the
+// server may already have acted on. A retried POST /worker/dequeue, for one,
+// would lose the task delivered by the first attempt.
+func retrySafe(method string, header http.Header) bool {
+    switch method {
+    case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+        return true
+    }
+    return header.Get("Idempotency-Key") != ""
+}
+
+func retryable(resp *http.Response, err error) bool {
+    if err != nil {
+        return true
+    }
+    return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// backoff honours Retry-After when the server sends it and otherwise uses
+// exponential backoff with jitter.
+func (c *Client) backoff(attempt int, resp *http.Response) time.Duration {
+    if resp != nil {
+        if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+            return time.Duration(seconds) * time.Second
+        }
+    }
+
+    delay := c.Backoff << uint(attempt)
+    if delay <= 0 || delay > c.MaxBackoff {
+        delay = c.MaxBackoff
+    }
+    return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,350 @@
+package apiclient_test
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/http/cookiejar"
+    "net/http/httptest"
+    "sync/atomic"
+    "task_queue_system/apiclient"
+    "task_queue_system/auth"
+    "task_queue_system/inmemory"
+    "task_queue_system/models"
+    "task_queue_system/oidcmock"
+    "task_queue_system/queue"
+    "task_queue_system/workers"
+    "testing"
+    "time"
+)
+
+// newSystem serves an in-memory system whose workers complete every task.
+// Rate limiting is off, as the tests log in more often than the auth
+// budget allows.
+func newSystem(t *testing.T, numWorkers int) (*inmemory.System, *httptest.Server) {
+    t.Helper()
+    handler := workers.HandlerFunc(func(ctx context.Context, task *models.Task) error {
+        return nil
+    })
+    sys, err := inmemory.New(numWorkers, handler)
+    if err != nil {
+        t.Fatalf("inmemory.New: %v", err)
+    }
+    sys.Server.Limiter = nil
+    sys.Start()
+    t.Cleanup(sys.Stop)
+
+    server := httptest.NewServer(sys.Server.Routes())
+    t.Cleanup(server.Close)
+    return sys, server
+}
+
+// newClient registers a user in a new organization and logs in as its admin.
+func newClient(t *testing.T, baseURL, username string) *apiclient.Client {
+    t.Helper()
+    ctx := context.Background()
+    c := apiclient.New(baseURL, nil)
+    c.Backoff = time.Millisecond
+    if err := c.RegisterOrg(ctx, username, "correct-horse-1", username+"org"); err != nil {
+        t.Fatalf("RegisterOrg: %v", err)
+    }
+    if err := c.Login(ctx, username, "correct-horse-1"); err != nil {
+        t.Fatalf("Login: %v", err)
+    }
+    return c
+}
+
+func TestLogin(t *testing.T) {
+    _, server := newSystem(t, 0)
+    c := newClient(t, server.URL, "alice")
+
+    accessToken, refreshToken := c.Tokens()
+    if accessToken == "" || refreshToken == "" {
+        t.Fatalf("Tokens() = %q, %q, want both set", accessToken, refreshToken)
+    }
+    if _, err := c.ListTasks(context.Background(), apiclient.ListOptions{}); err != nil {
+        t.Fatalf("ListTasks: %v", err)
+    }
+
+    other := apiclient.New(server.URL, nil)
+    err := other.Login(context.Background(), "alice", "wrong-password")
+    if statusOf(err) != http.StatusUnauthorized {
+        t.Fatalf("Login with a wrong password = %v, want a 401", err)
+    }
+}
+
+func TestUnauthorizedRefreshes(t *testing.T) {
+    _, server := newSystem(t, 0)
+    c := newClient(t, server.URL, "bob")
+    ctx := context.Background()
+
+    _, refreshToken := c.Tokens()
+    c.SetTokens("expired", refreshToken)
+    if _, err := c.ListTasks(ctx, apiclient.ListOptions{}); err != nil {
+        t.Fatalf("ListTasks after the access token was rejected: %v", err)
+    }
+    accessToken, newRefreshToken := c.Tokens()
+    if accessToken == "expired" || newRefreshToken == refreshToken {
+        t.Fatal("tokens were not refreshed")
+    }
+
+    // A refresh token is accepted once
+    c.SetTokens("expired", refreshToken)
+    if _, err := c.ListTasks(ctx, apiclient.ListOptions{}); err == nil {
+        t.Fatal("ListTasks succeeded with a used refresh token")
+    }
+}
+
+// throttle answers the first n requests to path with 429 and Retry-After,
+// counting every request to it.
+func throttle(next http.Handler, path string, n int32, count *int32) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == path && atomic.AddInt32(count, 1) <= n {
+            w.Header().Set("Retry-After", "0")
+            w.WriteHeader(http.StatusTooManyRequests)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+func TestRetryAfterThrottling(t *testing.T) {
+    sys, server := newSystem(t, 0)
+    c := newClient(t, server.URL, "carol")
+    ctx := context.Background()
+
+    var tasks, dequeues int32
+    routes := sys.Server.Routes()
+    throttled := httptest.NewServer(throttle(throttle(routes, "/tasks", 2, &tasks), "/worker/dequeue", 1, &dequeues))
+    defer throttled.Close()
+    c.BaseURL = throttled.URL
+
+    if _, err := c.CreateTask(ctx, models.Task{Data: "payload", Priority: 1}, ""); err != nil {
+        t.Fatalf("CreateTask: %v", err)
+    }
+    if atomic.LoadInt32(&tasks) != 3 {
+        t.Fatalf("POST /tasks sent %d times, want 3", tasks)
+    }
+
+    // A retried dequeue could lose the task the first attempt delivered
+    _, err := c.Dequeue(ctx)
+    if statusOf(err) != http.StatusTooManyRequests {
+        t.Fatalf("Dequeue = %v, want a 429", err)
+    }
+    if atomic.LoadInt32(&dequeues) != 1 {
+        t.Fatalf("POST /worker/dequeue sent %d times, want 1", dequeues)
+    }
+}
+
+func TestIdempotencyKeyReplay(t *testing.T) {
+    _, server := newSystem(t, 0)
+    c := newClient(t, server.URL, "dave")
+    ctx := context.Background()
+
+    first, err := c.CreateTask(ctx, models.Task{Data: "once", Priority: 2}, "order-17")
+    if err != nil {
+        t.Fatalf("CreateTask: %v", err)
+    }
+    replay, err := c.CreateTask(ctx, models.Task{Data: "once", Priority: 2}, "order-17")
+    if err != nil {
+        t.Fatalf("CreateTask replay: %v", err)
+    }
+    if replay.ID != first.ID {
+        t.Fatalf("replay returned task %s, want %s", replay.ID, first.ID)
+    }
+
+    depths, err := c.QueueDepths(ctx)
+    if err != nil {
+        t.Fatalf("QueueDepths: %v", err)
+    }
+    if depths["medium"] != 1 {
+        t.Fatalf("QueueDepths() = %v, want one medium task", depths)
+    }
+}
+
+func TestWaitForTask(t *testing.T) {
+    sys, server := newSystem(t, 0)
+    c := newClient(t, server.URL, "erin")
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    // In-process workers serve the default organization only, so a worker
+    // account of erin's organization processes the task remotely
+    if _, err := c.CreateUser(ctx, "erinworker", "correct-horse-1", "worker"); err != nil {
+        t.Fatalf("CreateUser: %v", err)
+    }
+    worker := apiclient.New(server.URL, nil)
+    if err := worker.Login(ctx, "erinworker", "correct-horse-1"); err != nil {
+        t.Fatalf("Login: %v", err)
+    }
+
+    task, err := c.CreateTask(ctx, models.Task{Data: "work", Priority: 3}, "")
+    if err != nil {
+        t.Fatalf("CreateTask: %v", err)
+    }
+    go func() {
+        delivery, err := worker.Dequeue(ctx)
+        if err != nil || delivery == nil {
+            t.Errorf("Dequeue = %v, %v", delivery, err)
+            return
+        }
+        time.Sleep(50 * time.Millisecond)
+        if _, err := worker.AckTask(ctx, delivery, nil); err != nil {
+            t.Errorf("AckTask: %v", err)
+        }
+    }()
+
+    done, err := c.WaitForTask(ctx, task.ID, 10*time.Millisecond)
+    if err != nil {
+        t.Fatalf("WaitForTask: %v", err)
+    }
+    if done.Status != "completed" {
+        t.Fatalf("task finished as %s, want completed", done.Status)
+    }
+    if _, err := sys.Store.GetTask(task.ID); err != nil {
+        t.Fatalf("store lost the task: %v", err)
+    }
+}
+
+func TestInProcessWorkers(t *testing.T) {
+    _, server := newSystem(t, 2)
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    c := apiclient.New(server.URL, nil)
+    if err := c.Register(ctx, "frank", "correct-horse-1"); err != nil {
+        t.Fatalf("Register: %v", err)
+    }
+    if err := c.Login(ctx, "frank", "correct-horse-1"); err != nil {
+        t.Fatalf("Login: %v", err)
+    }
+    task, err := c.CreateTask(ctx, models.Task{Data: "work", Priority: 1}, "")
+    if err != nil {
+        t.Fatalf("CreateTask: %v", err)
+    }
+    done, err := c.WaitForTask(ctx, task.ID, 10*time.Millisecond)
+    if err != nil || done.Status != "completed" {
+        t.Fatalf("WaitForTask = %v, %v, want a completed task", done, err)
+    }
+}
+
+// flakyBackend fails the first failures pushes.
+type flakyBackend struct {
+    queue.Backend
+    failures int32
+}
+
+func (b *flakyBackend) Push(ctx context.Context, task models.Task) error {
+    if atomic.AddInt32(&b.failures, -1) >= 0 {
+        return errors.New("backend unavailable")
+    }
+    return b.Backend.Push(ctx, task)
+}
+
+func TestRetryAfterFailedPush(t *testing.T) {
+    sys, err := inmemory.New(1, workers.HandlerFunc(func(ctx context.Context, task *models.Task) error {
+        return nil
+    }))
+    if err != nil {
+        t.Fatalf("inmemory.New: %v", err)
+    }
+    sys.Server.Limiter = nil
+    sys.Queue.Backend = &flakyBackend{Backend: sys.Queue.Backend, failures: 1}
+    sys.Start()
+    defer sys.Stop()
+    server := httptest.NewServer(sys.Server.Routes())
+    defer server.Close()
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+
+    c := apiclient.New(server.URL, nil)
+    c.Backoff = time.Millisecond
+    if err := c.Register(ctx, "ivan", "correct-horse-1"); err != nil {
+        t.Fatalf("Register: %v", err)
+    }
+    if err := c.Login(ctx, "ivan", "correct-horse-1"); err != nil {
+        t.Fatalf("Login: %v", err)
+    }
+
+    // The first attempt's 500 is retried with the same Idempotency-Key,
+    // which must queue the task rather than return the unqueued one
+    task, err := c.CreateTask(ctx, models.Task{Data: "work", Priority: 1}, "push-fails-once")
+    if err != nil {
+        t.Fatalf("CreateTask: %v", err)
+    }
+    done, err := c.WaitForTask(ctx, task.ID, 10*time.Millisecond)
+    if err != nil || done.Status != "completed" {
+        t.Fatalf("WaitForTask = %v, %v, want a completed task", done, err)
+    }
+}
+
+func TestOIDCLogin(t *testing.T) {
+    provider, err := oidcmock.NewServer("dtq", "secret", map[string]interface{}{
+        "sub": "1234", "preferred_username": "grace", "groups": []string{"dtq-producers"},
+    })
+    if err != nil {
+        t.Fatalf("oidcmock.NewServer: %v", err)
+    }
+    defer provider.Close()
+
+    sys, err := inmemory.New(0, nil)
+    if err != nil {
+        t.Fatalf("inmemory.New: %v", err)
+    }
+    sys.Server.Limiter = nil
+    server := httptest.NewUnstartedServer(nil)
+    server.Start()
+    defer server.Close()
+    sys.Server.OIDC, err = auth.NewOIDCProvider(context.Background(), auth.OIDCConfig{
+        Issuer:       provider.Issuer,
+        ClientID:     "dtq",
+        ClientSecret: "secret",
+        RedirectURL:  server.URL + "/oidc/callback",
+        RolesClaim:   "groups",
+        RoleMap:      map[string]string{"dtq-producers": "producer"},
+    })
+    if err != nil {
+        t.Fatalf("NewOIDCProvider: %v", err)
+    }
+    server.Config.Handler = sys.Server.Routes()
+
+    // The browser's part: follow the redirects through the provider, with
+    // the state cookie, back to the callback that returns the tokens
+    jar, _ := cookiejar.New(nil)
+    browser := &http.Client{Jar: jar}
+    resp, err := browser.Get(server.URL + "/oidc/login")
+    if err != nil {
+        t.Fatalf("GET /oidc/login: %v", err)
+    }
+    defer resp.Body.Close()
+    var tokens map[string]string
+    if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil || resp.StatusCode != http.StatusOK {
+        t.Fatalf("OIDC login = %d, %v", resp.StatusCode, err)
+    }
+
+    c := apiclient.New(server.URL, nil)
+    c.SetTokens(tokens["access_token"], tokens["refresh_token"])
+    task, err := c.CreateTask(context.Background(), models.Task{Data: "federated", Priority: 1}, "")
+    if err != nil {
+        t.Fatalf("CreateTask: %v", err)
+    }
+    if task.Owner != "grace" {
+        t.Fatalf("task owner = %q, want grace", task.Owner)
+    }
+    if err := c.Refresh(context.Background()); err != nil {
+        t.Fatalf("Refresh: %v", err)
+    }
+    if _, err := c.CreateUser(context.Background(), "mallory", "correct-horse-1", "admin"); statusOf(err) != http.StatusForbidden {
+        t.Fatalf("producer CreateUser = %v, want a 403", err)
+    }
+}
+
+// statusOf returns the status code of an API error, or 0 for other errors.
+func statusOf(err error) int {
+    var apiErr *apiclient.Error
+    if errors.As(err, &apiErr) {
+        return apiErr.StatusCode
+    }
+    return 0
+}
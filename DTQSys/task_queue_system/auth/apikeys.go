@@ -0,0 +1,166 @@
+package auth
+
+import (
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "strings"
+    "task_queue_system/db"
+    "task_queue_system/models"
+    "time"
+)
+
+// APIKeyPrefix starts every API key, so the auth middleware can tell keys
+// from JWTs and leaked keys are easy to search for.
+const APIKeyPrefix = "dtq_"
+
+// ScopeEnqueuePrefix scopes submission to one task type: enqueue:emails, or
+// enqueue:* for any type.
+const ScopeEnqueuePrefix = "enqueue:"
+
+// scopePermissions maps the other scopes to the permissions they grant.
+// Keys never manage users, keys or organizations.
+var scopePermissions = map[string][]string{
+    "read:tasks":    {PermReadTasks, PermReadAllTasks},
+    "manage:tasks":  {PermManageTasks, PermManageAllTasks},
+    "read:system":   {PermReadSystem},
+    "process:tasks": {PermProcessTasks},
+}
+
+var (
+    ErrInvalidAPIKey = errors.New("invalid API key")
+    ErrNotService    = errors.New("not a service account")
+)
+
+// ValidScope reports whether scope is one an API key can hold.
+func ValidScope(scope string) bool {
+    if strings.HasPrefix(scope, ScopeEnqueuePrefix) {
+        return len(scope) > len(ScopeEnqueuePrefix)
+    }
+    _, ok := scopePermissions[scope]
+    return ok
+}
+
+// ScopesPermit reports whether the scopes grant the permission.
+func ScopesPermit(scopes []string, permission string) bool {
+    for _, scope := range scopes {
+        if strings.HasPrefix(scope, ScopeEnqueuePrefix) && permission == PermSubmitTasks {
+            return true
+        }
+        for _, p := range scopePermissions[scope] {
+            if p == permission {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// ScopesAllowType reports whether the scopes allow submitting tasks of the
+// type.
+func ScopesAllowType(scopes []string, taskType string) bool {
+    for _, scope := range scopes {
+        if scope == ScopeEnqueuePrefix+"*" || scope == ScopeEnqueuePrefix+taskType {
+            return true
+        }
+    }
+    return false
+}
+
+// CreateServiceAccount adds a service account to the organization. It has
+// no password and authenticates only with its API keys.
+func CreateServiceAccount(store db.Store, name, org string) (*models.User, error) {
+    exists, err := store.UserExists(name)
+    if err != nil {
+        return nil, err
+    }
+    if exists {
+        return nil, ErrUserExists
+    }
+
+    account := models.User{Username: name, Role: RoleService, Org: org}
+    if err := store.CreateUser(account, ""); err != nil {
+        return nil, err
+    }
+    return &account, nil
+}
+
+// CreateAPIKey issues a key for the service account and returns its secret,
+// which cannot be recovered later.
+func CreateAPIKey(store db.Store, account models.User, scopes []string, expires *time.Time) (string, *models.APIKey, error) {
+    if account.Role != RoleService {
+        return "", nil, ErrNotService
+    }
+
+    id := make([]byte, 8)
+    secret := make([]byte, 32)
+    if _, err := rand.Read(id); err != nil {
+        return "", nil, err
+    }
+    if _, err := rand.Read(secret); err != nil {
+        return "", nil, err
+    }
+    encoded := base64.RawURLEncoding.EncodeToString(secret)
+
+    key := models.APIKey{
+        ID:      hex.EncodeToString(id),
+        Account: account.Username,
+        Org:     account.Org,
+        Scopes:  scopes,
+        Created: time.Now().UTC(),
+        Expires: expires,
+        Hash:    hashSecret(encoded),
+    }
+    if err := store.CreateAPIKey(key); err != nil {
+        return "", nil, err
+    }
+    return APIKeyPrefix + key.ID + "_" + encoded, &key, nil
+}
+
+// ValidateAPIKey returns the key record for a presented API key if it is
+// neither revoked nor expired.
+func ValidateAPIKey(store db.Store, apiKey string) (*models.APIKey, error) {
+    parts := strings.SplitN(strings.TrimPrefix(apiKey, APIKeyPrefix), "_", 2)
+    if !IsAPIKey(apiKey) || len(parts) != 2 {
+        return nil, ErrInvalidAPIKey
+    }
+    id, secret := parts[0], parts[1]
+
+    key, err := store.GetAPIKey(id)
+    if err == db.ErrNotFound {
+        return nil, ErrInvalidAPIKey
+    } else if err != nil {
+        return nil, err
+    }
+    if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hashSecret(secret))) != 1 {
+        return nil, ErrInvalidAPIKey
+    }
+    if key.Revoked || (key.Expires != nil && !time.Now().Before(*key.Expires)) {
+        return nil, ErrInvalidAPIKey
+    }
+
+    // Disabling a service account stops all of its keys
+    account, err := store.GetUser(key.Account)
+    if err == db.ErrNotFound || (err == nil && account.Disabled) {
+        return nil, ErrInvalidAPIKey
+    } else if err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+// IsAPIKey reports whether a bearer credential is an API key rather than a
+// JWT.
+func IsAPIKey(credential string) bool {
+    return strings.HasPrefix(credential, APIKeyPrefix)
+}
+
+// hashSecret hashes a key secret. The secrets are random 256-bit values, so
+// a fast hash is enough and keeps per-request checks cheap.
+func hashSecret(secret string) string {
+    sum := sha256.Sum256([]byte(secret))
+    return hex.EncodeToString(sum[:])
+}
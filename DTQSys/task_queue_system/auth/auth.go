@@ -1,97 +1,299 @@
 package auth
 
 import (
-    "database/sql"
+    "context"
     "errors"
-    "os"
-    "time"
+    "sync"
+    "task_queue_system/db"
     "task_queue_system/models"
+    "time"
 
     "github.com/golang-jwt/jwt/v5"
+    "github.com/google/uuid"
     "golang.org/x/crypto/bcrypt"
 )
 
-var jwtKey = []byte(os.Getenv("JWT_SECRET_KEY"))
+// Token types. Each is only accepted where it belongs: access tokens by the
+// API, refresh tokens by /refresh.
+const (
+    TokenAccess  = "access"
+    TokenRefresh = "refresh"
+)
+
+const (
+    AccessTokenTTL  = 15 * time.Minute   // Short-lived access token
+    RefreshTokenTTL = 7 * 24 * time.Hour // Long-lived refresh token
+)
+
+func init() {
+    // Tokens carry millisecond issue times so that a user revocation can
+    // tell the tokens issued just before it from those issued just after,
+    // such as the ones a password change hands out
+    jwt.TimePrecision = time.Millisecond
+}
+
+var (
+    // ErrInvalidCredentials is the one error a failed password login
+    // reports, whether the user is unknown, disabled or locked out or the
+    // password is wrong, so that logins do not reveal which users exist.
+    ErrInvalidCredentials = errors.New("invalid username or password")
+    ErrInvalidToken       = errors.New("invalid token")
+    // ErrTokenReuse means a refresh token was presented after it had been
+    // exchanged, so it may have been stolen; its session is revoked.
+    ErrTokenReuse = errors.New("refresh token reused, session revoked")
+)
 
 type Claims struct {
     Username string `json:"username"`
+    Role     string `json:"role"`
+    Org      string `json:"org"`
+    Type     string `json:"token_type"`
+    // SessionID is shared by every token obtained from one login.
+    SessionID string `json:"sid"`
     jwt.RegisteredClaims
 }
 
-func RegisterUser(db *sql.DB, username, password string) error {
+// ErrOrgExists is returned when someone registers into an existing
+// organization; its admins add members instead.
+var ErrOrgExists = errors.New("organization already exists, ask one of its admins for an account")
+
+// ErrUserExists is returned when creating a user or service account whose
+// name is taken.
+var ErrUserExists = errors.New("user already exists")
+
+// RegisterUser signs up a user. Without an org the user joins the default
+// organization; naming a new org creates it with the user as its admin.
+func RegisterUser(store db.Store, username, password, org string) error {
+    user := models.User{Username: username, Role: bootstrapRole(username), Org: db.DefaultOrg}
+    if org != "" && org != db.DefaultOrg {
+        exists, err := store.OrgExists(org)
+        if err != nil {
+            return err
+        }
+        if exists {
+            return ErrOrgExists
+        }
+        user.Role, user.Org = RoleAdmin, org
+    }
+    return CreateUser(store, user, password)
+}
+
+// CreateUser adds a user with the given role and organization.
+func CreateUser(store db.Store, user models.User, password string) error {
     // Check if the user already exists
-    var exists bool
-    err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username=$1)", username).Scan(&exists)
+    exists, err := store.UserExists(user.Username)
     if err != nil {
         return err
     }
     if exists {
-        return errors.New("user already exists")
+        return ErrUserExists
+    }
+
+    if err := Policy.Check(user.Username, password); err != nil {
+        return err
     }
 
     // Hash the password
-    passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    passwordHash, err := hashPassword(password)
     if err != nil {
         return err
     }
 
     // Insert the new user
-    _, err = db.Exec("INSERT INTO users (username, password_hash) VALUES ($1, $2)", username, string(passwordHash))
-    return err
+    return store.CreateUser(user, passwordHash)
 }
 
-func AuthenticateUser(db *sql.DB, username, password string) (string, string, error) {
-    var passwordHash string
-    err := db.QueryRow("SELECT password_hash FROM users WHERE username=$1", username).Scan(&passwordHash)
+// AuthenticateUser checks a password login. Users without two-factor
+// authentication get the tokens of a new session; for the others only a
+// challenge is returned, to be completed with CompleteTOTPLogin. Every
+// failure is reported as ErrInvalidCredentials.
+func AuthenticateUser(store db.Store, username, password string) (accessToken, refreshToken, challenge string, err error) {
+    record, err := verifyPassword(store, username, password)
     if err != nil {
-        if err == sql.ErrNoRows {
-            return "", "", errors.New("user not found")
+        return "", "", "", err
+    }
+
+    // The failure count is kept until the code is checked too, so that
+    // knowing the password does not allow unlimited guesses at the code
+    if record.TOTPEnabled {
+        challenge, err = totpChallenge(username)
+        return "", "", challenge, err
+    }
+    if record.FailedLogins > 0 {
+        if err := store.ResetLoginFailures(username); err != nil {
+            return "", "", "", err
         }
-        return "", "", err
     }
 
-    // Compare the provided password with the stored hash
-    err = bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password))
+    user, err := store.GetUser(username)
     if err != nil {
-        return "", "", errors.New("invalid credentials")
+        return "", "", "", err
     }
 
     // Generate tokens
-    accessToken, refreshToken, err := GenerateTokens(username)
+    accessToken, refreshToken, err = GenerateTokens(store, *user)
+    if err != nil {
+        return "", "", "", err
+    }
+
+    return accessToken, refreshToken, "", nil
+}
+
+// verifyPassword checks the password, counting failures towards a lockout,
+// and returns the user's login record.
+func verifyPassword(store db.Store, username, password string) (*models.LoginRecord, error) {
+    record, err := store.LoginRecord(username)
+    if err != nil && err != db.ErrNotFound {
+        return nil, err
+    }
+
+    // Compare even when the login fails anyway, so that every failure
+    // takes as long as a wrong password
+    passwordHash := dummyPasswordHash()
+    if record != nil && record.PasswordHash != "" {
+        passwordHash = []byte(record.PasswordHash)
+    }
+    match := bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) == nil
+
+    now := time.Now()
+    if record == nil || record.PasswordHash == "" || record.Disabled || now.Before(lockedUntil(record)) {
+        return nil, ErrInvalidCredentials
+    }
+    if !match {
+        if err := store.RecordLoginFailure(username, now); err != nil {
+            return nil, err
+        }
+        return nil, ErrInvalidCredentials
+    }
+    return record, nil
+}
+
+var (
+    dummyHashOnce sync.Once
+    dummyHash     []byte
+)
+
+// dummyPasswordHash is compared against when the user has no password.
+func dummyPasswordHash() []byte {
+    dummyHashOnce.Do(func() {
+        dummyHash, _ = bcrypt.GenerateFromPassword([]byte(uuid.New().String()), bcrypt.DefaultCost)
+    })
+    return dummyHash
+}
+
+func hashPassword(password string) (string, error) {
+    passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+    return string(passwordHash), err
+}
+
+// GenerateTokens starts a new session for the user and returns its first
+// token pair.
+func GenerateTokens(store db.Store, user models.User) (accessToken string, refreshToken string, err error) {
+    return issueTokens(store, user, uuid.New().String())
+}
+
+// RefreshTokens exchanges a refresh token for a new pair in the same session.
+// Every refresh token works once; presenting it again revokes the session.
+func RefreshTokens(store db.Store, denylist Denylist, refreshToken string) (string, string, error) {
+    claims, err := ValidateToken(refreshToken, TokenRefresh)
     if err != nil {
+        return "", "", ErrInvalidToken
+    }
+
+    record, err := store.UseRefreshToken(claims.ID)
+    if err == db.ErrNotFound {
+        return "", "", ErrInvalidToken
+    } else if err != nil {
         return "", "", err
     }
+    if record.Used {
+        if err := RevokeSession(store, denylist, record.SessionID); err != nil {
+            return "", "", err
+        }
+        return "", "", ErrTokenReuse
+    }
+    if record.Revoked {
+        return "", "", ErrInvalidToken
+    }
 
-    return accessToken, refreshToken, nil
+    // The user is read again so that role changes apply on the next refresh
+    user, err := store.GetUser(record.Username)
+    if err == db.ErrNotFound || (err == nil && user.Disabled) {
+        return "", "", ErrInvalidToken
+    } else if err != nil {
+        return "", "", err
+    }
+    return issueTokens(store, *user, record.SessionID)
 }
 
-func GenerateTokens(username string) (accessToken string, refreshToken string, err error) {
-    accessTokenExp := time.Now().Add(15 * time.Minute) // Short-lived access token
-    refreshTokenExp := time.Now().Add(7 * 24 * time.Hour) // Long-lived refresh token
+// RevokeSession ends a session: its refresh tokens stop working and its
+// access tokens are denied until they expire.
+func RevokeSession(store db.Store, denylist Denylist, sessionID string) error {
+    if err := store.RevokeSession(sessionID); err != nil {
+        return err
+    }
+    return denylist.DenySession(context.Background(), sessionID)
+}
+
+// RevokeUser ends every session of the user.
+func RevokeUser(store db.Store, denylist Denylist, username string) error {
+    if err := store.RevokeUserSessions(username); err != nil {
+        return err
+    }
+    return denylist.DenyUser(context.Background(), username)
+}
+
+func issueTokens(store db.Store, user models.User, sessionID string) (accessToken string, refreshToken string, err error) {
+    now := time.Now()
 
     accessClaims := &Claims{
-        Username: username,
+        Username:  user.Username,
+        Role:      user.Role,
+        Org:       user.Org,
+        Type:      TokenAccess,
+        SessionID: sessionID,
         RegisteredClaims: jwt.RegisteredClaims{
-            ExpiresAt: jwt.NewNumericDate(accessTokenExp),
+            ID:        uuid.New().String(),
+            IssuedAt:  jwt.NewNumericDate(now),
+            ExpiresAt: jwt.NewNumericDate(now.Add(AccessTokenTTL)),
         },
     }
 
     refreshClaims := &Claims{
-        Username: username,
+        Username:  user.Username,
+        Role:      user.Role,
+        Org:       user.Org,
+        Type:      TokenRefresh,
+        SessionID: sessionID,
         RegisteredClaims: jwt.RegisteredClaims{
-            ExpiresAt: jwt.NewNumericDate(refreshTokenExp),
+            ID:        uuid.New().String(),
+            IssuedAt:  jwt.NewNumericDate(now),
+            ExpiresAt: jwt.NewNumericDate(now.Add(RefreshTokenTTL)),
         },
     }
 
-    at := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims)
-    rt := jwt.NewWithClaims(jwt.SigningMethodHS256, refreshClaims)
+    key, err := signingKey(now)
+    if err != nil {
+        return "", "", err
+    }
 
-    accessToken, err = at.SignedString(jwtKey)
+    accessToken, err = signToken(key, accessClaims)
     if err != nil {
         return "", "", err
     }
 
-    refreshToken, err = rt.SignedString(jwtKey)
+    refreshToken, err = signToken(key, refreshClaims)
+    if err != nil {
+        return "", "", err
+    }
+
+    // Record the refresh token so it can be rotated and revoked
+    err = store.CreateRefreshToken(models.RefreshToken{
+        ID:        refreshClaims.ID,
+        SessionID: sessionID,
+        Username:  user.Username,
+        Expires:   refreshClaims.ExpiresAt.Time,
+    })
     if err != nil {
         return "", "", err
     }
@@ -99,16 +301,30 @@ func GenerateTokens(username string) (accessToken string, refreshToken string, e
     return accessToken, refreshToken, nil
 }
 
-func ValidateToken(tokenStr string) (*Claims, error) {
+// signToken signs the claims, naming the key in the kid header so
+// verifiers can pick it from the JWKS.
+func signToken(key *Key, claims jwt.Claims) (string, error) {
+    token := jwt.NewWithClaims(key.method(), claims)
+    if key.ID != "" {
+        token.Header["kid"] = key.ID
+    }
+    return token.SignedString(key.private)
+}
+
+// ValidateToken verifies the token and that it is of the expected type.
+func ValidateToken(tokenStr, tokenType string) (*Claims, error) {
+    ks := Keys()
+    if ks == nil {
+        return nil, ErrNoKeys
+    }
     claims := &Claims{}
-    token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-        return jwtKey, nil
-    })
+    token, err := jwt.ParseWithClaims(tokenStr, claims, ks.keyFunc,
+        jwt.WithValidMethods([]string{AlgRS256, AlgEdDSA, AlgHS256}))
     if err != nil {
         return nil, err
     }
-    if !token.Valid {
-        return nil, errors.New("invalid token")
+    if !token.Valid || claims.Type != tokenType || claims.ID == "" {
+        return nil, ErrInvalidToken
     }
     return claims, nil
 }
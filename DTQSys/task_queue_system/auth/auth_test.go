@@ -0,0 +1,90 @@
+package auth_test
+
+import (
+    "context"
+    "task_queue_system/auth"
+    "task_queue_system/db"
+    "testing"
+)
+
+// login registers the user on a fresh store with a generated signing key
+// and returns the tokens of its first session.
+func login(t *testing.T, username string) (store *db.MemoryStore, accessToken, refreshToken string) {
+    t.Helper()
+    key, err := auth.GenerateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    keys, err := auth.NewKeySet(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    auth.SetKeys(keys)
+
+    store = db.NewMemoryStore()
+    if err := auth.RegisterUser(store, username, "correct-horse-1", ""); err != nil {
+        t.Fatalf("RegisterUser: %v", err)
+    }
+    accessToken, refreshToken, _, err = auth.AuthenticateUser(store, username, "correct-horse-1")
+    if err != nil {
+        t.Fatalf("AuthenticateUser: %v", err)
+    }
+    return store, accessToken, refreshToken
+}
+
+// denied reports whether the access token is valid but denylisted.
+func denied(t *testing.T, denylist auth.Denylist, accessToken string) bool {
+    t.Helper()
+    claims, err := auth.ValidateToken(accessToken, auth.TokenAccess)
+    if err != nil {
+        t.Fatalf("ValidateToken: %v", err)
+    }
+    isDenied, err := denylist.Denied(context.Background(), claims)
+    if err != nil {
+        t.Fatalf("Denied: %v", err)
+    }
+    return isDenied
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+    store, _, first := login(t, "irene")
+    denylist := auth.NewMemoryDenylist()
+
+    access, second, err := auth.RefreshTokens(store, denylist, first)
+    if err != nil {
+        t.Fatalf("RefreshTokens = %v, want a new pair", err)
+    }
+    if second == first {
+        t.Fatal("RefreshTokens returned the refresh token it was given")
+    }
+    if denied(t, denylist, access) {
+        t.Fatal("the refreshed access token is denied before any reuse")
+    }
+
+    // Presenting the exchanged token again looks like theft
+    if _, _, err := auth.RefreshTokens(store, denylist, first); err != auth.ErrTokenReuse {
+        t.Fatalf("reusing a refresh token = %v, want ErrTokenReuse", err)
+    }
+    if _, _, err := auth.RefreshTokens(store, denylist, second); err != auth.ErrInvalidToken {
+        t.Fatalf("refreshing after reuse = %v, want ErrInvalidToken", err)
+    }
+    if !denied(t, denylist, access) {
+        t.Fatal("the session's access token is still accepted after reuse")
+    }
+
+    // Other sessions of the user are not affected
+    _, other, _, err := auth.AuthenticateUser(store, "irene", "correct-horse-1")
+    if err != nil {
+        t.Fatalf("AuthenticateUser: %v", err)
+    }
+    if _, _, err := auth.RefreshTokens(store, denylist, other); err != nil {
+        t.Fatalf("refreshing another session = %v, want a new pair", err)
+    }
+}
+
+func TestRefreshTokenRejectsAccessToken(t *testing.T) {
+    store, access, _ := login(t, "james")
+    if _, _, err := auth.RefreshTokens(store, auth.NewMemoryDenylist(), access); err != auth.ErrInvalidToken {
+        t.Fatalf("refreshing with an access token = %v, want ErrInvalidToken", err)
+    }
+}
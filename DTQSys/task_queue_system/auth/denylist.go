@@ -0,0 +1,140 @@
+package auth
+
+import (
+    "context"
+    "math"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+    "github.com/golang-jwt/jwt/v5"
+)
+
+// Denylist rejects access tokens before they expire. Entries only need to
+// outlive the access tokens they cover, so they are kept for AccessTokenTTL.
+type Denylist interface {
+    // DenySession rejects the access tokens of the session.
+    DenySession(ctx context.Context, sessionID string) error
+    // DenyUser rejects the access tokens issued to the user so far.
+    DenyUser(ctx context.Context, username string) error
+    // Denied reports whether the access token has been revoked.
+    Denied(ctx context.Context, claims *Claims) (bool, error)
+}
+
+// issuedBefore reports whether the token was issued no later than the
+// revocation. Both are compared in milliseconds, the precision of issue
+// times, so only a token issued in the very millisecond of the revocation is
+// rejected along with the earlier ones.
+func issuedBefore(claims *Claims, revoked time.Time) bool {
+    if claims.IssuedAt == nil {
+        return true
+    }
+    return !claims.IssuedAt.Time.After(revoked.Truncate(jwt.TimePrecision))
+}
+
+// RedisDenylist shares revocations between all API instances.
+type RedisDenylist struct {
+    Client *redis.Client
+}
+
+func NewRedisDenylist(client *redis.Client) *RedisDenylist {
+    return &RedisDenylist{Client: client}
+}
+
+func sessionKey(sessionID string) string {
+    return "denylist:session:" + sessionID
+}
+
+func userKey(username string) string {
+    return "denylist:user:" + username
+}
+
+func (d *RedisDenylist) DenySession(ctx context.Context, sessionID string) error {
+    return d.Client.Set(ctx, sessionKey(sessionID), 1, AccessTokenTTL).Err()
+}
+
+func (d *RedisDenylist) DenyUser(ctx context.Context, username string) error {
+    // Fractional seconds; entries written with whole seconds parse the same way
+    revoked := float64(time.Now().UnixMilli()) / 1000
+    return d.Client.Set(ctx, userKey(username), strconv.FormatFloat(revoked, 'f', 3, 64), AccessTokenTTL).Err()
+}
+
+func (d *RedisDenylist) Denied(ctx context.Context, claims *Claims) (bool, error) {
+    values, err := d.Client.MGet(ctx, sessionKey(claims.SessionID), userKey(claims.Username)).Result()
+    if err != nil {
+        return false, err
+    }
+    if values[0] != nil {
+        return true, nil
+    }
+    if revoked, ok := values[1].(string); ok {
+        at, err := strconv.ParseFloat(revoked, 64)
+        if err != nil {
+            return false, err
+        }
+        return issuedBefore(claims, time.UnixMilli(int64(math.Round(at*1000)))), nil
+    }
+    return false, nil
+}
+
+// MemoryDenylist keeps revocations in process, for single-instance and
+// embedded deployments.
+type MemoryDenylist struct {
+    mu       sync.Mutex
+    sessions map[string]time.Time
+    users    map[string]time.Time
+}
+
+func NewMemoryDenylist() *MemoryDenylist {
+    return &MemoryDenylist{
+        sessions: make(map[string]time.Time),
+        users:    make(map[string]time.Time),
+    }
+}
+
+func (d *MemoryDenylist) DenySession(ctx context.Context, sessionID string) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    d.expire()
+    d.sessions[sessionID] = time.Now()
+    return nil
+}
+
+func (d *MemoryDenylist) DenyUser(ctx context.Context, username string) error {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    d.expire()
+    d.users[username] = time.Now()
+    return nil
+}
+
+func (d *MemoryDenylist) Denied(ctx context.Context, claims *Claims) (bool, error) {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    if _, denied := d.sessions[claims.SessionID]; denied {
+        return true, nil
+    }
+    if at, denied := d.users[claims.Username]; denied {
+        return issuedBefore(claims, at), nil
+    }
+    return false, nil
+}
+
+// expire drops entries whose tokens have all expired. Callers hold d.mu.
+func (d *MemoryDenylist) expire() {
+    cutoff := time.Now().Add(-AccessTokenTTL)
+    for id, at := range d.sessions {
+        if at.Before(cutoff) {
+            delete(d.sessions, id)
+        }
+    }
+    for username, at := range d.users {
+        if at.Before(cutoff) {
+            delete(d.users, username)
+        }
+    }
+}
@@ -0,0 +1,285 @@
+package auth
+
+import (
+    "crypto/ed25519"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "math/big"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "github.com/google/uuid"
+)
+
+// Signing algorithms. HS256 remains for deployments that still configure
+// JWT_SECRET_KEY; its key is never published.
+const (
+    AlgRS256 = "RS256"
+    AlgEdDSA = "EdDSA"
+    AlgHS256 = "HS256"
+)
+
+var ErrNoKeys = errors.New("no token signing key configured, set JWT_SIGNING_KEYS or JWT_SECRET_KEY")
+
+// Key signs or verifies tokens. Keys loaded from a public key only verify.
+type Key struct {
+    ID        string
+    Algorithm string
+    // ActiveFrom is when the key starts signing. A key verifies, and is
+    // published in the JWKS, as soon as it is loaded, so verifiers learn
+    // about it before the first token it signs.
+    ActiveFrom time.Time
+
+    private interface{}
+    public  interface{}
+}
+
+// CanSign reports whether the private half of the key is available.
+func (k *Key) CanSign() bool {
+    return k.private != nil
+}
+
+func (k *Key) method() jwt.SigningMethod {
+    switch k.Algorithm {
+    case AlgRS256:
+        return jwt.SigningMethodRS256
+    case AlgEdDSA:
+        return jwt.SigningMethodEdDSA
+    }
+    return jwt.SigningMethodHS256
+}
+
+// KeySet is every key the server accepts. The signing key is the one
+// activated most recently; the others keep verifying the tokens they signed
+// until they are removed from the configuration.
+type KeySet struct {
+    keys []*Key
+}
+
+// NewKeySet checks that key IDs are unique and that at least one key can sign.
+func NewKeySet(keys ...*Key) (*KeySet, error) {
+    seen := make(map[string]bool)
+    signer := false
+    for _, key := range keys {
+        if seen[key.ID] {
+            return nil, fmt.Errorf("duplicate key ID %q", key.ID)
+        }
+        seen[key.ID] = true
+        signer = signer || key.CanSign()
+    }
+    if !signer {
+        return nil, ErrNoKeys
+    }
+    return &KeySet{keys: keys}, nil
+}
+
+// SigningKey returns the key that signs tokens at now: the signing key with
+// the latest ActiveFrom not after now, later keys winning ties.
+func (ks *KeySet) SigningKey(now time.Time) (*Key, error) {
+    var current *Key
+    for _, key := range ks.keys {
+        if !key.CanSign() || key.ActiveFrom.After(now) {
+            continue
+        }
+        if current == nil || !key.ActiveFrom.Before(current.ActiveFrom) {
+            current = key
+        }
+    }
+    if current == nil {
+        return nil, ErrNoKeys
+    }
+    return current, nil
+}
+
+// keyFunc finds the verification key named by the token's kid. Tokens
+// without a kid can only be HS256 tokens signed with JWT_SECRET_KEY.
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+    kid, _ := token.Header["kid"].(string)
+    for _, key := range ks.keys {
+        if key.ID != kid {
+            continue
+        }
+        // The algorithm is fixed by the key, never by the token
+        if token.Method.Alg() != key.Algorithm {
+            return nil, ErrInvalidToken
+        }
+        return key.public, nil
+    }
+    return nil, ErrInvalidToken
+}
+
+// JWK is the public half of a key as published at /.well-known/jwks.json.
+type JWK struct {
+    KeyType   string `json:"kty"`
+    KeyID     string `json:"kid"`
+    Use       string `json:"use"`
+    Algorithm string `json:"alg"`
+    N         string `json:"n,omitempty"`
+    E         string `json:"e,omitempty"`
+    Curve     string `json:"crv,omitempty"`
+    X         string `json:"x,omitempty"`
+}
+
+// JWKS returns the public keys of the set, including keys not yet active.
+func (ks *KeySet) JWKS() []JWK {
+    b64 := base64.RawURLEncoding
+    jwks := []JWK{}
+    for _, key := range ks.keys {
+        switch public := key.public.(type) {
+        case *rsa.PublicKey:
+            jwks = append(jwks, JWK{
+                KeyType: "RSA", KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm,
+                N: b64.EncodeToString(public.N.Bytes()),
+                E: b64.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+            })
+        case ed25519.PublicKey:
+            jwks = append(jwks, JWK{
+                KeyType: "OKP", KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm,
+                Curve: "Ed25519", X: b64.EncodeToString(public),
+            })
+        }
+    }
+    return jwks
+}
+
+// ParseKey reads an RSA or Ed25519 key from PEM. Private keys (PKCS#1 or
+// PKCS#8) sign and verify; public keys (PKIX) only verify.
+func ParseKey(id string, data []byte) (*Key, error) {
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("key %s: no PEM data", id)
+    }
+
+    var parsed interface{}
+    var err error
+    switch block.Type {
+    case "RSA PRIVATE KEY":
+        parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+    case "PRIVATE KEY":
+        parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+    case "PUBLIC KEY":
+        parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+    default:
+        return nil, fmt.Errorf("key %s: unsupported PEM block %q", id, block.Type)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("key %s: %v", id, err)
+    }
+
+    key := &Key{ID: id}
+    switch k := parsed.(type) {
+    case *rsa.PrivateKey:
+        key.Algorithm, key.private, key.public = AlgRS256, k, &k.PublicKey
+    case *rsa.PublicKey:
+        key.Algorithm, key.public = AlgRS256, k
+    case ed25519.PrivateKey:
+        key.Algorithm, key.private, key.public = AlgEdDSA, k, k.Public()
+    case ed25519.PublicKey:
+        key.Algorithm, key.public = AlgEdDSA, k
+    default:
+        return nil, fmt.Errorf("key %s: only RSA and Ed25519 keys are supported", id)
+    }
+    if k, ok := key.public.(*rsa.PublicKey); ok && k.N.BitLen() < 2048 {
+        return nil, fmt.Errorf("key %s: RSA keys must be at least 2048 bits", id)
+    }
+    return key, nil
+}
+
+// GenerateKey creates an Ed25519 key with a random ID, for deployments such
+// as in-memory mode whose tokens only need to outlive the process.
+func GenerateKey() (*Key, error) {
+    public, private, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, err
+    }
+    return &Key{ID: uuid.New().String(), Algorithm: AlgEdDSA, private: private, public: public}, nil
+}
+
+// LoadKeys builds the key set from the environment.
+//
+// JWT_SIGNING_KEYS is a comma-separated list of ID=PATH[@TIME] entries, each
+// naming a PEM key file and optionally the RFC 3339 time it starts signing.
+// Rotation is scheduled by adding the next key with a future time; the old
+// key keeps verifying until it is removed, which is safe once
+// RefreshTokenTTL has passed since the switch.
+//
+// JWT_SECRET_KEY adds the legacy HS256 secret, which signs only while no
+// asymmetric key is active and verifies tokens without a kid.
+func LoadKeys() (*KeySet, error) {
+    var keys []*Key
+    if secret := os.Getenv("JWT_SECRET_KEY"); secret != "" {
+        keys = append(keys, &Key{Algorithm: AlgHS256, private: []byte(secret), public: []byte(secret)})
+    }
+
+    for _, entry := range strings.Split(os.Getenv("JWT_SIGNING_KEYS"), ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        id, path := splitPair(entry, "=")
+        if id == "" || path == "" {
+            return nil, fmt.Errorf("JWT_SIGNING_KEYS: %q is not ID=PATH[@TIME]", entry)
+        }
+        path, activeFrom := splitPair(path, "@")
+
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("key %s: %v", id, err)
+        }
+        key, err := ParseKey(id, data)
+        if err != nil {
+            return nil, err
+        }
+        if activeFrom != "" {
+            if key.ActiveFrom, err = time.Parse(time.RFC3339, activeFrom); err != nil {
+                return nil, fmt.Errorf("key %s: invalid activation time: %v", id, err)
+            }
+        }
+        keys = append(keys, key)
+    }
+    return NewKeySet(keys...)
+}
+
+func splitPair(s, sep string) (string, string) {
+    i := strings.Index(s, sep)
+    if i < 0 {
+        return s, ""
+    }
+    return s[:i], s[i+len(sep):]
+}
+
+var (
+    keysMu sync.RWMutex
+    keys   *KeySet
+)
+
+// SetKeys installs the key set used to issue and validate tokens.
+func SetKeys(ks *KeySet) {
+    keysMu.Lock()
+    defer keysMu.Unlock()
+    keys = ks
+}
+
+// Keys returns the installed key set, or nil before SetKeys.
+func Keys() *KeySet {
+    keysMu.RLock()
+    defer keysMu.RUnlock()
+    return keys
+}
+
+// signingKey returns the installed key set's signing key at now.
+func signingKey(now time.Time) (*Key, error) {
+    ks := Keys()
+    if ks == nil {
+        return nil, ErrNoKeys
+    }
+    return ks.SigningKey(now)
+}
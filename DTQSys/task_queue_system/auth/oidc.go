@@ -0,0 +1,516 @@
+package auth
+
+import (
+    "context"
+    "crypto/ecdsa"
+    "crypto/ed25519"
+    "crypto/elliptic"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "math/big"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "sync"
+    "task_queue_system/db"
+    "task_queue_system/models"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+)
+
+// OIDCLoginTTL bounds the time between starting a login at the provider and
+// returning to the callback.
+const OIDCLoginTTL = 10 * time.Minute
+
+// tokenOIDCLogin is the token type of the login state kept in a cookie
+// during the authorization-code flow.
+const tokenOIDCLogin = "oidc_login"
+
+var (
+    ErrOIDCState      = errors.New("invalid or expired login state, start again at /oidc/login")
+    ErrOIDCNoRole     = errors.New("identity is not in any group mapped to a role")
+    ErrOIDCUserExists = errors.New("a local user with this name already exists")
+    ErrUserDisabled   = errors.New("user is disabled")
+)
+
+// OIDCConfig configures login through an OpenID Connect provider.
+type OIDCConfig struct {
+    Issuer       string
+    ClientID     string
+    ClientSecret string
+    // RedirectURL is this server's /oidc/callback, as registered with the
+    // provider.
+    RedirectURL string
+    Scopes      []string
+    // UsernameClaim names the local user created for a new identity.
+    UsernameClaim string
+    // RolesClaim, when set, lists the identity's groups and RoleMap maps
+    // them to roles; the provider then decides the role at every login.
+    RolesClaim string
+    RoleMap    map[string]string
+    // Org is the organization new users join.
+    Org string
+    // LinkExisting lets a new identity take over the local user of the same
+    // name. Only enable it when the provider's usernames are trusted.
+    LinkExisting bool
+    HTTPClient   *http.Client
+}
+
+// OIDCConfigFromEnv reads the OIDC_* variables. OIDC login is disabled
+// when OIDC_ISSUER is empty.
+func OIDCConfigFromEnv() OIDCConfig {
+    config := OIDCConfig{
+        Issuer:        os.Getenv("OIDC_ISSUER"),
+        ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+        ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+        RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+        Scopes:        strings.Fields(os.Getenv("OIDC_SCOPES")),
+        UsernameClaim: os.Getenv("OIDC_USERNAME_CLAIM"),
+        RolesClaim:    os.Getenv("OIDC_ROLES_CLAIM"),
+        Org:           os.Getenv("OIDC_ORG"),
+        LinkExisting:  os.Getenv("OIDC_LINK_EXISTING") == "true",
+    }
+    for _, pair := range strings.Split(os.Getenv("OIDC_ROLE_MAP"), ",") {
+        group, role := splitPair(strings.TrimSpace(pair), "=")
+        if group != "" && role != "" {
+            if config.RoleMap == nil {
+                config.RoleMap = make(map[string]string)
+            }
+            config.RoleMap[group] = role
+        }
+    }
+    return config
+}
+
+// OIDCProvider runs the authorization-code flow with PKCE against one
+// provider and maps the identities it returns to local users.
+type OIDCProvider struct {
+    config        OIDCConfig
+    authEndpoint  string
+    tokenEndpoint string
+    jwksURI       string
+
+    mu      sync.Mutex
+    keys    map[string]interface{}
+    fetched time.Time
+}
+
+// NewOIDCProvider reads the provider's discovery document.
+func NewOIDCProvider(ctx context.Context, config OIDCConfig) (*OIDCProvider, error) {
+    if config.Issuer == "" || config.ClientID == "" || config.RedirectURL == "" {
+        return nil, errors.New("OIDC needs an issuer, a client ID and a redirect URL")
+    }
+    for group, role := range config.RoleMap {
+        if !ValidRole(role) {
+            return nil, fmt.Errorf("OIDC role map: group %s maps to unknown role %q", group, role)
+        }
+    }
+    if len(config.Scopes) == 0 {
+        config.Scopes = []string{"openid", "profile", "email"}
+    }
+    if config.UsernameClaim == "" {
+        config.UsernameClaim = "preferred_username"
+    }
+    if config.Org == "" {
+        config.Org = db.DefaultOrg
+    }
+    if config.HTTPClient == nil {
+        config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+    }
+
+    var discovery struct {
+        Issuer                string `json:"issuer"`
+        AuthorizationEndpoint string `json:"authorization_endpoint"`
+        TokenEndpoint         string `json:"token_endpoint"`
+        JWKSURI               string `json:"jwks_uri"`
+    }
+    p := &OIDCProvider{config: config}
+    wellKnown := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+    if err := p.getJSON(ctx, wellKnown, &discovery); err != nil {
+        return nil, fmt.Errorf("OIDC discovery: %v", err)
+    }
+    if discovery.Issuer != config.Issuer {
+        return nil, fmt.Errorf("OIDC discovery: issuer %q does not match %q", discovery.Issuer, config.Issuer)
+    }
+    if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+        return nil, errors.New("OIDC discovery: provider does not support the authorization-code flow")
+    }
+    p.authEndpoint = discovery.AuthorizationEndpoint
+    p.tokenEndpoint = discovery.TokenEndpoint
+    p.jwksURI = discovery.JWKSURI
+    return p, nil
+}
+
+// oidcLoginClaims carry the state, nonce and PKCE verifier from BeginLogin
+// to CompleteLogin. They are signed with our own key, so no server-side
+// storage is needed between the two requests.
+type oidcLoginClaims struct {
+    Type     string `json:"token_type"`
+    State    string `json:"state"`
+    Nonce    string `json:"nonce"`
+    Verifier string `json:"verifier"`
+    jwt.RegisteredClaims
+}
+
+// BeginLogin returns the provider URL to send the user to, and the login
+// state to keep in a cookie until the callback.
+func (p *OIDCProvider) BeginLogin() (authURL, loginState string, err error) {
+    now := time.Now()
+    key, err := signingKey(now)
+    if err != nil {
+        return "", "", err
+    }
+
+    claims := &oidcLoginClaims{
+        Type:     tokenOIDCLogin,
+        State:    randomString(),
+        Nonce:    randomString(),
+        Verifier: randomString(),
+        RegisteredClaims: jwt.RegisteredClaims{
+            ExpiresAt: jwt.NewNumericDate(now.Add(OIDCLoginTTL)),
+        },
+    }
+    if loginState, err = signToken(key, claims); err != nil {
+        return "", "", err
+    }
+
+    challenge := sha256.Sum256([]byte(claims.Verifier))
+    query := url.Values{
+        "response_type":         {"code"},
+        "client_id":             {p.config.ClientID},
+        "redirect_uri":          {p.config.RedirectURL},
+        "scope":                 {strings.Join(p.config.Scopes, " ")},
+        "state":                 {claims.State},
+        "nonce":                 {claims.Nonce},
+        "code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+        "code_challenge_method": {"S256"},
+    }
+    separator := "?"
+    if strings.Contains(p.authEndpoint, "?") {
+        separator = "&"
+    }
+    return p.authEndpoint + separator + query.Encode(), loginState, nil
+}
+
+// CompleteLogin checks the callback's state against the login state,
+// redeems the code and returns the local user of the identity.
+func (p *OIDCProvider) CompleteLogin(ctx context.Context, store db.Store, loginState, state, code string) (*models.User, error) {
+    ks := Keys()
+    if ks == nil {
+        return nil, ErrNoKeys
+    }
+    claims := &oidcLoginClaims{}
+    token, err := jwt.ParseWithClaims(loginState, claims, ks.keyFunc,
+        jwt.WithValidMethods([]string{AlgRS256, AlgEdDSA, AlgHS256}))
+    if err != nil || !token.Valid || claims.Type != tokenOIDCLogin || claims.State == "" ||
+        subtle.ConstantTimeCompare([]byte(claims.State), []byte(state)) != 1 {
+        return nil, ErrOIDCState
+    }
+
+    rawIDToken, err := p.exchange(ctx, code, claims.Verifier)
+    if err != nil {
+        return nil, err
+    }
+    idClaims, err := p.verifyIDToken(ctx, rawIDToken, claims.Nonce)
+    if err != nil {
+        return nil, err
+    }
+    return p.localUser(store, idClaims)
+}
+
+// exchange redeems the authorization code for an ID token.
+func (p *OIDCProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+    form := url.Values{
+        "grant_type":    {"authorization_code"},
+        "code":          {code},
+        "redirect_uri":  {p.config.RedirectURL},
+        "code_verifier": {verifier},
+        "client_id":     {p.config.ClientID},
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.tokenEndpoint, strings.NewReader(form.Encode()))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    if p.config.ClientSecret != "" {
+        req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+    }
+
+    resp, err := p.config.HTTPClient.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+
+    var tokens struct {
+        IDToken          string `json:"id_token"`
+        Error            string `json:"error"`
+        ErrorDescription string `json:"error_description"`
+    }
+    json.NewDecoder(resp.Body).Decode(&tokens)
+    if resp.StatusCode != http.StatusOK {
+        return "", fmt.Errorf("token endpoint returned %d %s %s", resp.StatusCode, tokens.Error, tokens.ErrorDescription)
+    }
+    if tokens.IDToken == "" {
+        return "", errors.New("token endpoint returned no ID token")
+    }
+    return tokens.IDToken, nil
+}
+
+// verifyIDToken checks the ID token's signature against the provider's
+// JWKS, its issuer, audience and expiry, and the nonce of this login.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, rawIDToken, nonce string) (jwt.MapClaims, error) {
+    claims := jwt.MapClaims{}
+    _, err := jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (interface{}, error) {
+        kid, _ := token.Header["kid"].(string)
+        key, err := p.key(ctx, kid)
+        if err != nil {
+            return nil, err
+        }
+        // The algorithm must belong to the key's type
+        var matches bool
+        switch key.(type) {
+        case *rsa.PublicKey:
+            _, matches = token.Method.(*jwt.SigningMethodRSA)
+        case *ecdsa.PublicKey:
+            _, matches = token.Method.(*jwt.SigningMethodECDSA)
+        case ed25519.PublicKey:
+            _, matches = token.Method.(*jwt.SigningMethodEd25519)
+        }
+        if !matches {
+            return nil, errors.New("ID token algorithm does not match its key")
+        }
+        return key, nil
+    },
+        jwt.WithValidMethods([]string{"RS256", "ES256", "EdDSA"}),
+        jwt.WithIssuer(p.config.Issuer),
+        jwt.WithAudience(p.config.ClientID),
+        jwt.WithLeeway(time.Minute))
+    if err != nil {
+        return nil, fmt.Errorf("invalid ID token: %v", err)
+    }
+
+    if exp, _ := claims.GetExpirationTime(); exp == nil {
+        return nil, errors.New("invalid ID token: no expiry")
+    }
+    if sub, _ := claims.GetSubject(); sub == "" {
+        return nil, errors.New("invalid ID token: no subject")
+    }
+    if got, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+        return nil, errors.New("invalid ID token: nonce does not match")
+    }
+    // With several audiences the token must have been issued to us
+    if aud, _ := claims.GetAudience(); len(aud) > 1 {
+        if azp, _ := claims["azp"].(string); azp != p.config.ClientID {
+            return nil, errors.New("invalid ID token: not issued to this client")
+        }
+    }
+    return claims, nil
+}
+
+// key returns the provider key with the kid. An unknown kid refetches the
+// JWKS, since the provider may have rotated, but at most once a minute.
+func (p *OIDCProvider) key(ctx context.Context, kid string) (interface{}, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    if key := p.lookupKey(kid); key != nil {
+        return key, nil
+    }
+    if p.keys != nil && time.Since(p.fetched) < time.Minute {
+        return nil, fmt.Errorf("unknown ID token key %q", kid)
+    }
+
+    var jwks struct {
+        Keys []struct {
+            KeyType string `json:"kty"`
+            KeyID   string `json:"kid"`
+            Use     string `json:"use"`
+            Curve   string `json:"crv"`
+            N       string `json:"n"`
+            E       string `json:"e"`
+            X       string `json:"x"`
+            Y       string `json:"y"`
+        } `json:"keys"`
+    }
+    if err := p.getJSON(ctx, p.jwksURI, &jwks); err != nil {
+        return nil, fmt.Errorf("fetching provider keys: %v", err)
+    }
+
+    b64 := base64.RawURLEncoding
+    keys := make(map[string]interface{})
+    for _, k := range jwks.Keys {
+        if k.Use != "" && k.Use != "sig" {
+            continue
+        }
+        switch {
+        case k.KeyType == "RSA":
+            n, errN := b64.DecodeString(k.N)
+            e, errE := b64.DecodeString(k.E)
+            if errN == nil && errE == nil {
+                keys[k.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+            }
+        case k.KeyType == "EC" && k.Curve == "P-256":
+            x, errX := b64.DecodeString(k.X)
+            y, errY := b64.DecodeString(k.Y)
+            if errX == nil && errY == nil {
+                keys[k.KeyID] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+            }
+        case k.KeyType == "OKP" && k.Curve == "Ed25519":
+            x, err := b64.DecodeString(k.X)
+            if err == nil && len(x) == ed25519.PublicKeySize {
+                keys[k.KeyID] = ed25519.PublicKey(x)
+            }
+        }
+    }
+    p.keys, p.fetched = keys, time.Now()
+
+    if key := p.lookupKey(kid); key != nil {
+        return key, nil
+    }
+    return nil, fmt.Errorf("unknown ID token key %q", kid)
+}
+
+// lookupKey finds a cached key. Tokens without a kid are accepted when the
+// provider publishes a single key.
+func (p *OIDCProvider) lookupKey(kid string) interface{} {
+    if key, ok := p.keys[kid]; ok {
+        return key
+    }
+    if kid == "" && len(p.keys) == 1 {
+        for _, key := range p.keys {
+            return key
+        }
+    }
+    return nil
+}
+
+// localUser returns the local user linked to the identity, linking or
+// creating one at the identity's first login.
+func (p *OIDCProvider) localUser(store db.Store, claims jwt.MapClaims) (*models.User, error) {
+    subject, _ := claims.GetSubject()
+    role, err := p.mappedRole(claims)
+    if err != nil {
+        return nil, err
+    }
+
+    var user *models.User
+    username, err := store.IdentityUser(p.config.Issuer, subject)
+    switch {
+    case err == nil:
+        user, err = store.GetUser(username)
+    case err == db.ErrNotFound:
+        user, err = p.linkUser(store, claims, subject, role)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if user.Disabled {
+        return nil, ErrUserDisabled
+    }
+
+    // The provider's groups decide the role at every login
+    if role != "" && user.Role != role {
+        if err := store.SetUserRole(user.Username, role); err != nil {
+            return nil, err
+        }
+        user.Role = role
+    }
+    return user, nil
+}
+
+// linkUser links a new identity to the local user named by its username
+// claim, creating the user without a password unless LinkExisting allows
+// taking over an existing one.
+func (p *OIDCProvider) linkUser(store db.Store, claims jwt.MapClaims, subject, role string) (*models.User, error) {
+    name, _ := claims[p.config.UsernameClaim].(string)
+    if name == "" || len(name) > 50 {
+        return nil, fmt.Errorf("ID token has no usable %s claim", p.config.UsernameClaim)
+    }
+
+    user, err := store.GetUser(name)
+    switch {
+    case err == nil:
+        if !p.config.LinkExisting || user.Org != p.config.Org || user.Role == RoleService {
+            return nil, ErrOIDCUserExists
+        }
+    case err == db.ErrNotFound:
+        // Never ADMIN_USERS: the provider picks the username, so anyone it
+        // lets sign up could claim an admin's name
+        user = &models.User{Username: name, Role: role, Org: p.config.Org}
+        if user.Role == "" {
+            user.Role = DefaultRole
+        }
+        // No password: the provider authenticates this user
+        if err := store.CreateUser(*user, ""); err != nil {
+            return nil, err
+        }
+    default:
+        return nil, err
+    }
+
+    if err := store.LinkIdentity(p.config.Issuer, subject, user.Username); err != nil {
+        return nil, err
+    }
+    return user, nil
+}
+
+// mappedRole returns the most privileged role the identity's groups map to,
+// or "" when roles are not taken from the provider.
+func (p *OIDCProvider) mappedRole(claims jwt.MapClaims) (string, error) {
+    if p.config.RolesClaim == "" || len(p.config.RoleMap) == 0 {
+        return "", nil
+    }
+
+    granted := make(map[string]bool)
+    switch groups := claims[p.config.RolesClaim].(type) {
+    case string:
+        granted[p.config.RoleMap[groups]] = true
+    case []interface{}:
+        for _, group := range groups {
+            if name, ok := group.(string); ok {
+                granted[p.config.RoleMap[name]] = true
+            }
+        }
+    }
+    for _, role := range []string{RoleAdmin, RoleProducer, RoleViewer, RoleWorker} {
+        if granted[role] {
+            return role, nil
+        }
+    }
+    return "", ErrOIDCNoRole
+}
+
+func (p *OIDCProvider) getJSON(ctx context.Context, url string, out interface{}) error {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    resp, err := p.config.HTTPClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("GET %s returned %d", url, resp.StatusCode)
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// randomString returns 32 random bytes, base64url encoded.
+func randomString() string {
+    b := make([]byte, 32)
+    if _, err := rand.Read(b); err != nil {
+        panic(err)
+    }
+    return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,200 @@
+package auth
+
+import (
+    "bufio"
+    "fmt"
+    "os"
+    "strconv"
+    "strings"
+    "task_queue_system/db"
+    "task_queue_system/models"
+    "time"
+    "unicode"
+    "unicode/utf8"
+)
+
+// maxPasswordLength is in bytes; bcrypt ignores anything longer.
+const maxPasswordLength = 72
+
+// Progressive lockout: from the LockoutThreshold-th consecutive failed
+// login on, the account is locked for a minute after each failure, doubling
+// with every further failure up to an hour.
+const (
+    LockoutThreshold = 5
+    lockoutBase      = time.Minute
+    lockoutMax       = time.Hour
+)
+
+// commonPasswords are refused whatever the policy's length and classes.
+var commonPasswords = []string{
+    "password", "password1", "password12", "password123", "passw0rd",
+    "12345678", "123456789", "1234567890", "11111111", "00000000",
+    "qwertyui", "qwertyuiop", "qwerty123", "1q2w3e4r", "abc12345",
+    "iloveyou", "sunshine", "princess", "football", "baseball",
+    "superman", "trustno1", "letmein1", "welcome1", "admin123",
+    "changeme",
+}
+
+// PasswordPolicy decides which new passwords are accepted. It is checked
+// when a password is set, so tightening it does not lock anyone out.
+type PasswordPolicy struct {
+    MinLength int
+    // MinClasses is how many of lower case letters, upper case letters,
+    // digits and other characters a password must mix.
+    MinClasses int
+    // Blocklist holds refused passwords, in lower case.
+    Blocklist map[string]bool
+}
+
+// Policy applies to every password set through this package.
+var Policy = DefaultPasswordPolicy()
+
+// DefaultPasswordPolicy asks for 8 characters, not among common passwords.
+func DefaultPasswordPolicy() PasswordPolicy {
+    policy := PasswordPolicy{MinLength: 8, Blocklist: make(map[string]bool)}
+    for _, password := range commonPasswords {
+        policy.Blocklist[password] = true
+    }
+    return policy
+}
+
+// PasswordPolicyFromEnv adjusts the default policy with PASSWORD_MIN_LENGTH,
+// PASSWORD_MIN_CLASSES and PASSWORD_BLOCKLIST_FILE, a file of further
+// refused passwords, one per line.
+func PasswordPolicyFromEnv() (PasswordPolicy, error) {
+    policy := DefaultPasswordPolicy()
+    if value := os.Getenv("PASSWORD_MIN_LENGTH"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 1 || n > maxPasswordLength {
+            return policy, fmt.Errorf("PASSWORD_MIN_LENGTH must be between 1 and %d", maxPasswordLength)
+        }
+        policy.MinLength = n
+    }
+    if value := os.Getenv("PASSWORD_MIN_CLASSES"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 0 || n > 4 {
+            return policy, fmt.Errorf("PASSWORD_MIN_CLASSES must be between 0 and 4")
+        }
+        policy.MinClasses = n
+    }
+    if path := os.Getenv("PASSWORD_BLOCKLIST_FILE"); path != "" {
+        file, err := os.Open(path)
+        if err != nil {
+            return policy, err
+        }
+        defer file.Close()
+
+        scanner := bufio.NewScanner(file)
+        for scanner.Scan() {
+            if line := strings.TrimSpace(scanner.Text()); line != "" {
+                policy.Blocklist[strings.ToLower(line)] = true
+            }
+        }
+        if err := scanner.Err(); err != nil {
+            return policy, err
+        }
+    }
+    return policy, nil
+}
+
+// PasswordError explains why the policy refused a password.
+type PasswordError struct {
+    Reason string
+}
+
+func (e *PasswordError) Error() string {
+    return "password " + e.Reason
+}
+
+// Check returns a *PasswordError when the password may not be set for the
+// user.
+func (p PasswordPolicy) Check(username, password string) error {
+    if utf8.RuneCountInString(password) < p.MinLength {
+        return &PasswordError{fmt.Sprintf("must be at least %d characters long", p.MinLength)}
+    }
+    if len(password) > maxPasswordLength {
+        return &PasswordError{fmt.Sprintf("must be at most %d bytes long", maxPasswordLength)}
+    }
+
+    var lower, upper, digit, other int
+    for _, r := range password {
+        switch {
+        case unicode.IsLower(r):
+            lower = 1
+        case unicode.IsUpper(r):
+            upper = 1
+        case unicode.IsDigit(r):
+            digit = 1
+        default:
+            other = 1
+        }
+    }
+    if lower+upper+digit+other < p.MinClasses {
+        return &PasswordError{fmt.Sprintf("must mix at least %d of lower case, upper case, digits and symbols", p.MinClasses)}
+    }
+
+    folded := strings.ToLower(password)
+    if p.Blocklist[folded] {
+        return &PasswordError{"is too common"}
+    }
+    if username != "" && strings.Contains(folded, strings.ToLower(username)) {
+        return &PasswordError{"must not contain the username"}
+    }
+    return nil
+}
+
+// lockedUntil returns when a user with the record may try to log in again.
+func lockedUntil(record *models.LoginRecord) time.Time {
+    if record.FailedLogins < LockoutThreshold {
+        return time.Time{}
+    }
+    lock := lockoutBase
+    for i := LockoutThreshold; i < record.FailedLogins && lock < lockoutMax; i++ {
+        lock *= 2
+    }
+    if lock > lockoutMax {
+        lock = lockoutMax
+    }
+    return record.LastFailedLogin.Add(lock)
+}
+
+// ChangePassword replaces the user's password after checking the current
+// one, and ends all of the user's sessions.
+func ChangePassword(store db.Store, denylist Denylist, username, current, password string) error {
+    if _, err := verifyPassword(store, username, current); err != nil {
+        return err
+    }
+    return setPassword(store, denylist, username, password)
+}
+
+// ResetPassword sets a password chosen by an admin. It also lifts a lockout
+// and ends all of the user's sessions.
+func ResetPassword(store db.Store, denylist Denylist, username, password string) error {
+    return setPassword(store, denylist, username, password)
+}
+
+func setPassword(store db.Store, denylist Denylist, username, password string) error {
+    if err := Policy.Check(username, password); err != nil {
+        return err
+    }
+    passwordHash, err := hashPassword(password)
+    if err != nil {
+        return err
+    }
+    if err := store.SetPasswordHash(username, passwordHash); err != nil {
+        return err
+    }
+    return RevokeUser(store, denylist, username)
+}
+
+// SetUserDisabled disables or re-enables a user. Disabling ends every
+// session at once; enabling also lifts a lockout.
+func SetUserDisabled(store db.Store, denylist Denylist, username string, disabled bool) error {
+    if err := store.SetUserDisabled(username, disabled); err != nil {
+        return err
+    }
+    if !disabled {
+        return store.ResetLoginFailures(username)
+    }
+    return RevokeUser(store, denylist, username)
+}
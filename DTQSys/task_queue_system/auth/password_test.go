@@ -0,0 +1,59 @@
+package auth
+
+import (
+    "task_queue_system/db"
+    "task_queue_system/models"
+    "testing"
+    "time"
+)
+
+func TestLockoutSchedule(t *testing.T) {
+    last := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+    tests := []struct {
+        failures int
+        lock     time.Duration
+    }{
+        {0, 0},
+        {1, 0},
+        {LockoutThreshold - 1, 0},
+        {LockoutThreshold, time.Minute},
+        {LockoutThreshold + 1, 2 * time.Minute},
+        {LockoutThreshold + 2, 4 * time.Minute},
+        {LockoutThreshold + 5, 32 * time.Minute},
+        {LockoutThreshold + 6, time.Hour},
+        {LockoutThreshold + 7, time.Hour},
+        {1000, time.Hour},
+    }
+    for _, test := range tests {
+        record := &models.LoginRecord{FailedLogins: test.failures, LastFailedLogin: last}
+        want := time.Time{}
+        if test.lock > 0 {
+            want = last.Add(test.lock)
+        }
+        if got := lockedUntil(record); !got.Equal(want) {
+            t.Errorf("lockedUntil after %d failures = %v, want %v", test.failures, got, want)
+        }
+    }
+}
+
+func TestLockoutRefusesCorrectPassword(t *testing.T) {
+    store := db.NewMemoryStore()
+    if err := RegisterUser(store, "karen", "correct-horse-1", ""); err != nil {
+        t.Fatalf("RegisterUser: %v", err)
+    }
+    for i := 0; i < LockoutThreshold; i++ {
+        if _, err := verifyPassword(store, "karen", "wrong-horse-1"); err != ErrInvalidCredentials {
+            t.Fatalf("failed login %d = %v, want ErrInvalidCredentials", i+1, err)
+        }
+    }
+    if _, err := verifyPassword(store, "karen", "correct-horse-1"); err != ErrInvalidCredentials {
+        t.Fatalf("login while locked out = %v, want ErrInvalidCredentials", err)
+    }
+
+    // A further failure locks for two minutes; once they have passed, the
+    // correct password works again
+    store.RecordLoginFailure("karen", time.Now().Add(-3*time.Minute))
+    if _, err := verifyPassword(store, "karen", "correct-horse-1"); err != nil {
+        t.Fatalf("login after the lock expired = %v, want success", err)
+    }
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+    "os"
+    "strings"
+)
+
+// Roles a user can hold. Every user has exactly one.
+const (
+    RoleAdmin    = "admin"
+    RoleProducer = "producer"
+    RoleViewer   = "viewer"
+    RoleWorker   = "worker"
+)
+
+// RoleService marks service accounts. They cannot log in and hold no
+// permissions of their own; each request is limited to the scopes of the
+// API key it presents.
+const RoleService = "service"
+
+// DefaultRole is given to self-registered users.
+const DefaultRole = RoleProducer
+
+// Permissions checked by the API routes.
+const (
+    PermSubmitTasks    = "tasks:submit"
+    PermReadTasks      = "tasks:read"
+    PermReadAllTasks   = "tasks:read_all"
+    PermManageTasks    = "tasks:manage"
+    PermManageAllTasks = "tasks:manage_all"
+    PermReadSystem     = "system:read"
+    PermManageUsers    = "users:manage"
+    PermProcessTasks   = "tasks:process"
+    // PermManageOrgs additionally requires membership of the default
+    // organization, whose admins operate the deployment.
+    PermManageOrgs = "orgs:manage"
+    PermReadAudit  = "audit:read"
+)
+
+var rolePermissions = map[string][]string{
+    RoleAdmin: {
+        PermSubmitTasks, PermReadTasks, PermReadAllTasks, PermManageTasks,
+        PermManageAllTasks, PermReadSystem, PermManageUsers, PermProcessTasks,
+        PermManageOrgs, PermReadAudit,
+    },
+    // Producers submit tasks and manage their own
+    RoleProducer: {PermSubmitTasks, PermReadTasks, PermManageTasks},
+    // Viewers can look at everything and change nothing
+    RoleViewer: {PermReadTasks, PermReadAllTasks, PermReadSystem},
+    // Worker credentials can only dequeue and acknowledge
+    RoleWorker: {PermProcessTasks},
+}
+
+// ValidRole reports whether role is one of the known roles.
+func ValidRole(role string) bool {
+    _, ok := rolePermissions[role]
+    return ok
+}
+
+// HasPermission reports whether the role grants the permission.
+func HasPermission(role, permission string) bool {
+    for _, p := range rolePermissions[role] {
+        if p == permission {
+            return true
+        }
+    }
+    return false
+}
+
+// bootstrapRole returns the role for a user registering into the default
+// organization. Usernames listed in the comma-separated ADMIN_USERS variable
+// become admins, so a fresh deployment has someone who can assign roles.
+func bootstrapRole(username string) string {
+    for _, admin := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+        if admin = strings.TrimSpace(admin); admin != "" && admin == username {
+            return RoleAdmin
+        }
+    }
+    return DefaultRole
+}
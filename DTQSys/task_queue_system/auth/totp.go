@@ -0,0 +1,285 @@
+package auth
+
+import (
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/binary"
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "net/url"
+    "strconv"
+    "strings"
+    "task_queue_system/db"
+    "task_queue_system/models"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "github.com/google/uuid"
+)
+
+// TOTP codes as RFC 6238 defines them and authenticator apps generate them
+// by default: six digits from HMAC-SHA1 over 30 second steps.
+const (
+    totpPeriod = 30
+    totpDigits = 6
+    // totpSkew also accepts the codes of this many steps either side of
+    // now, for clocks that drift.
+    totpSkew = 1
+)
+
+// TOTPChallengeTTL bounds the time between the password and the code of a
+// two-factor login.
+const TOTPChallengeTTL = 5 * time.Minute
+
+// TokenTOTPChallenge is the token type of the challenge a password login
+// returns to users with two-factor authentication. It is only accepted by
+// CompleteTOTPLogin.
+const TokenTOTPChallenge = "totp_challenge"
+
+// RecoveryCodeCount recovery codes are issued at enrollment. Each can
+// replace a TOTP code once, e.g. after losing the authenticator.
+const RecoveryCodeCount = 10
+
+// TOTPIssuer names this service in authenticator apps.
+var TOTPIssuer = "DTQSys"
+
+var (
+    ErrInvalidTOTPCode = errors.New("invalid two-factor code")
+    ErrTOTPEnabled     = errors.New("two-factor authentication is already enabled")
+    ErrTOTPNotEnrolled = errors.New("two-factor enrollment has not been started")
+    ErrTOTPNotEnabled  = errors.New("two-factor authentication is not enabled")
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is what an authenticator app needs to add the account.
+type TOTPEnrollment struct {
+    Secret string `json:"secret"`
+    // URI is the otpauth:// provisioning URI, usually shown as a QR code.
+    URI string `json:"uri"`
+}
+
+// BeginTOTPEnrollment checks the user's password and generates a new
+// secret. It is not asked for at login until ConfirmTOTPEnrollment.
+func BeginTOTPEnrollment(store db.Store, username, password string) (*TOTPEnrollment, error) {
+    if _, err := verifyPassword(store, username, password); err != nil {
+        return nil, err
+    }
+    totp, err := store.UserTOTP(username)
+    if err != nil {
+        return nil, err
+    }
+    if totp.Enabled {
+        return nil, ErrTOTPEnabled
+    }
+
+    key := make([]byte, 20)
+    if _, err := rand.Read(key); err != nil {
+        return nil, err
+    }
+    secret := totpEncoding.EncodeToString(key)
+    if err := store.SetUserTOTP(username, models.TOTP{Secret: secret}); err != nil {
+        return nil, err
+    }
+    return &TOTPEnrollment{Secret: secret, URI: provisioningURI(username, secret)}, nil
+}
+
+// ConfirmTOTPEnrollment enables two-factor authentication once the user
+// proves the authenticator works, and returns the recovery codes. They are
+// only stored hashed, so this is the only time they are shown.
+func ConfirmTOTPEnrollment(store db.Store, username, code string) ([]string, error) {
+    totp, err := store.UserTOTP(username)
+    if err != nil {
+        return nil, err
+    }
+    if totp.Enabled {
+        return nil, ErrTOTPEnabled
+    }
+    if totp.Secret == "" {
+        return nil, ErrTOTPNotEnrolled
+    }
+    step, ok := matchTOTP(totp.Secret, normalizeCode(code), time.Now())
+    if !ok {
+        return nil, ErrInvalidTOTPCode
+    }
+
+    codes := make([]string, RecoveryCodeCount)
+    totp.RecoveryCodes = make([]string, RecoveryCodeCount)
+    for i := range codes {
+        b := make([]byte, 7)
+        if _, err := rand.Read(b); err != nil {
+            return nil, err
+        }
+        recovery := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+        codes[i] = recovery[:5] + "-" + recovery[5:]
+        totp.RecoveryCodes[i] = hashRecoveryCode(recovery)
+    }
+    totp.Enabled, totp.LastStep = true, step
+    if err := store.SetUserTOTP(username, *totp); err != nil {
+        return nil, err
+    }
+    return codes, nil
+}
+
+// DisableTOTP turns two-factor authentication off. It takes the password
+// and a code, so a stolen access token alone cannot weaken the account.
+func DisableTOTP(store db.Store, username, password, code string) error {
+    if _, err := verifyPassword(store, username, password); err != nil {
+        return err
+    }
+    totp, err := store.UserTOTP(username)
+    if err != nil {
+        return err
+    }
+    if !totp.Enabled {
+        return ErrTOTPNotEnabled
+    }
+    if err := verifySecondFactor(store, username, totp, code); err != nil {
+        return err
+    }
+    return store.SetUserTOTP(username, models.TOTP{})
+}
+
+// CompleteTOTPLogin checks the code for the challenge AuthenticateUser
+// returned and starts a session. The code may also be a recovery code.
+// Wrong codes count towards the same lockout as wrong passwords.
+func CompleteTOTPLogin(store db.Store, challenge, code string) (string, string, error) {
+    claims, err := ValidateToken(challenge, TokenTOTPChallenge)
+    if err != nil {
+        return "", "", ErrInvalidToken
+    }
+
+    record, err := store.LoginRecord(claims.Username)
+    if err == db.ErrNotFound {
+        return "", "", ErrInvalidToken
+    } else if err != nil {
+        return "", "", err
+    }
+    // An admin may have reset the enrollment since the password was checked
+    if !record.TOTPEnabled {
+        return "", "", ErrInvalidToken
+    }
+    if record.Disabled || time.Now().Before(lockedUntil(record)) {
+        return "", "", ErrInvalidCredentials
+    }
+
+    totp, err := store.UserTOTP(claims.Username)
+    if err != nil {
+        return "", "", err
+    }
+    if err := verifySecondFactor(store, claims.Username, totp, code); err != nil {
+        return "", "", err
+    }
+    if record.FailedLogins > 0 {
+        if err := store.ResetLoginFailures(claims.Username); err != nil {
+            return "", "", err
+        }
+    }
+
+    user, err := store.GetUser(claims.Username)
+    if err != nil {
+        return "", "", err
+    }
+    return GenerateTokens(store, *user)
+}
+
+// totpChallenge signs the proof that the user's password was right, which
+// CompleteTOTPLogin exchanges for tokens together with a code.
+func totpChallenge(username string) (string, error) {
+    now := time.Now()
+    key, err := signingKey(now)
+    if err != nil {
+        return "", err
+    }
+    claims := &Claims{
+        Username: username,
+        Type:     TokenTOTPChallenge,
+        RegisteredClaims: jwt.RegisteredClaims{
+            ID:        uuid.New().String(),
+            IssuedAt:  jwt.NewNumericDate(now),
+            ExpiresAt: jwt.NewNumericDate(now.Add(TOTPChallengeTTL)),
+        },
+    }
+    return signToken(key, claims)
+}
+
+// verifySecondFactor accepts a TOTP code not used before or an unused
+// recovery code, which is then used up. Anything else counts as a failed
+// login.
+func verifySecondFactor(store db.Store, username string, totp *models.TOTP, code string) error {
+    code = normalizeCode(code)
+    if len(code) == totpDigits {
+        if step, ok := matchTOTP(totp.Secret, code, time.Now()); ok {
+            used, err := store.UseTOTPStep(username, step)
+            if err != nil || used {
+                return err
+            }
+        }
+    } else if code != "" {
+        used, err := store.UseRecoveryCode(username, hashRecoveryCode(code))
+        if err != nil || used {
+            return err
+        }
+    }
+
+    if err := store.RecordLoginFailure(username, time.Now()); err != nil {
+        return err
+    }
+    return ErrInvalidTOTPCode
+}
+
+// matchTOTP returns the time step around now whose code is code.
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+    key, err := totpEncoding.DecodeString(secret)
+    if err != nil || secret == "" || len(code) != totpDigits {
+        return 0, false
+    }
+    current := now.Unix() / totpPeriod
+    for step := current - totpSkew; step <= current+totpSkew; step++ {
+        if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+            return step, true
+        }
+    }
+    return 0, false
+}
+
+// totpCode computes the code of a time step (RFC 4226 section 5.3).
+func totpCode(key []byte, step int64) string {
+    var counter [8]byte
+    binary.BigEndian.PutUint64(counter[:], uint64(step))
+    mac := hmac.New(sha1.New, key)
+    mac.Write(counter[:])
+    sum := mac.Sum(nil)
+
+    offset := sum[len(sum)-1] & 0x0f
+    value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+    return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// provisioningURI is the otpauth:// URI authenticator apps scan.
+func provisioningURI(username, secret string) string {
+    query := url.Values{
+        "secret":    {secret},
+        "issuer":    {TOTPIssuer},
+        "algorithm": {"SHA1"},
+        "digits":    {strconv.Itoa(totpDigits)},
+        "period":    {strconv.Itoa(totpPeriod)},
+    }
+    return "otpauth://totp/" + url.PathEscape(TOTPIssuer+":"+username) + "?" + query.Encode()
+}
+
+// normalizeCode drops the spaces and dashes people type into codes.
+func normalizeCode(code string) string {
+    code = strings.ToLower(code)
+    return strings.NewReplacer(" ", "", "-", "").Replace(code)
+}
+
+func hashRecoveryCode(code string) string {
+    sum := sha256.Sum256([]byte(code))
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,616 @@
+// Command dtqctl administers the task queue through its REST API.
+//
+//     dtqctl [-server URL] [-insecure] [-o table|json] <command> [args]
+//
+// Run dtqctl without arguments for the list of commands.
+package main
+
+import (
+    "context"
+    "crypto/tls"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "task_queue_system/apiclient"
+    "task_queue_system/models"
+    "text/tabwriter"
+    "time"
+)
+
+const usage = `Usage: dtqctl [-server URL] [-insecure] [-o table|json] <command> [args]
+
+Commands:
+  login -u USER [-p PASSWORD]     log in and cache tokens (password also read from DTQ_PASSWORD or stdin,
+                                  a two-factor code from DTQ_TOTP_CODE or stdin)
+  logout                          end the session and forget cached tokens
+  passwd                          change your password (prompts; or DTQ_PASSWORD and DTQ_NEW_PASSWORD)
+  totp enroll                     set up two-factor authentication and print recovery codes
+  totp disable                    turn two-factor authentication off (prompts for password and code)
+  register -u USER [-p PASSWORD] [-org ORG]
+                                  sign up; a new ORG is created with you as its admin
+  submit [flags] [DATA...]        submit one task per DATA argument
+  submit [flags] -f FILE          submit the file contents as one task
+  submit -                        submit NDJSON tasks read from stdin
+  tasks [-status S] [-type T] [-owner U] [-priority N] [-since D] [-sort KEY] [-limit N] [-cursor C] [-all]
+                                  list tasks
+  get ID                          show a task
+  cancel ID...                    cancel pending tasks
+  retry ID...                     re-enqueue failed tasks
+  wait [-timeout D] ID            wait for a task to finish
+  queues                          show queue depths
+  workers                         show active workers
+  users create -u USER [-p PASSWORD] [-role ROLE]
+                                  add a user to your organization (admins only)
+  users list                      list your organization's users and their roles (admins only)
+  users set-role USER ROLE        assign admin, producer, viewer or worker (admins only)
+  users revoke USER               log a user out of every session (admins only)
+  users reset-password USER [-p PASSWORD]
+                                  set a user's password and lift a lockout (admins only)
+  users disable USER              disable a user and end their sessions (admins only)
+  users enable USER               enable a disabled user (admins only)
+  users reset-totp USER           remove a user's two-factor enrollment (admins only)
+  service-accounts list           list your organization's service accounts (admins only)
+  service-accounts create NAME    add a service account (admins only)
+  service-accounts keys NAME      list a service account's API keys (admins only)
+  service-accounts create-key NAME -scopes S[,S...] [-expires-in D]
+                                  issue an API key and print its secret (admins only)
+  service-accounts expire-key NAME ID [-in D]
+                                  expire an API key now or after D (admins only)
+  service-accounts revoke-key NAME ID
+                                  revoke an API key (admins only)
+  audit [-actor U] [-action A] [-result R] [-since D] [-limit N] [-cursor C]
+                                  show the audit log, newest first (admins only)
+  quota                           show your organization's quota and your usage
+  quota ORG                       show an organization's quota (operators only)
+  quota set ORG [-max-queued N] [-max-per-minute N] [-max-per-hour N] [-max-bytes-per-day N]
+        [-user-max-queued N] [-user-max-per-hour N] [-user-max-bytes-per-day N]
+                                  set an organization's quota, 0 for no limit (operators only)
+  schedules                       manage schedules (not supported by this server)
+
+Set DTQ_API_KEY to authenticate with a service account's API key instead of
+cached login tokens.
+`
+
+// cli carries the global flags and the API client shared by all commands.
+type cli struct {
+    server string
+    output string
+    client *apiclient.Client
+}
+
+func main() {
+    global := flag.NewFlagSet("dtqctl", flag.ExitOnError)
+    global.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+    server := global.String("server", envOr("DTQ_SERVER", "https://localhost:8443"), "API base URL")
+    insecure := global.Bool("insecure", false, "skip TLS certificate verification (self-signed certificates)")
+    output := global.String("o", "table", "output format: table or json")
+    global.Parse(os.Args[1:])
+
+    if global.NArg() == 0 {
+        global.Usage()
+        os.Exit(2)
+    }
+    if *output != "table" && *output != "json" {
+        fatalf("unknown output format %q", *output)
+    }
+
+    httpClient := &http.Client{Timeout: 30 * time.Second}
+    if *insecure {
+        httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+    }
+    c := &cli{server: *server, output: *output, client: apiclient.New(*server, httpClient)}
+
+    command, args := global.Arg(0), global.Args()[1:]
+    apiKey := os.Getenv("DTQ_API_KEY")
+    if apiKey != "" {
+        c.client.SetAPIKey(apiKey)
+    } else if command != "login" && command != "register" {
+        c.loadTokens()
+    }
+
+    ctx := context.Background()
+    var err error
+    switch command {
+    case "login":
+        err = c.login(ctx, args)
+    case "logout":
+        err = c.logout(ctx)
+    case "passwd":
+        err = c.passwd(ctx)
+    case "totp":
+        err = c.totp(ctx, args)
+    case "submit":
+        err = c.submit(ctx, args)
+    case "tasks":
+        err = c.listTasks(ctx, args)
+    case "get":
+        err = c.getTask(ctx, args)
+    case "cancel":
+        err = c.cancelTasks(ctx, args)
+    case "retry":
+        err = c.retryTasks(ctx, args)
+    case "wait":
+        err = c.waitTask(ctx, args)
+    case "queues":
+        err = c.queues(ctx)
+    case "workers":
+        err = c.workers(ctx)
+    case "register":
+        err = c.register(ctx, args)
+    case "users":
+        err = c.users(ctx, args)
+    case "service-accounts":
+        err = c.serviceAccounts(ctx, args)
+    case "audit":
+        err = c.audit(ctx, args)
+    case "quota":
+        err = c.quota(ctx, args)
+    case "schedules":
+        err = errors.New("schedules are not supported by this server")
+    default:
+        global.Usage()
+        os.Exit(2)
+    }
+
+    // Refreshed tokens are written back so the next run does not need to
+    // refresh again
+    if apiKey == "" && command != "login" && command != "logout" && command != "register" && command != "passwd" {
+        c.saveTokens()
+    }
+    if err != nil {
+        fatalf("%v", err)
+    }
+}
+
+func (c *cli) login(ctx context.Context, args []string) error {
+    fs := flag.NewFlagSet("login", flag.ExitOnError)
+    username := fs.String("u", os.Getenv("DTQ_USERNAME"), "username")
+    password := fs.String("p", "", "password")
+    fs.Parse(args)
+
+    if *username == "" {
+        return errors.New("login: -u is required")
+    }
+    pw, err := readPassword(*password)
+    if err != nil {
+        return err
+    }
+    err = c.client.Login(ctx, *username, pw)
+    if err == apiclient.ErrTOTPRequired {
+        code, readErr := readSecret("Two-factor code: ", os.Getenv("DTQ_TOTP_CODE"))
+        if readErr != nil {
+            return readErr
+        }
+        err = c.client.LoginTOTP(ctx, code)
+    }
+    if err != nil {
+        return err
+    }
+    c.saveTokens()
+    fmt.Fprintln(os.Stderr, "Logged in as", *username)
+    return nil
+}
+
+// logout ends the session on the server and drops this server's cached
+// tokens, even when the server cannot be reached.
+func (c *cli) logout(ctx context.Context) error {
+    if accessToken, _ := c.client.Tokens(); accessToken != "" {
+        if err := c.client.Logout(ctx); err != nil {
+            fmt.Fprintln(os.Stderr, "warning: server logout failed:", err)
+        }
+    }
+
+    cache := readTokenCache()
+    delete(cache, c.server)
+    return writeTokenCache(cache)
+}
+
+// passwd changes the password. The server ends every session, so the
+// cached tokens are dropped as on logout.
+func (c *cli) passwd(ctx context.Context) error {
+    current, err := readSecret("Current password: ", os.Getenv("DTQ_PASSWORD"))
+    if err != nil {
+        return err
+    }
+    password, err := readSecret("New password: ", os.Getenv("DTQ_NEW_PASSWORD"))
+    if err != nil {
+        return err
+    }
+    if err := c.client.ChangePassword(ctx, current, password); err != nil {
+        return err
+    }
+
+    cache := readTokenCache()
+    delete(cache, c.server)
+    if err := writeTokenCache(cache); err != nil {
+        return err
+    }
+    fmt.Fprintln(os.Stderr, "Password changed; log in again")
+    return nil
+}
+
+func (c *cli) totp(ctx context.Context, args []string) error {
+    if len(args) != 1 {
+        return errors.New("totp: expected enroll or disable")
+    }
+    password, err := readSecret("Password: ", os.Getenv("DTQ_PASSWORD"))
+    if err != nil {
+        return err
+    }
+
+    switch args[0] {
+    case "enroll":
+        secret, uri, err := c.client.BeginTOTPEnrollment(ctx, password)
+        if err != nil {
+            return err
+        }
+        fmt.Fprintln(os.Stderr, "Add this account to your authenticator app, then enter the code it shows.")
+        fmt.Fprintln(os.Stderr, "Secret:", secret)
+        fmt.Fprintln(os.Stderr, "URI:   ", uri)
+        code, err := readSecret("Two-factor code: ", os.Getenv("DTQ_TOTP_CODE"))
+        if err != nil {
+            return err
+        }
+        codes, err := c.client.ConfirmTOTPEnrollment(ctx, code)
+        if err != nil {
+            return err
+        }
+        fmt.Fprintln(os.Stderr, "Two-factor authentication enabled. Keep these recovery codes safe; each works once:")
+        for _, code := range codes {
+            fmt.Println(code)
+        }
+        return nil
+    case "disable":
+        code, err := readSecret("Two-factor code: ", os.Getenv("DTQ_TOTP_CODE"))
+        if err != nil {
+            return err
+        }
+        if err := c.client.DisableTOTP(ctx, password, code); err != nil {
+            return err
+        }
+        fmt.Fprintln(os.Stderr, "Two-factor authentication disabled")
+        return nil
+    }
+    return fmt.Errorf("totp: unknown subcommand %q", args[0])
+}
+
+func (c *cli) register(ctx context.Context, args []string) error {
+    fs := flag.NewFlagSet("register", flag.ExitOnError)
+    username := fs.String("u", "", "username")
+    password := fs.String("p", "", "password")
+    org := fs.String("org", "", "create this organization (default: join the default organization)")
+    fs.Parse(args)
+
+    if *username == "" {
+        return errors.New("register: -u is required")
+    }
+    pw, err := readPassword(*password)
+    if err != nil {
+        return err
+    }
+    if err := c.client.RegisterOrg(ctx, *username, pw, *org); err != nil {
+        return err
+    }
+    fmt.Fprintln(os.Stderr, "Registered", *username)
+    return nil
+}
+
+func (c *cli) users(ctx context.Context, args []string) error {
+    if len(args) == 0 {
+        return errors.New("users: expected create, list or set-role")
+    }
+    switch args[0] {
+    case "create":
+        return c.createUser(ctx, args[1:])
+    case "list":
+        return c.listUsers(ctx)
+    case "set-role":
+        if len(args) != 3 {
+            return errors.New("users set-role: USER and ROLE are required")
+        }
+        if err := c.client.SetUserRole(ctx, args[1], args[2]); err != nil {
+            return err
+        }
+        fmt.Fprintf(os.Stderr, "%s is now %s\n", args[1], args[2])
+        return nil
+    case "revoke":
+        if len(args) != 2 {
+            return errors.New("users revoke: USER is required")
+        }
+        if err := c.client.RevokeSessions(ctx, args[1]); err != nil {
+            return err
+        }
+        fmt.Fprintln(os.Stderr, "Revoked all sessions of", args[1])
+        return nil
+    case "reset-password":
+        return c.resetPassword(ctx, args[1:])
+    case "disable", "enable":
+        if len(args) != 2 {
+            return fmt.Errorf("users %s: USER is required", args[0])
+        }
+        if err := c.client.SetUserDisabled(ctx, args[1], args[0] == "disable"); err != nil {
+            return err
+        }
+        fmt.Fprintf(os.Stderr, "%s is now %sd\n", args[1], args[0])
+        return nil
+    case "reset-totp":
+        if len(args) != 2 {
+            return errors.New("users reset-totp: USER is required")
+        }
+        if err := c.client.ResetTOTP(ctx, args[1]); err != nil {
+            return err
+        }
+        fmt.Fprintln(os.Stderr, "Removed the two-factor enrollment of", args[1])
+        return nil
+    }
+    return fmt.Errorf("users: unknown subcommand %q", args[0])
+}
+
+func (c *cli) resetPassword(ctx context.Context, args []string) error {
+    if len(args) == 0 {
+        return errors.New("users reset-password: USER is required")
+    }
+    fs := flag.NewFlagSet("users reset-password", flag.ExitOnError)
+    password := fs.String("p", "", "new password")
+    fs.Parse(args[1:])
+
+    pw, err := readSecret("New password: ", *password)
+    if err != nil {
+        return err
+    }
+    if err := c.client.ResetPassword(ctx, args[0], pw); err != nil {
+        return err
+    }
+    fmt.Fprintln(os.Stderr, "Reset the password of", args[0])
+    return nil
+}
+
+func (c *cli) listUsers(ctx context.Context) error {
+    users, err := c.client.ListUsers(ctx)
+    if err != nil {
+        return err
+    }
+    if c.output == "json" {
+        return printJSON(users)
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "USERNAME\tROLE\tDISABLED\t2FA")
+    for _, user := range users {
+        fmt.Fprintf(w, "%s\t%s\t%t\t%t\n", user.Username, user.Role, user.Disabled, user.TOTPEnabled)
+    }
+    return w.Flush()
+}
+
+func (c *cli) createUser(ctx context.Context, args []string) error {
+    fs := flag.NewFlagSet("users create", flag.ExitOnError)
+    username := fs.String("u", "", "username")
+    password := fs.String("p", "", "password")
+    role := fs.String("role", "", "admin, producer, viewer or worker (default producer)")
+    fs.Parse(args)
+
+    if *username == "" {
+        return errors.New("users create: -u is required")
+    }
+    pw, err := readPassword(*password)
+    if err != nil {
+        return err
+    }
+    user, err := c.client.CreateUser(ctx, *username, pw, *role)
+    if err != nil {
+        return err
+    }
+    fmt.Fprintf(os.Stderr, "Created %s %s in %s\n", user.Role, user.Username, user.Org)
+    return nil
+}
+
+func (c *cli) audit(ctx context.Context, args []string) error {
+    fs := flag.NewFlagSet("audit", flag.ExitOnError)
+    var opts apiclient.AuditOptions
+    fs.StringVar(&opts.Actor, "actor", "", "only events of this user")
+    fs.StringVar(&opts.Action, "action", "", `only this action, e.g. "POST /login"`)
+    fs.StringVar(&opts.Result, "result", "", "only success, denied or failure")
+    fs.IntVar(&opts.Limit, "limit", 50, "page size")
+    fs.StringVar(&opts.Cursor, "cursor", "", "continue from a previous next_cursor")
+    since := fs.Duration("since", 0, "only events within this duration")
+    fs.Parse(args)
+
+    if *since > 0 {
+        opts.Since = time.Now().Add(-*since)
+    }
+
+    page, err := c.client.ListAuditEvents(ctx, opts)
+    if err != nil {
+        return err
+    }
+    if c.output == "json" {
+        return printJSON(page)
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "TIME\tACTOR\tACTION\tTARGET\tRESULT\tIP")
+    for _, event := range page.Events {
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", event.Time.Local().Format(time.RFC3339),
+            event.Actor, event.Action, event.Target, event.Result, event.IP)
+    }
+    if err := w.Flush(); err != nil {
+        return err
+    }
+    if page.NextCursor != "" {
+        fmt.Fprintln(os.Stderr, "More events: -cursor", page.NextCursor)
+    }
+    return nil
+}
+
+func (c *cli) quota(ctx context.Context, args []string) error {
+    if len(args) > 0 && args[0] == "set" {
+        if len(args) < 2 {
+            return errors.New("quota set: ORG is required")
+        }
+        fs := flag.NewFlagSet("quota set", flag.ExitOnError)
+        var quota models.Quota
+        fs.IntVar(&quota.MaxQueued, "max-queued", 0, "maximum pending tasks, 0 for no limit")
+        fs.IntVar(&quota.MaxTasksPerMinute, "max-per-minute", 0, "maximum submissions per minute, 0 for no limit")
+        fs.IntVar(&quota.MaxTasksPerHour, "max-per-hour", 0, "maximum submissions per hour, 0 for no limit")
+        fs.Int64Var(&quota.MaxPayloadBytesPerDay, "max-bytes-per-day", 0, "maximum payload bytes per day, 0 for no limit")
+        fs.IntVar(&quota.User.MaxQueued, "user-max-queued", 0, "maximum pending tasks of each member, 0 for no limit")
+        fs.IntVar(&quota.User.MaxTasksPerHour, "user-max-per-hour", 0, "maximum submissions per hour of each member, 0 for no limit")
+        fs.Int64Var(&quota.User.MaxPayloadBytesPerDay, "user-max-bytes-per-day", 0, "maximum payload bytes per day of each member, 0 for no limit")
+        fs.Parse(args[2:])
+        if err := c.client.SetOrgQuota(ctx, args[1], quota); err != nil {
+            return err
+        }
+        args = args[1:2]
+    }
+    if len(args) == 0 {
+        return c.myQuota(ctx)
+    }
+    if len(args) != 1 {
+        return errors.New("quota: at most one ORG is allowed")
+    }
+
+    quota, err := c.client.OrgQuota(ctx, args[0])
+    if err != nil {
+        return err
+    }
+    if c.output == "json" {
+        return printJSON(quota)
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "LIMIT\tORGANIZATION\tEACH MEMBER")
+    fmt.Fprintf(w, "Max queued:\t%s\t%s\n", limit(int64(quota.MaxQueued)), limit(int64(quota.User.MaxQueued)))
+    fmt.Fprintf(w, "Max per minute:\t%s\t-\n", limit(int64(quota.MaxTasksPerMinute)))
+    fmt.Fprintf(w, "Max per hour:\t%s\t%s\n", limit(int64(quota.MaxTasksPerHour)), limit(int64(quota.User.MaxTasksPerHour)))
+    fmt.Fprintf(w, "Max bytes per day:\t%s\t%s\n", limit(quota.MaxPayloadBytesPerDay), limit(quota.User.MaxPayloadBytesPerDay))
+    return w.Flush()
+}
+
+// myQuota shows the caller's organization quota next to what the
+// organization and the caller have used of it.
+func (c *cli) myQuota(ctx context.Context) error {
+    report, err := c.client.MyQuota(ctx)
+    if err != nil {
+        return err
+    }
+    if c.output == "json" {
+        return printJSON(report)
+    }
+
+    quota, org, user := report.Quota, report.OrgUsage, report.UserUsage
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintf(w, "\tORGANIZATION (%s)\tYOU\n", report.Org)
+    fmt.Fprintf(w, "Queued:\t%s\t%s\n", used(int64(org.Queued), int64(quota.MaxQueued)), used(int64(user.Queued), int64(quota.User.MaxQueued)))
+    fmt.Fprintf(w, "Last minute:\t%s\t%d\n", used(int64(org.TasksLastMinute), int64(quota.MaxTasksPerMinute)), user.TasksLastMinute)
+    fmt.Fprintf(w, "Last hour:\t%s\t%s\n", used(int64(org.TasksLastHour), int64(quota.MaxTasksPerHour)), used(int64(user.TasksLastHour), int64(quota.User.MaxTasksPerHour)))
+    fmt.Fprintf(w, "Bytes last day:\t%s\t%s\n", used(org.PayloadBytesLastDay, quota.MaxPayloadBytesPerDay), used(user.PayloadBytesLastDay, quota.User.MaxPayloadBytesPerDay))
+    return w.Flush()
+}
+
+// used formats an amount used against its limit.
+func used(n, max int64) string {
+    return strconv.FormatInt(n, 10) + " / " + limit(max)
+}
+
+func limit(n int64) string {
+    if n == 0 {
+        return "unlimited"
+    }
+    return strconv.FormatInt(n, 10)
+}
+
+// tokenCache is the on-disk form of cached tokens, keyed by server URL.
+type tokenCache map[string]struct {
+    AccessToken  string `json:"access_token"`
+    RefreshToken string `json:"refresh_token"`
+}
+
+func tokenCachePath() string {
+    dir, err := os.UserConfigDir()
+    if err != nil {
+        dir = os.TempDir()
+    }
+    return filepath.Join(dir, "dtqctl", "tokens.json")
+}
+
+func readTokenCache() tokenCache {
+    cache := tokenCache{}
+    data, err := os.ReadFile(tokenCachePath())
+    if err == nil {
+        json.Unmarshal(data, &cache)
+    }
+    return cache
+}
+
+func (c *cli) loadTokens() {
+    if tokens, ok := readTokenCache()[c.server]; ok {
+        c.client.SetTokens(tokens.AccessToken, tokens.RefreshToken)
+    }
+}
+
+func (c *cli) saveTokens() {
+    accessToken, refreshToken := c.client.Tokens()
+    if accessToken == "" {
+        return
+    }
+
+    cache := readTokenCache()
+    entry := cache[c.server]
+    entry.AccessToken, entry.RefreshToken = accessToken, refreshToken
+    cache[c.server] = entry
+
+    if err := writeTokenCache(cache); err != nil {
+        fmt.Fprintln(os.Stderr, "warning: cannot cache tokens:", err)
+    }
+}
+
+func writeTokenCache(cache tokenCache) error {
+    data, err := json.MarshalIndent(cache, "", "  ")
+    if err != nil {
+        return err
+    }
+    path := tokenCachePath()
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return err
+    }
+    return os.WriteFile(path, data, 0600)
+}
+
+func readPassword(flagValue string) (string, error) {
+    if flagValue != "" {
+        return flagValue, nil
+    }
+    return readSecret("Password: ", os.Getenv("DTQ_PASSWORD"))
+}
+
+// readSecret returns value, or else prompts for it on stdin.
+func readSecret(prompt, value string) (string, error) {
+    if value != "" {
+        return value, nil
+    }
+
+    fmt.Fprint(os.Stderr, prompt)
+    var pw string
+    if _, err := fmt.Fscanln(os.Stdin, &pw); err != nil {
+        return "", fmt.Errorf("no %s given", strings.ToLower(strings.TrimSuffix(prompt, ": ")))
+    }
+    return pw, nil
+}
+
+func envOr(name, fallback string) string {
+    if value := os.Getenv(name); value != "" {
+        return value
+    }
+    return fallback
+}
+
+func fatalf(format string, args ...interface{}) {
+    fmt.Fprintf(os.Stderr, "dtqctl: "+format+"\n", args...)
+    os.Exit(1)
+}
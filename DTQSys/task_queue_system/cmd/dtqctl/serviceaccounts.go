@@ -0,0 +1,137 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "flag"
+    "fmt"
+    "os"
+    "strings"
+    "text/tabwriter"
+    "time"
+)
+
+func (c *cli) serviceAccounts(ctx context.Context, args []string) error {
+    if len(args) == 0 {
+        return errors.New("service-accounts: expected list, create, keys, create-key, expire-key or revoke-key")
+    }
+    switch args[0] {
+    case "list":
+        return c.listServiceAccounts(ctx)
+    case "create":
+        if len(args) != 2 {
+            return errors.New("service-accounts create: NAME is required")
+        }
+        account, err := c.client.CreateServiceAccount(ctx, args[1])
+        if err != nil {
+            return err
+        }
+        fmt.Fprintf(os.Stderr, "Created service account %s in %s\n", account.Username, account.Org)
+        return nil
+    case "keys":
+        if len(args) != 2 {
+            return errors.New("service-accounts keys: NAME is required")
+        }
+        return c.listAPIKeys(ctx, args[1])
+    case "create-key":
+        return c.createAPIKey(ctx, args[1:])
+    case "expire-key":
+        return c.expireAPIKey(ctx, args[1:])
+    case "revoke-key":
+        if len(args) != 3 {
+            return errors.New("service-accounts revoke-key: NAME and ID are required")
+        }
+        if err := c.client.RevokeAPIKey(ctx, args[1], args[2]); err != nil {
+            return err
+        }
+        fmt.Fprintln(os.Stderr, "Revoked API key", args[2])
+        return nil
+    }
+    return fmt.Errorf("service-accounts: unknown subcommand %q", args[0])
+}
+
+func (c *cli) listServiceAccounts(ctx context.Context) error {
+    accounts, err := c.client.ListServiceAccounts(ctx)
+    if err != nil {
+        return err
+    }
+    if c.output == "json" {
+        return printJSON(accounts)
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "NAME\tORG")
+    for _, account := range accounts {
+        fmt.Fprintf(w, "%s\t%s\n", account.Username, account.Org)
+    }
+    return w.Flush()
+}
+
+func (c *cli) listAPIKeys(ctx context.Context, account string) error {
+    keys, err := c.client.ListAPIKeys(ctx, account)
+    if err != nil {
+        return err
+    }
+    if c.output == "json" {
+        return printJSON(keys)
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tSCOPES\tCREATED\tEXPIRES\tREVOKED")
+    for _, key := range keys {
+        expires := "never"
+        if key.Expires != nil {
+            expires = key.Expires.Format(time.RFC3339)
+        }
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\n", key.ID, strings.Join(key.Scopes, ","),
+            key.Created.Format(time.RFC3339), expires, key.Revoked)
+    }
+    return w.Flush()
+}
+
+func (c *cli) createAPIKey(ctx context.Context, args []string) error {
+    if len(args) == 0 {
+        return errors.New("service-accounts create-key: NAME is required")
+    }
+    fs := flag.NewFlagSet("service-accounts create-key", flag.ExitOnError)
+    scopes := fs.String("scopes", "", "comma-separated scopes, e.g. enqueue:emails,read:tasks")
+    expiresIn := fs.Duration("expires-in", 0, "expire the key after this long (0 never expires)")
+    fs.Parse(args[1:])
+
+    if *scopes == "" {
+        return errors.New("service-accounts create-key: -scopes is required")
+    }
+    var expires *time.Time
+    if *expiresIn > 0 {
+        at := time.Now().Add(*expiresIn)
+        expires = &at
+    }
+
+    secret, key, err := c.client.CreateAPIKey(ctx, args[0], strings.Split(*scopes, ","), expires)
+    if err != nil {
+        return err
+    }
+    if c.output == "json" {
+        return printJSON(map[string]interface{}{"key": secret, "api_key": key})
+    }
+    // The secret goes to stdout alone so it can be captured by scripts
+    fmt.Fprintf(os.Stderr, "Created API key %s; store it now, it is not shown again\n", key.ID)
+    fmt.Println(secret)
+    return nil
+}
+
+func (c *cli) expireAPIKey(ctx context.Context, args []string) error {
+    if len(args) < 2 {
+        return errors.New("service-accounts expire-key: NAME and ID are required")
+    }
+    fs := flag.NewFlagSet("service-accounts expire-key", flag.ExitOnError)
+    in := fs.Duration("in", 0, "expire after this long instead of now")
+    fs.Parse(args[2:])
+
+    at := time.Now().Add(*in)
+    if err := c.client.SetAPIKeyExpiry(ctx, args[0], args[1], &at); err != nil {
+        return err
+    }
+    fmt.Fprintf(os.Stderr, "API key %s expires %s\n", args[1], at.Format(time.RFC3339))
+    return nil
+}
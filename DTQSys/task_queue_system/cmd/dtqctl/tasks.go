@@ -0,0 +1,271 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "sort"
+    "strings"
+    "task_queue_system/apiclient"
+    "task_queue_system/models"
+    "text/tabwriter"
+    "time"
+)
+
+func (c *cli) submit(ctx context.Context, args []string) error {
+    fs := flag.NewFlagSet("submit", flag.ExitOnError)
+    taskType := fs.String("type", "", "task type")
+    priority := fs.Int("priority", 1, "priority: 1 (low) to 3 (high)")
+    file := fs.String("f", "", "read the task data from FILE")
+    key := fs.String("key", "", "idempotency key (single task only)")
+    fs.Parse(args)
+
+    var tasks []models.Task
+    switch {
+    case *file != "":
+        data, err := os.ReadFile(*file)
+        if err != nil {
+            return err
+        }
+        tasks = append(tasks, models.Task{Type: *taskType, Data: string(data), Priority: *priority})
+    case fs.NArg() == 1 && fs.Arg(0) == "-":
+        var err error
+        if tasks, err = readNDJSON(os.Stdin, *taskType, *priority); err != nil {
+            return err
+        }
+    case fs.NArg() > 0:
+        for _, data := range fs.Args() {
+            tasks = append(tasks, models.Task{Type: *taskType, Data: data, Priority: *priority})
+        }
+    default:
+        return errors.New("submit: give task data as arguments, -f FILE or - for NDJSON on stdin")
+    }
+    if *key != "" && len(tasks) > 1 {
+        return errors.New("submit: -key only applies to a single task")
+    }
+
+    var created []models.Task
+    for i, task := range tasks {
+        result, err := c.client.CreateTask(ctx, task, *key)
+        if err != nil {
+            c.printTasks(created)
+            return fmt.Errorf("task %d: %v", i+1, err)
+        }
+        created = append(created, *result)
+    }
+    c.printTasks(created)
+    return nil
+}
+
+// readNDJSON reads one task object per line. Lines may leave out type and
+// priority, which then come from the command-line flags.
+func readNDJSON(r io.Reader, taskType string, priority int) ([]models.Task, error) {
+    var tasks []models.Task
+    scanner := bufio.NewScanner(r)
+    scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+    for line := 1; scanner.Scan(); line++ {
+        text := strings.TrimSpace(scanner.Text())
+        if text == "" {
+            continue
+        }
+
+        task := models.Task{Type: taskType, Priority: priority}
+        if err := json.Unmarshal([]byte(text), &task); err != nil {
+            return nil, fmt.Errorf("stdin line %d: %v", line, err)
+        }
+        tasks = append(tasks, task)
+    }
+    return tasks, scanner.Err()
+}
+
+func (c *cli) listTasks(ctx context.Context, args []string) error {
+    fs := flag.NewFlagSet("tasks", flag.ExitOnError)
+    var opts apiclient.ListOptions
+    fs.StringVar(&opts.Status, "status", "", "only tasks with this status")
+    fs.StringVar(&opts.Type, "type", "", "only tasks of this type")
+    fs.StringVar(&opts.Owner, "owner", "", "only tasks submitted by this user (admins and viewers only)")
+    fs.IntVar(&opts.Priority, "priority", 0, "only tasks with this priority")
+    fs.StringVar(&opts.Sort, "sort", "", "created or priority, prefix - for descending")
+    fs.IntVar(&opts.Limit, "limit", 50, "page size")
+    fs.StringVar(&opts.Cursor, "cursor", "", "continue from a previous next_cursor")
+    since := fs.Duration("since", 0, "only tasks created within this duration")
+    all := fs.Bool("all", false, "follow cursors and list every matching task")
+    fs.Parse(args)
+
+    if *since > 0 {
+        opts.CreatedAfter = time.Now().Add(-*since)
+    }
+
+    if *all {
+        tasks, err := c.client.ListAllTasks(ctx, opts)
+        if err != nil {
+            return err
+        }
+        c.printTasks(tasks)
+        return nil
+    }
+
+    page, err := c.client.ListTasks(ctx, opts)
+    if err != nil {
+        return err
+    }
+    if c.output == "json" {
+        return printJSON(page)
+    }
+    c.printTasks(page.Tasks)
+    if page.NextCursor != "" {
+        fmt.Fprintln(os.Stderr, "More tasks: -cursor", page.NextCursor)
+    }
+    return nil
+}
+
+func (c *cli) getTask(ctx context.Context, args []string) error {
+    if len(args) != 1 {
+        return errors.New("get: exactly one task ID is required")
+    }
+
+    task, err := c.client.GetTask(ctx, args[0])
+    if err != nil {
+        return err
+    }
+    if c.output == "json" {
+        return printJSON(task)
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintf(w, "ID:\t%s\n", task.ID)
+    fmt.Fprintf(w, "Type:\t%s\n", task.Type)
+    fmt.Fprintf(w, "Owner:\t%s\n", task.Owner)
+    fmt.Fprintf(w, "Status:\t%s\n", task.Status)
+    fmt.Fprintf(w, "Priority:\t%d\n", task.Priority)
+    fmt.Fprintf(w, "Retries:\t%d\n", task.Retries)
+    fmt.Fprintf(w, "Created:\t%s\n", task.Created.Format(time.RFC3339))
+    fmt.Fprintf(w, "Data:\t%s\n", task.Data)
+    return w.Flush()
+}
+
+func (c *cli) cancelTasks(ctx context.Context, args []string) error {
+    if len(args) == 0 {
+        return errors.New("cancel: at least one task ID is required")
+    }
+
+    for _, id := range args {
+        if err := c.client.CancelTask(ctx, id); err != nil {
+            return fmt.Errorf("%s: %v", id, err)
+        }
+        fmt.Fprintln(os.Stderr, "Cancelled", id)
+    }
+    return nil
+}
+
+func (c *cli) retryTasks(ctx context.Context, args []string) error {
+    if len(args) == 0 {
+        return errors.New("retry: at least one task ID is required")
+    }
+
+    var retried []models.Task
+    for _, id := range args {
+        task, err := c.client.RetryTask(ctx, id)
+        if err != nil {
+            c.printTasks(retried)
+            return fmt.Errorf("%s: %v", id, err)
+        }
+        retried = append(retried, *task)
+    }
+    c.printTasks(retried)
+    return nil
+}
+
+func (c *cli) waitTask(ctx context.Context, args []string) error {
+    fs := flag.NewFlagSet("wait", flag.ExitOnError)
+    timeout := fs.Duration("timeout", 0, "give up after this long (0 waits forever)")
+    fs.Parse(args)
+    if fs.NArg() != 1 {
+        return errors.New("wait: exactly one task ID is required")
+    }
+
+    if *timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, *timeout)
+        defer cancel()
+    }
+    task, err := c.client.WaitForTask(ctx, fs.Arg(0), time.Second)
+    if err != nil {
+        return err
+    }
+    c.printTasks([]models.Task{*task})
+    if task.Status != "completed" {
+        return fmt.Errorf("task %s", task.Status)
+    }
+    return nil
+}
+
+func (c *cli) queues(ctx context.Context) error {
+    depths, err := c.client.QueueDepths(ctx)
+    if err != nil {
+        return err
+    }
+    if c.output == "json" {
+        return printJSON(depths)
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "QUEUE\tDEPTH")
+    for _, name := range []string{"high", "medium", "low"} {
+        fmt.Fprintf(w, "%s\t%d\n", name, depths[name])
+    }
+    return w.Flush()
+}
+
+func (c *cli) workers(ctx context.Context) error {
+    workers, err := c.client.Workers(ctx)
+    if err != nil {
+        return err
+    }
+    if c.output == "json" {
+        return printJSON(workers)
+    }
+
+    ids := make([]string, 0, len(workers))
+    for id := range workers {
+        ids = append(ids, id)
+    }
+    sort.Strings(ids)
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "WORKER\tSTATUS")
+    for _, id := range ids {
+        fmt.Fprintf(w, "%s\t%s\n", id, workers[id])
+    }
+    return w.Flush()
+}
+
+func (c *cli) printTasks(tasks []models.Task) {
+    if c.output == "json" {
+        if tasks == nil {
+            tasks = []models.Task{}
+        }
+        printJSON(tasks)
+        return
+    }
+
+    w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+    fmt.Fprintln(w, "ID\tTYPE\tOWNER\tSTATUS\tPRIORITY\tRETRIES\tCREATED")
+    for _, task := range tasks {
+        fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%s\n",
+            task.ID, task.Type, task.Owner, task.Status, task.Priority,
+            task.Retries, task.Created.Format(time.RFC3339))
+    }
+    w.Flush()
+}
+
+func printJSON(v interface{}) error {
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    return enc.Encode(v)
+}
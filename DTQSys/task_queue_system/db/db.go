@@ -2,44 +2,758 @@ package db
 
 import (
     "database/sql"
+    "errors"
     "fmt"
     "os"
+    "strings"
     "task_queue_system/models"
+    "time"
 
-    _ "github.com/lib/pq"
+    "github.com/lib/pq"
 )
 
-func OpenDB() (*sql.DB, error) {
+// ConnString builds the PostgreSQL connection string from the environment.
+func ConnString() string {
     host := os.Getenv("DB_HOST")
     port := os.Getenv("DB_PORT")
     user := os.Getenv("DB_USER")
     password := os.Getenv("DB_PASSWORD")
     dbname := os.Getenv("DB_NAME")
 
-    psqlInfo := fmt.Sprintf(
+    return fmt.Sprintf(
         "host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
         host, port, user, password, dbname)
-    db, err := sql.Open("postgres", psqlInfo)
+}
+
+func OpenDB() (*sql.DB, error) {
+    db, err := sql.Open("postgres", ConnString())
     if err != nil {
         return nil, err
     }
     return db, db.Ping()
 }
 
-func InsertTask(db *sql.DB, task models.Task) error {
+// Store persists tasks and user accounts. PostgresStore is the production
+// implementation; MemoryStore backs tests and embedded use.
+type Store interface {
+    InsertTask(task models.Task) error
+    // DeleteTask removes the task, e.g. one that was stored but could not be
+    // queued. Deleting a missing task is not an error.
+    DeleteTask(taskID string) error
+    UpdateTaskStatus(taskID, status string) error
+    // UpdateTaskRetries records how many attempts of the task have failed.
+    UpdateTaskRetries(taskID string, retries int) error
+    // SetTaskDelivery records the consumer a task was handed to and the
+    // receipt of that delivery, so an acknowledgement can be checked against
+    // them. ClearTaskDelivery clears the record only if it holds consumer
+    // and receipt, and reports whether it did; of concurrent
+    // acknowledgements of one delivery, exactly one succeeds.
+    SetTaskDelivery(taskID, consumer, receipt string) error
+    ClearTaskDelivery(taskID, consumer, receipt string) (bool, error)
+    // TransitionTaskStatus sets the status only if the task is currently in
+    // one of the from statuses, and reports whether it did.
+    TransitionTaskStatus(taskID string, from []string, to string) (bool, error)
+    // ListTasks returns the tasks matching the filter, in its sort order.
+    ListTasks(filter TaskFilter) ([]models.Task, error)
+    // CountTasks counts the tasks matching the filter, ignoring its cursor,
+    // sort and limit.
+    CountTasks(filter TaskFilter) (int, error)
+    // GetTask returns ErrNotFound when the task does not exist.
+    GetTask(taskID string) (*models.Task, error)
+
+    UserExists(username string) (bool, error)
+    CreateUser(user models.User, passwordHash string) error
+    // LoginRecord, GetUser, SetUserRole, SetPasswordHash and
+    // SetUserDisabled return ErrNotFound when the user does not exist.
+    LoginRecord(username string) (*models.LoginRecord, error)
+    GetUser(username string) (*models.User, error)
+    SetUserRole(username, role string) error
+    ListUsers(org string) ([]models.User, error)
+    SetPasswordHash(username, passwordHash string) error
+    SetUserDisabled(username string, disabled bool) error
+    // RecordLoginFailure counts a failed password login at the given time;
+    // ResetLoginFailures clears the count after a successful one.
+    RecordLoginFailure(username string, at time.Time) error
+    ResetLoginFailures(username string) error
+
+    // UserTOTP returns the user's TOTP enrollment, zero when there is none.
+    // UserTOTP and SetUserTOTP return ErrNotFound when the user does not
+    // exist.
+    UserTOTP(username string) (*models.TOTP, error)
+    // SetUserTOTP replaces the enrollment; a zero TOTP removes it.
+    SetUserTOTP(username string, totp models.TOTP) error
+    // UseTOTPStep records the time step of an accepted code and reports
+    // false when that step or a later one was already used.
+    UseTOTPStep(username string, step int64) (bool, error)
+    // UseRecoveryCode removes the recovery code hash and reports whether
+    // the user had it.
+    UseRecoveryCode(username, codeHash string) (bool, error)
+
+    // OrgExists reports whether any user belongs to the organization.
+    OrgExists(org string) (bool, error)
+    // OrgQuota returns ErrNotFound when no quota is set for the
+    // organization.
+    OrgQuota(org string) (*models.Quota, error)
+    SetOrgQuota(org string, quota models.Quota) error
+    // QuotaUsage sums up the tasks of the organization or, when owner is
+    // set, of that member, over the windows ending at now.
+    QuotaUsage(org, owner string, now time.Time) (*models.QuotaUsage, error)
+    // InsertTaskWithinQuota inserts the task like InsertTask, unless check
+    // rejects the usage of the task's organization and owner at
+    // task.Created. No other task of the organization is inserted this way
+    // in between, so concurrent submissions cannot overshoot a quota. It
+    // reports false, without checking the quota, when a task with the ID
+    // already exists.
+    InsertTaskWithinQuota(task models.Task, check func(org, user *models.QuotaUsage) error) (bool, error)
+
+    CreateRefreshToken(token models.RefreshToken) error
+    // UseRefreshToken marks the token used and returns it as it was before,
+    // so a token presented twice comes back with Used set. It returns
+    // ErrNotFound for unknown tokens.
+    UseRefreshToken(id string) (*models.RefreshToken, error)
+    RevokeSession(sessionID string) error
+    RevokeUserSessions(username string) error
+
+    CreateAPIKey(key models.APIKey) error
+    // GetAPIKey, SetAPIKeyExpiry and RevokeAPIKey return ErrNotFound when
+    // the key does not exist.
+    GetAPIKey(id string) (*models.APIKey, error)
+    ListAPIKeys(account string) ([]models.APIKey, error)
+    SetAPIKeyExpiry(id string, expires *time.Time) error
+    RevokeAPIKey(id string) error
+
+    // IdentityUser returns the local user linked to an external identity,
+    // or ErrNotFound when none is.
+    IdentityUser(issuer, subject string) (string, error)
+    LinkIdentity(issuer, subject, username string) error
+
+    // InsertAuditEvent appends to the audit log. Events are never updated
+    // or deleted.
+    InsertAuditEvent(event models.AuditEvent) error
+    // ListAuditEvents returns the events matching the filter, newest first.
+    ListAuditEvents(filter AuditFilter) ([]models.AuditEvent, error)
+}
+
+// ErrNotFound is returned by a Store when the requested record does not exist.
+var ErrNotFound = errors.New("not found")
+
+// DefaultOrg is the organization of users who register without naming one.
+// Data created before organizations existed belongs to it.
+const DefaultOrg = "default"
+
+type PostgresStore struct {
+    DB *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+    return &PostgresStore{DB: db}
+}
+
+// querier is what PostgresStore needs of a *sql.DB or *sql.Tx.
+type querier interface {
+    Exec(query string, args ...interface{}) (sql.Result, error)
+    QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func (s *PostgresStore) InsertTask(task models.Task) error {
+    _, err := insertTask(s.DB, task)
+    return err
+}
+
+// insertTask reports whether the task was inserted, which it is not when a
+// task with the ID already exists.
+func insertTask(q querier, task models.Task) (bool, error) {
     sqlStatement := `
-        INSERT INTO tasks (task_id, data, status, created, retries, priority)
-        VALUES ($1, $2, $3, $4, $5, $6)
+        INSERT INTO tasks (task_id, type, owner, org, data, status, created, retries, priority)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
         ON CONFLICT (task_id) DO NOTHING`
-    _, err := db.Exec(sqlStatement,
-        task.ID, task.Data, task.Status, task.Created,
+    result, err := q.Exec(sqlStatement,
+        task.ID, task.Type, task.Owner, task.Org, task.Data, task.Status, task.Created,
         task.Retries, task.Priority)
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+func (s *PostgresStore) InsertTaskWithinQuota(task models.Task, check func(org, user *models.QuotaUsage) error) (bool, error) {
+    tx, err := s.DB.Begin()
+    if err != nil {
+        return false, err
+    }
+    defer tx.Rollback()
+
+    // Submissions to the organization wait here until this one commits
+    if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", "quota:"+task.Org); err != nil {
+        return false, err
+    }
+    // A replayed submission is not a new task and must not count again
+    var exists bool
+    if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM tasks WHERE task_id = $1)", task.ID).Scan(&exists); err != nil {
+        return false, err
+    }
+    if exists {
+        return false, nil
+    }
+
+    orgUsage, err := quotaUsage(tx, task.Org, "", task.Created)
+    if err != nil {
+        return false, err
+    }
+    userUsage := &models.QuotaUsage{}
+    if task.Owner != "" {
+        if userUsage, err = quotaUsage(tx, task.Org, task.Owner, task.Created); err != nil {
+            return false, err
+        }
+    }
+    if err := check(orgUsage, userUsage); err != nil {
+        return false, err
+    }
+
+    inserted, err := insertTask(tx, task)
+    if err != nil {
+        return false, err
+    }
+    return inserted, tx.Commit()
+}
+
+func (s *PostgresStore) QuotaUsage(org, owner string, now time.Time) (*models.QuotaUsage, error) {
+    return quotaUsage(s.DB, org, owner, now)
+}
+
+func quotaUsage(q querier, org, owner string, now time.Time) (*models.QuotaUsage, error) {
+    query := `
+        SELECT
+            COUNT(*) FILTER (WHERE status = 'pending'),
+            COUNT(*) FILTER (WHERE created > $2),
+            COUNT(*) FILTER (WHERE created > $3),
+            COALESCE(SUM(OCTET_LENGTH(data)) FILTER (WHERE created > $4), 0)
+        FROM tasks
+        WHERE org = $1 AND (status = 'pending' OR created > $4)`
+    args := []interface{}{org, now.Add(-time.Minute), now.Add(-time.Hour), now.Add(-24 * time.Hour)}
+    if owner != "" {
+        query += " AND owner = $5"
+        args = append(args, owner)
+    }
+
+    var usage models.QuotaUsage
+    err := q.QueryRow(query, args...).
+        Scan(&usage.Queued, &usage.TasksLastMinute, &usage.TasksLastHour, &usage.PayloadBytesLastDay)
+    if err != nil {
+        return nil, err
+    }
+    return &usage, nil
+}
+
+func (s *PostgresStore) DeleteTask(taskID string) error {
+    _, err := s.DB.Exec("DELETE FROM tasks WHERE task_id = $1", taskID)
     return err
 }
 
-func UpdateTaskStatus(db *sql.DB, taskID, status string) error {
+func (s *PostgresStore) UpdateTaskStatus(taskID, status string) error {
     sqlStatement := `
         UPDATE tasks SET status = $1 WHERE task_id = $2`
-    _, err := db.Exec(sqlStatement, status, taskID)
+    _, err := s.DB.Exec(sqlStatement, status, taskID)
+    return err
+}
+
+func (s *PostgresStore) UpdateTaskRetries(taskID string, retries int) error {
+    sqlStatement := `
+        UPDATE tasks SET retries = $1 WHERE task_id = $2`
+    _, err := s.DB.Exec(sqlStatement, retries, taskID)
+    return err
+}
+
+func (s *PostgresStore) SetTaskDelivery(taskID, consumer, receipt string) error {
+    sqlStatement := `
+        UPDATE tasks SET delivery_consumer = $1, delivery_receipt = $2 WHERE task_id = $3`
+    _, err := s.DB.Exec(sqlStatement, consumer, receipt, taskID)
+    return err
+}
+
+func (s *PostgresStore) ClearTaskDelivery(taskID, consumer, receipt string) (bool, error) {
+    sqlStatement := `
+        UPDATE tasks SET delivery_consumer = '', delivery_receipt = ''
+        WHERE task_id = $1 AND delivery_consumer = $2 AND delivery_receipt = $3 AND delivery_consumer <> ''`
+    result, err := s.DB.Exec(sqlStatement, taskID, consumer, receipt)
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n == 1, err
+}
+
+func (s *PostgresStore) TransitionTaskStatus(taskID string, from []string, to string) (bool, error) {
+    sqlStatement := `
+        UPDATE tasks SET status = $1 WHERE task_id = $2 AND status = ANY($3)`
+    result, err := s.DB.Exec(sqlStatement, to, taskID, pq.Array(from))
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+// taskConditions translates the filter's constraints into SQL conditions,
+// appending their values to args through arg.
+func taskConditions(filter TaskFilter, arg func(value interface{}) string) []string {
+    var conditions []string
+    if filter.Status != "" {
+        conditions = append(conditions, "status = "+arg(filter.Status))
+    }
+    if filter.Type != "" {
+        conditions = append(conditions, "type = "+arg(filter.Type))
+    }
+    if filter.Owner != "" {
+        conditions = append(conditions, "owner = "+arg(filter.Owner))
+    }
+    if filter.Org != "" {
+        conditions = append(conditions, "org = "+arg(filter.Org))
+    }
+    if filter.Priority != 0 {
+        conditions = append(conditions, "priority = "+arg(filter.Priority))
+    }
+    if !filter.CreatedAfter.IsZero() {
+        conditions = append(conditions, "created > "+arg(filter.CreatedAfter))
+    }
+    if !filter.CreatedBefore.IsZero() {
+        conditions = append(conditions, "created < "+arg(filter.CreatedBefore))
+    }
+    return conditions
+}
+
+func (s *PostgresStore) ListTasks(filter TaskFilter) ([]models.Task, error) {
+    var args []interface{}
+    arg := func(value interface{}) string {
+        args = append(args, value)
+        return fmt.Sprintf("$%d", len(args))
+    }
+    conditions := taskConditions(filter, arg)
+
+    sortColumn, direction, comparison := "created", "ASC", ">"
+    if filter.Sort == SortPriority {
+        sortColumn = "priority"
+    }
+    if filter.Desc {
+        direction, comparison = "DESC", "<"
+    }
+
+    // Keyset pagination: continue strictly after the cursor position
+    if filter.After != nil {
+        var position interface{} = filter.After.Created
+        if filter.Sort == SortPriority {
+            position = filter.After.Priority
+        }
+        conditions = append(conditions, fmt.Sprintf("(%s, task_id) %s (%s, %s)",
+            sortColumn, comparison, arg(position), arg(filter.After.ID)))
+    }
+
+    query := "SELECT task_id, type, owner, org, data, status, created, retries, priority FROM tasks"
+    if len(conditions) > 0 {
+        query += " WHERE " + strings.Join(conditions, " AND ")
+    }
+    query += fmt.Sprintf(" ORDER BY %s %s, task_id %s", sortColumn, direction, direction)
+    if filter.Limit > 0 {
+        query += " LIMIT " + arg(filter.Limit)
+    }
+
+    rows, err := s.DB.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var tasks []models.Task
+    for rows.Next() {
+        var task models.Task
+        err := rows.Scan(&task.ID, &task.Type, &task.Owner, &task.Org, &task.Data, &task.Status, &task.Created, &task.Retries, &task.Priority)
+        if err != nil {
+            return nil, err
+        }
+        tasks = append(tasks, task)
+    }
+    return tasks, rows.Err()
+}
+
+func (s *PostgresStore) CountTasks(filter TaskFilter) (int, error) {
+    var args []interface{}
+    arg := func(value interface{}) string {
+        args = append(args, value)
+        return fmt.Sprintf("$%d", len(args))
+    }
+    conditions := taskConditions(filter, arg)
+
+    query := "SELECT COUNT(*) FROM tasks"
+    if len(conditions) > 0 {
+        query += " WHERE " + strings.Join(conditions, " AND ")
+    }
+    var count int
+    err := s.DB.QueryRow(query, args...).Scan(&count)
+    return count, err
+}
+
+func (s *PostgresStore) GetTask(taskID string) (*models.Task, error) {
+    var task models.Task
+    err := s.DB.QueryRow("SELECT task_id, type, owner, org, data, status, created, retries, priority FROM tasks WHERE task_id = $1", taskID).
+        Scan(&task.ID, &task.Type, &task.Owner, &task.Org, &task.Data, &task.Status, &task.Created, &task.Retries, &task.Priority)
+    if err == sql.ErrNoRows {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &task, nil
+}
+
+func (s *PostgresStore) UserExists(username string) (bool, error) {
+    var exists bool
+    err := s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username=$1)", username).Scan(&exists)
+    return exists, err
+}
+
+func (s *PostgresStore) CreateUser(user models.User, passwordHash string) error {
+    _, err := s.DB.Exec("INSERT INTO users (username, password_hash, role, org) VALUES ($1, $2, $3, $4)",
+        user.Username, passwordHash, user.Role, user.Org)
     return err
 }
+
+func (s *PostgresStore) LoginRecord(username string) (*models.LoginRecord, error) {
+    var record models.LoginRecord
+    var lastFailed sql.NullTime
+    err := s.DB.QueryRow("SELECT password_hash, failed_logins, last_failed_login, disabled, totp_enabled FROM users WHERE username=$1", username).
+        Scan(&record.PasswordHash, &record.FailedLogins, &lastFailed, &record.Disabled, &record.TOTPEnabled)
+    if err == sql.ErrNoRows {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    record.LastFailedLogin = lastFailed.Time
+    return &record, nil
+}
+
+func (s *PostgresStore) GetUser(username string) (*models.User, error) {
+    var user models.User
+    err := s.DB.QueryRow("SELECT username, role, org, disabled, totp_enabled FROM users WHERE username=$1", username).
+        Scan(&user.Username, &user.Role, &user.Org, &user.Disabled, &user.TOTPEnabled)
+    if err == sql.ErrNoRows {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &user, nil
+}
+
+func (s *PostgresStore) SetUserRole(username, role string) error {
+    return s.updateOne("UPDATE users SET role = $2 WHERE username = $1", username, role)
+}
+
+func (s *PostgresStore) SetPasswordHash(username, passwordHash string) error {
+    // A new password also lifts any lockout
+    return s.updateOne("UPDATE users SET password_hash = $2, failed_logins = 0 WHERE username = $1", username, passwordHash)
+}
+
+func (s *PostgresStore) SetUserDisabled(username string, disabled bool) error {
+    return s.updateOne("UPDATE users SET disabled = $2 WHERE username = $1", username, disabled)
+}
+
+func (s *PostgresStore) RecordLoginFailure(username string, at time.Time) error {
+    _, err := s.DB.Exec("UPDATE users SET failed_logins = failed_logins + 1, last_failed_login = $2 WHERE username = $1", username, at)
+    return err
+}
+
+func (s *PostgresStore) ResetLoginFailures(username string) error {
+    _, err := s.DB.Exec("UPDATE users SET failed_logins = 0 WHERE username = $1", username)
+    return err
+}
+
+func (s *PostgresStore) UserTOTP(username string) (*models.TOTP, error) {
+    var totp models.TOTP
+    err := s.DB.QueryRow("SELECT totp_secret, totp_enabled, recovery_codes, totp_last_step FROM users WHERE username=$1", username).
+        Scan(&totp.Secret, &totp.Enabled, pq.Array(&totp.RecoveryCodes), &totp.LastStep)
+    if err == sql.ErrNoRows {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &totp, nil
+}
+
+func (s *PostgresStore) SetUserTOTP(username string, totp models.TOTP) error {
+    sqlStatement := `
+        UPDATE users SET totp_secret = $2, totp_enabled = $3, recovery_codes = $4, totp_last_step = $5
+        WHERE username = $1`
+    return s.updateOne(sqlStatement, username, totp.Secret, totp.Enabled, pq.Array(totp.RecoveryCodes), totp.LastStep)
+}
+
+func (s *PostgresStore) UseTOTPStep(username string, step int64) (bool, error) {
+    result, err := s.DB.Exec("UPDATE users SET totp_last_step = $2 WHERE username = $1 AND totp_last_step < $2", username, step)
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+func (s *PostgresStore) UseRecoveryCode(username, codeHash string) (bool, error) {
+    sqlStatement := `
+        UPDATE users SET recovery_codes = array_remove(recovery_codes, $2)
+        WHERE username = $1 AND $2 = ANY(recovery_codes)`
+    result, err := s.DB.Exec(sqlStatement, username, codeHash)
+    if err != nil {
+        return false, err
+    }
+    n, err := result.RowsAffected()
+    return n > 0, err
+}
+
+// updateOne runs an UPDATE of a single row, returning ErrNotFound when no
+// row matched.
+func (s *PostgresStore) updateOne(sqlStatement string, args ...interface{}) error {
+    result, err := s.DB.Exec(sqlStatement, args...)
+    if err != nil {
+        return err
+    }
+    if n, err := result.RowsAffected(); err != nil {
+        return err
+    } else if n == 0 {
+        return ErrNotFound
+    }
+    return nil
+}
+
+func (s *PostgresStore) ListUsers(org string) ([]models.User, error) {
+    rows, err := s.DB.Query("SELECT username, role, org, disabled, totp_enabled FROM users WHERE org = $1 ORDER BY username", org)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var users []models.User
+    for rows.Next() {
+        var user models.User
+        if err := rows.Scan(&user.Username, &user.Role, &user.Org, &user.Disabled, &user.TOTPEnabled); err != nil {
+            return nil, err
+        }
+        users = append(users, user)
+    }
+    return users, rows.Err()
+}
+
+func (s *PostgresStore) OrgExists(org string) (bool, error) {
+    var exists bool
+    err := s.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE org=$1)", org).Scan(&exists)
+    return exists, err
+}
+
+func (s *PostgresStore) OrgQuota(org string) (*models.Quota, error) {
+    var quota models.Quota
+    sqlStatement := `
+        SELECT max_queued, max_tasks_per_minute, max_tasks_per_hour, max_payload_bytes_per_day,
+            user_max_queued, user_max_tasks_per_hour, user_max_payload_bytes_per_day
+        FROM org_quotas WHERE org=$1`
+    err := s.DB.QueryRow(sqlStatement, org).Scan(
+        &quota.MaxQueued, &quota.MaxTasksPerMinute, &quota.MaxTasksPerHour, &quota.MaxPayloadBytesPerDay,
+        &quota.User.MaxQueued, &quota.User.MaxTasksPerHour, &quota.User.MaxPayloadBytesPerDay)
+    if err == sql.ErrNoRows {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &quota, nil
+}
+
+func (s *PostgresStore) SetOrgQuota(org string, quota models.Quota) error {
+    sqlStatement := `
+        INSERT INTO org_quotas (org, max_queued, max_tasks_per_minute, max_tasks_per_hour,
+            max_payload_bytes_per_day, user_max_queued, user_max_tasks_per_hour,
+            user_max_payload_bytes_per_day)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+        ON CONFLICT (org) DO UPDATE SET max_queued = $2, max_tasks_per_minute = $3,
+            max_tasks_per_hour = $4, max_payload_bytes_per_day = $5, user_max_queued = $6,
+            user_max_tasks_per_hour = $7, user_max_payload_bytes_per_day = $8`
+    _, err := s.DB.Exec(sqlStatement, org, quota.MaxQueued, quota.MaxTasksPerMinute,
+        quota.MaxTasksPerHour, quota.MaxPayloadBytesPerDay, quota.User.MaxQueued,
+        quota.User.MaxTasksPerHour, quota.User.MaxPayloadBytesPerDay)
+    return err
+}
+
+func (s *PostgresStore) CreateRefreshToken(token models.RefreshToken) error {
+    sqlStatement := `
+        INSERT INTO refresh_tokens (id, session_id, username, expires)
+        VALUES ($1, $2, $3, $4)`
+    _, err := s.DB.Exec(sqlStatement, token.ID, token.SessionID, token.Username, token.Expires)
+    return err
+}
+
+func (s *PostgresStore) UseRefreshToken(id string) (*models.RefreshToken, error) {
+    // The row lock makes concurrent uses of one token see each other
+    sqlStatement := `
+        UPDATE refresh_tokens t SET used = TRUE
+        FROM (SELECT id, used FROM refresh_tokens WHERE id = $1 FOR UPDATE) old
+        WHERE t.id = old.id
+        RETURNING t.id, t.session_id, t.username, t.expires, old.used, t.revoked`
+    var token models.RefreshToken
+    err := s.DB.QueryRow(sqlStatement, id).
+        Scan(&token.ID, &token.SessionID, &token.Username, &token.Expires, &token.Used, &token.Revoked)
+    if err == sql.ErrNoRows {
+        return nil, ErrNotFound
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &token, nil
+}
+
+func (s *PostgresStore) RevokeSession(sessionID string) error {
+    _, err := s.DB.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE session_id = $1", sessionID)
+    return err
+}
+
+func (s *PostgresStore) RevokeUserSessions(username string) error {
+    _, err := s.DB.Exec("UPDATE refresh_tokens SET revoked = TRUE WHERE username = $1", username)
+    return err
+}
+
+func (s *PostgresStore) CreateAPIKey(key models.APIKey) error {
+    sqlStatement := `
+        INSERT INTO api_keys (id, account, org, scopes, hash, created, expires)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)`
+    _, err := s.DB.Exec(sqlStatement, key.ID, key.Account, key.Org, pq.Array(key.Scopes), key.Hash, key.Created, key.Expires)
+    return err
+}
+
+func (s *PostgresStore) GetAPIKey(id string) (*models.APIKey, error) {
+    row := s.DB.QueryRow("SELECT id, account, org, scopes, hash, created, expires, revoked FROM api_keys WHERE id = $1", id)
+    key, err := scanAPIKey(row)
+    if err == sql.ErrNoRows {
+        return nil, ErrNotFound
+    }
+    return key, err
+}
+
+func (s *PostgresStore) ListAPIKeys(account string) ([]models.APIKey, error) {
+    rows, err := s.DB.Query("SELECT id, account, org, scopes, hash, created, expires, revoked FROM api_keys WHERE account = $1 ORDER BY created, id", account)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var keys []models.APIKey
+    for rows.Next() {
+        key, err := scanAPIKey(rows)
+        if err != nil {
+            return nil, err
+        }
+        keys = append(keys, *key)
+    }
+    return keys, rows.Err()
+}
+
+func (s *PostgresStore) SetAPIKeyExpiry(id string, expires *time.Time) error {
+    return s.updateOne("UPDATE api_keys SET expires = $2 WHERE id = $1", id, expires)
+}
+
+func (s *PostgresStore) RevokeAPIKey(id string) error {
+    return s.updateOne("UPDATE api_keys SET revoked = TRUE WHERE id = $1", id)
+}
+
+func scanAPIKey(row interface{ Scan(...interface{}) error }) (*models.APIKey, error) {
+    var key models.APIKey
+    var expires sql.NullTime
+    err := row.Scan(&key.ID, &key.Account, &key.Org, pq.Array(&key.Scopes), &key.Hash, &key.Created, &expires, &key.Revoked)
+    if err != nil {
+        return nil, err
+    }
+    if expires.Valid {
+        key.Expires = &expires.Time
+    }
+    return &key, nil
+}
+
+func (s *PostgresStore) IdentityUser(issuer, subject string) (string, error) {
+    var username string
+    err := s.DB.QueryRow("SELECT username FROM user_identities WHERE issuer = $1 AND subject = $2", issuer, subject).
+        Scan(&username)
+    if err == sql.ErrNoRows {
+        return "", ErrNotFound
+    }
+    return username, err
+}
+
+func (s *PostgresStore) LinkIdentity(issuer, subject, username string) error {
+    _, err := s.DB.Exec("INSERT INTO user_identities (issuer, subject, username) VALUES ($1, $2, $3)",
+        issuer, subject, username)
+    return err
+}
+
+func (s *PostgresStore) InsertAuditEvent(event models.AuditEvent) error {
+    sqlStatement := `
+        INSERT INTO audit_log (id, time, actor, org, action, target, ip, user_agent, result, status)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
+    _, err := s.DB.Exec(sqlStatement, event.ID, event.Time, event.Actor, event.Org, event.Action,
+        event.Target, event.IP, event.UserAgent, event.Result, event.Status)
+    return err
+}
+
+func (s *PostgresStore) ListAuditEvents(filter AuditFilter) ([]models.AuditEvent, error) {
+    var args []interface{}
+    arg := func(value interface{}) string {
+        args = append(args, value)
+        return fmt.Sprintf("$%d", len(args))
+    }
+
+    var conditions []string
+    if filter.Org != "" {
+        conditions = append(conditions, "org = "+arg(filter.Org))
+    }
+    if filter.Actor != "" {
+        conditions = append(conditions, "actor = "+arg(filter.Actor))
+    }
+    if filter.Action != "" {
+        conditions = append(conditions, "action = "+arg(filter.Action))
+    }
+    if filter.Result != "" {
+        conditions = append(conditions, "result = "+arg(filter.Result))
+    }
+    if !filter.Since.IsZero() {
+        conditions = append(conditions, "time >= "+arg(filter.Since))
+    }
+    if !filter.Until.IsZero() {
+        conditions = append(conditions, "time < "+arg(filter.Until))
+    }
+    if filter.Before != nil {
+        conditions = append(conditions, fmt.Sprintf("(time, id) < (%s, %s)", arg(filter.Before.Time), arg(filter.Before.ID)))
+    }
+
+    query := "SELECT id, time, actor, org, action, target, ip, user_agent, result, status FROM audit_log"
+    if len(conditions) > 0 {
+        query += " WHERE " + strings.Join(conditions, " AND ")
+    }
+    query += " ORDER BY time DESC, id DESC"
+    if filter.Limit > 0 {
+        query += " LIMIT " + arg(filter.Limit)
+    }
+
+    rows, err := s.DB.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var events []models.AuditEvent
+    for rows.Next() {
+        var event models.AuditEvent
+        err := rows.Scan(&event.ID, &event.Time, &event.Actor, &event.Org, &event.Action, &event.Target,
+            &event.IP, &event.UserAgent, &event.Result, &event.Status)
+        if err != nil {
+            return nil, err
+        }
+        events = append(events, event)
+    }
+    return events, rows.Err()
+}
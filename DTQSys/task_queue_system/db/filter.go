@@ -0,0 +1,155 @@
+package db
+
+import (
+    "task_queue_system/models"
+    "time"
+)
+
+// Sort keys accepted by TaskFilter.Sort.
+const (
+    SortCreated  = "created"
+    SortPriority = "priority"
+)
+
+// TaskFilter selects one page of tasks. Zero values mean "no constraint".
+type TaskFilter struct {
+    Status        string
+    Type          string
+    Owner         string
+    Org           string
+    Priority      int
+    CreatedAfter  time.Time
+    CreatedBefore time.Time
+
+    // Sort is SortCreated or SortPriority; ties are broken by task ID in the
+    // same direction, which keeps keyset pagination stable.
+    Sort string
+    Desc bool
+
+    // After continues the listing after the given position.
+    After *TaskCursor
+    Limit int
+}
+
+// TaskCursor is the keyset position of the last task on a page.
+type TaskCursor struct {
+    Created  time.Time `json:"created,omitempty"`
+    Priority int       `json:"priority,omitempty"`
+    ID       string    `json:"id"`
+}
+
+// CursorFor returns the position of task under the filter's sort order.
+func (f TaskFilter) CursorFor(task models.Task) TaskCursor {
+    if f.Sort == SortPriority {
+        return TaskCursor{Priority: task.Priority, ID: task.ID}
+    }
+    return TaskCursor{Created: task.Created, ID: task.ID}
+}
+
+// matches reports whether a task passes the filter's constraints, not
+// counting the cursor.
+func (f TaskFilter) matches(task *models.Task) bool {
+    if f.Status != "" && task.Status != f.Status {
+        return false
+    }
+    if f.Type != "" && task.Type != f.Type {
+        return false
+    }
+    if f.Owner != "" && task.Owner != f.Owner {
+        return false
+    }
+    if f.Org != "" && task.Org != f.Org {
+        return false
+    }
+    if f.Priority != 0 && task.Priority != f.Priority {
+        return false
+    }
+    if !f.CreatedAfter.IsZero() && !task.Created.After(f.CreatedAfter) {
+        return false
+    }
+    if !f.CreatedBefore.IsZero() && !task.Created.Before(f.CreatedBefore) {
+        return false
+    }
+    return true
+}
+
+// compare orders a task against a cursor position in ascending sort order.
+func (f TaskFilter) compare(task *models.Task, cursor TaskCursor) int {
+    if f.Sort == SortPriority {
+        if task.Priority != cursor.Priority {
+            if task.Priority < cursor.Priority {
+                return -1
+            }
+            return 1
+        }
+    } else if !task.Created.Equal(cursor.Created) {
+        if task.Created.Before(cursor.Created) {
+            return -1
+        }
+        return 1
+    }
+
+    switch {
+    case task.ID < cursor.ID:
+        return -1
+    case task.ID > cursor.ID:
+        return 1
+    }
+    return 0
+}
+
+// AuditFilter selects audit events, newest first. Zero values mean "no
+// constraint".
+type AuditFilter struct {
+    Org    string
+    Actor  string
+    Action string
+    Result string
+    Since  time.Time
+    Until  time.Time
+
+    // Before continues the listing after the given position.
+    Before *AuditCursor
+    Limit  int
+}
+
+// AuditCursor is the keyset position of the last event on a page.
+type AuditCursor struct {
+    Time time.Time `json:"time"`
+    ID   string    `json:"id"`
+}
+
+// matches reports whether an event passes the filter, cursor included.
+func (f AuditFilter) matches(event *models.AuditEvent) bool {
+    if f.Org != "" && event.Org != f.Org {
+        return false
+    }
+    if f.Actor != "" && event.Actor != f.Actor {
+        return false
+    }
+    if f.Action != "" && event.Action != f.Action {
+        return false
+    }
+    if f.Result != "" && event.Result != f.Result {
+        return false
+    }
+    if !f.Since.IsZero() && event.Time.Before(f.Since) {
+        return false
+    }
+    if !f.Until.IsZero() && !event.Time.Before(f.Until) {
+        return false
+    }
+    if f.Before != nil && !auditBefore(event, *f.Before) {
+        return false
+    }
+    return true
+}
+
+// auditBefore reports whether the event comes after the cursor in newest
+// first order.
+func auditBefore(event *models.AuditEvent, cursor AuditCursor) bool {
+    if !event.Time.Equal(cursor.Time) {
+        return event.Time.Before(cursor.Time)
+    }
+    return event.ID < cursor.ID
+}
@@ -0,0 +1,623 @@
+package db
+
+import (
+    "errors"
+    "sort"
+    "sync"
+    "task_queue_system/models"
+    "time"
+)
+
+// MemoryStore is an in-process Store with the same semantics as
+// PostgresStore, for tests and embedded use.
+type MemoryStore struct {
+    mu     sync.Mutex
+    tasks  map[string]*models.Task
+    order  []string
+    // deliveries maps a task ID to its recorded consumer and receipt.
+    deliveries map[string][2]string
+    users  map[string]*memoryUser
+    quotas map[string]models.Quota
+    tokens map[string]*models.RefreshToken
+    keys   map[string]*models.APIKey
+    // identities maps issuer and subject, joined by a NUL, to a username.
+    identities map[string]string
+    audit      []models.AuditEvent
+}
+
+// memoryUser mirrors a row of the users table.
+type memoryUser struct {
+    models.User
+    passwordHash    string
+    failedLogins    int
+    lastFailedLogin time.Time
+    totp            models.TOTP
+}
+
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{
+        tasks:      make(map[string]*models.Task),
+        deliveries: make(map[string][2]string),
+        users:      make(map[string]*memoryUser),
+        quotas:     make(map[string]models.Quota),
+        tokens:     make(map[string]*models.RefreshToken),
+        keys:       make(map[string]*models.APIKey),
+        identities: make(map[string]string),
+    }
+}
+
+func (s *MemoryStore) InsertTask(task models.Task) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.insertTask(task)
+    return nil
+}
+
+// insertTask adds the task. Callers hold s.mu.
+func (s *MemoryStore) insertTask(task models.Task) {
+    // Like ON CONFLICT DO NOTHING, a re-enqueued task keeps its first row
+    if _, exists := s.tasks[task.ID]; exists {
+        return
+    }
+    task.Receipt = ""
+    s.tasks[task.ID] = &task
+    s.order = append(s.order, task.ID)
+}
+
+func (s *MemoryStore) InsertTaskWithinQuota(task models.Task, check func(org, user *models.QuotaUsage) error) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, exists := s.tasks[task.ID]; exists {
+        return false, nil
+    }
+    userUsage := &models.QuotaUsage{}
+    if task.Owner != "" {
+        userUsage = s.quotaUsage(task.Org, task.Owner, task.Created)
+    }
+    if err := check(s.quotaUsage(task.Org, "", task.Created), userUsage); err != nil {
+        return false, err
+    }
+    s.insertTask(task)
+    return true, nil
+}
+
+func (s *MemoryStore) QuotaUsage(org, owner string, now time.Time) (*models.QuotaUsage, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    return s.quotaUsage(org, owner, now), nil
+}
+
+// quotaUsage sums up tasks like PostgresStore.QuotaUsage. Callers hold s.mu.
+func (s *MemoryStore) quotaUsage(org, owner string, now time.Time) *models.QuotaUsage {
+    usage := &models.QuotaUsage{}
+    for _, task := range s.tasks {
+        if task.Org != org || (owner != "" && task.Owner != owner) {
+            continue
+        }
+        if task.Status == "pending" {
+            usage.Queued++
+        }
+        if task.Created.After(now.Add(-time.Minute)) {
+            usage.TasksLastMinute++
+        }
+        if task.Created.After(now.Add(-time.Hour)) {
+            usage.TasksLastHour++
+        }
+        if task.Created.After(now.Add(-24 * time.Hour)) {
+            usage.PayloadBytesLastDay += int64(len(task.Data))
+        }
+    }
+    return usage
+}
+
+func (s *MemoryStore) DeleteTask(taskID string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, exists := s.tasks[taskID]; !exists {
+        return nil
+    }
+    delete(s.tasks, taskID)
+    delete(s.deliveries, taskID)
+    for i, id := range s.order {
+        if id == taskID {
+            s.order = append(s.order[:i], s.order[i+1:]...)
+            break
+        }
+    }
+    return nil
+}
+
+func (s *MemoryStore) UpdateTaskStatus(taskID, status string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if task, exists := s.tasks[taskID]; exists {
+        task.Status = status
+    }
+    return nil
+}
+
+func (s *MemoryStore) UpdateTaskRetries(taskID string, retries int) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if task, exists := s.tasks[taskID]; exists {
+        task.Retries = retries
+    }
+    return nil
+}
+
+func (s *MemoryStore) SetTaskDelivery(taskID, consumer, receipt string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, exists := s.tasks[taskID]; exists {
+        s.deliveries[taskID] = [2]string{consumer, receipt}
+    }
+    return nil
+}
+
+func (s *MemoryStore) ClearTaskDelivery(taskID, consumer, receipt string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    delivery, exists := s.deliveries[taskID]
+    if !exists || delivery[0] == "" || delivery != [2]string{consumer, receipt} {
+        return false, nil
+    }
+    delete(s.deliveries, taskID)
+    return true, nil
+}
+
+func (s *MemoryStore) TransitionTaskStatus(taskID string, from []string, to string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    task, exists := s.tasks[taskID]
+    if !exists {
+        return false, nil
+    }
+    for _, status := range from {
+        if task.Status == status {
+            task.Status = to
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+func (s *MemoryStore) ListTasks(filter TaskFilter) ([]models.Task, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var tasks []models.Task
+    for _, id := range s.order {
+        task := s.tasks[id]
+        if !filter.matches(task) {
+            continue
+        }
+        if filter.After != nil {
+            c := filter.compare(task, *filter.After)
+            if (!filter.Desc && c <= 0) || (filter.Desc && c >= 0) {
+                continue
+            }
+        }
+        tasks = append(tasks, *task)
+    }
+
+    sort.Slice(tasks, func(i, j int) bool {
+        c := filter.compare(&tasks[i], filter.CursorFor(tasks[j]))
+        if filter.Desc {
+            return c > 0
+        }
+        return c < 0
+    })
+    if filter.Limit > 0 && len(tasks) > filter.Limit {
+        tasks = tasks[:filter.Limit]
+    }
+    return tasks, nil
+}
+
+func (s *MemoryStore) GetTask(taskID string) (*models.Task, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    task, exists := s.tasks[taskID]
+    if !exists {
+        return nil, ErrNotFound
+    }
+    copied := *task
+    return &copied, nil
+}
+
+func (s *MemoryStore) CountTasks(filter TaskFilter) (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    count := 0
+    for _, task := range s.tasks {
+        if filter.matches(task) {
+            count++
+        }
+    }
+    return count, nil
+}
+
+func (s *MemoryStore) UserExists(username string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    _, exists := s.users[username]
+    return exists, nil
+}
+
+func (s *MemoryStore) CreateUser(user models.User, passwordHash string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, exists := s.users[user.Username]; exists {
+        return errors.New("duplicate username")
+    }
+    s.users[user.Username] = &memoryUser{User: user, passwordHash: passwordHash}
+    return nil
+}
+
+func (s *MemoryStore) LoginRecord(username string) (*models.LoginRecord, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    user, exists := s.users[username]
+    if !exists {
+        return nil, ErrNotFound
+    }
+    return &models.LoginRecord{
+        PasswordHash:    user.passwordHash,
+        FailedLogins:    user.failedLogins,
+        LastFailedLogin: user.lastFailedLogin,
+        Disabled:        user.Disabled,
+        TOTPEnabled:     user.TOTPEnabled,
+    }, nil
+}
+
+func (s *MemoryStore) GetUser(username string) (*models.User, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    user, exists := s.users[username]
+    if !exists {
+        return nil, ErrNotFound
+    }
+    copied := user.User
+    return &copied, nil
+}
+
+func (s *MemoryStore) SetUserRole(username, role string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    user, exists := s.users[username]
+    if !exists {
+        return ErrNotFound
+    }
+    user.Role = role
+    return nil
+}
+
+func (s *MemoryStore) SetPasswordHash(username, passwordHash string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    user, exists := s.users[username]
+    if !exists {
+        return ErrNotFound
+    }
+    user.passwordHash = passwordHash
+    user.failedLogins = 0
+    return nil
+}
+
+func (s *MemoryStore) SetUserDisabled(username string, disabled bool) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    user, exists := s.users[username]
+    if !exists {
+        return ErrNotFound
+    }
+    user.Disabled = disabled
+    return nil
+}
+
+func (s *MemoryStore) RecordLoginFailure(username string, at time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if user, exists := s.users[username]; exists {
+        user.failedLogins++
+        user.lastFailedLogin = at
+    }
+    return nil
+}
+
+func (s *MemoryStore) ResetLoginFailures(username string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if user, exists := s.users[username]; exists {
+        user.failedLogins = 0
+    }
+    return nil
+}
+
+func (s *MemoryStore) UserTOTP(username string) (*models.TOTP, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    user, exists := s.users[username]
+    if !exists {
+        return nil, ErrNotFound
+    }
+    copied := user.totp
+    copied.RecoveryCodes = append([]string(nil), user.totp.RecoveryCodes...)
+    return &copied, nil
+}
+
+func (s *MemoryStore) SetUserTOTP(username string, totp models.TOTP) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    user, exists := s.users[username]
+    if !exists {
+        return ErrNotFound
+    }
+    totp.RecoveryCodes = append([]string(nil), totp.RecoveryCodes...)
+    user.totp = totp
+    user.TOTPEnabled = totp.Enabled
+    return nil
+}
+
+func (s *MemoryStore) UseTOTPStep(username string, step int64) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    user, exists := s.users[username]
+    if !exists || user.totp.LastStep >= step {
+        return false, nil
+    }
+    user.totp.LastStep = step
+    return true, nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(username, codeHash string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    user, exists := s.users[username]
+    if !exists {
+        return false, nil
+    }
+    for i, hash := range user.totp.RecoveryCodes {
+        if hash == codeHash {
+            codes := user.totp.RecoveryCodes
+            user.totp.RecoveryCodes = append(codes[:i:i], codes[i+1:]...)
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+func (s *MemoryStore) ListUsers(org string) ([]models.User, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var users []models.User
+    for _, user := range s.users {
+        if user.Org == org {
+            users = append(users, user.User)
+        }
+    }
+    sort.Slice(users, func(i, j int) bool {
+        return users[i].Username < users[j].Username
+    })
+    return users, nil
+}
+
+func (s *MemoryStore) OrgExists(org string) (bool, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for _, user := range s.users {
+        if user.Org == org {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+func (s *MemoryStore) OrgQuota(org string) (*models.Quota, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    quota, exists := s.quotas[org]
+    if !exists {
+        return nil, ErrNotFound
+    }
+    return &quota, nil
+}
+
+func (s *MemoryStore) SetOrgQuota(org string, quota models.Quota) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.quotas[org] = quota
+    return nil
+}
+
+func (s *MemoryStore) CreateRefreshToken(token models.RefreshToken) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, exists := s.tokens[token.ID]; exists {
+        return errors.New("duplicate refresh token")
+    }
+    s.tokens[token.ID] = &token
+    return nil
+}
+
+func (s *MemoryStore) UseRefreshToken(id string) (*models.RefreshToken, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    token, exists := s.tokens[id]
+    if !exists {
+        return nil, ErrNotFound
+    }
+    before := *token
+    token.Used = true
+    return &before, nil
+}
+
+func (s *MemoryStore) RevokeSession(sessionID string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for _, token := range s.tokens {
+        if token.SessionID == sessionID {
+            token.Revoked = true
+        }
+    }
+    return nil
+}
+
+func (s *MemoryStore) RevokeUserSessions(username string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for _, token := range s.tokens {
+        if token.Username == username {
+            token.Revoked = true
+        }
+    }
+    return nil
+}
+
+func (s *MemoryStore) CreateAPIKey(key models.APIKey) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, exists := s.keys[key.ID]; exists {
+        return errors.New("duplicate API key")
+    }
+    key.Scopes = append([]string(nil), key.Scopes...)
+    s.keys[key.ID] = &key
+    return nil
+}
+
+func (s *MemoryStore) GetAPIKey(id string) (*models.APIKey, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    key, exists := s.keys[id]
+    if !exists {
+        return nil, ErrNotFound
+    }
+    copied := *key
+    return &copied, nil
+}
+
+func (s *MemoryStore) ListAPIKeys(account string) ([]models.APIKey, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var keys []models.APIKey
+    for _, key := range s.keys {
+        if key.Account == account {
+            keys = append(keys, *key)
+        }
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        if !keys[i].Created.Equal(keys[j].Created) {
+            return keys[i].Created.Before(keys[j].Created)
+        }
+        return keys[i].ID < keys[j].ID
+    })
+    return keys, nil
+}
+
+func (s *MemoryStore) SetAPIKeyExpiry(id string, expires *time.Time) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    key, exists := s.keys[id]
+    if !exists {
+        return ErrNotFound
+    }
+    key.Expires = expires
+    return nil
+}
+
+func (s *MemoryStore) RevokeAPIKey(id string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    key, exists := s.keys[id]
+    if !exists {
+        return ErrNotFound
+    }
+    key.Revoked = true
+    return nil
+}
+
+func (s *MemoryStore) IdentityUser(issuer, subject string) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    username, exists := s.identities[issuer+"\x00"+subject]
+    if !exists {
+        return "", ErrNotFound
+    }
+    return username, nil
+}
+
+func (s *MemoryStore) LinkIdentity(issuer, subject, username string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    key := issuer + "\x00" + subject
+    if _, exists := s.identities[key]; exists {
+        return errors.New("duplicate identity")
+    }
+    s.identities[key] = username
+    return nil
+}
+
+func (s *MemoryStore) InsertAuditEvent(event models.AuditEvent) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.audit = append(s.audit, event)
+    return nil
+}
+
+func (s *MemoryStore) ListAuditEvents(filter AuditFilter) ([]models.AuditEvent, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    var events []models.AuditEvent
+    for i := range s.audit {
+        if filter.matches(&s.audit[i]) {
+            events = append(events, s.audit[i])
+        }
+    }
+    sort.Slice(events, func(i, j int) bool {
+        return auditBefore(&events[j], AuditCursor{Time: events[i].Time, ID: events[i].ID})
+    })
+    if filter.Limit > 0 && len(events) > filter.Limit {
+        events = events[:filter.Limit]
+    }
+    return events, nil
+}
@@ -0,0 +1,79 @@
+package dtq
+
+import (
+    "context"
+    "task_queue_system/models"
+    "task_queue_system/queue"
+
+    "github.com/go-playground/validator/v10"
+)
+
+var validate = validator.New()
+
+// Client submits tasks straight to the queue backend.
+type Client struct {
+    queue *queue.Queue
+    org   string
+    err   error
+}
+
+func NewClient(cfg Config) *Client {
+    q, err := cfg.queue()
+    return &Client{queue: q, org: cfg.org(), err: err}
+}
+
+// Option adjusts a task before it is enqueued.
+type Option func(*models.Task)
+
+func WithPriority(priority int) Option {
+    return func(task *models.Task) {
+        task.Priority = priority
+    }
+}
+
+func WithType(taskType string) Option {
+    return func(task *models.Task) {
+        task.Type = taskType
+    }
+}
+
+// WithOwner records the user the task is submitted on behalf of, which
+// decides who can see it through the API.
+func WithOwner(username string) Option {
+    return func(task *models.Task) {
+        task.Owner = username
+    }
+}
+
+// WithID sets the task ID instead of generating one. Enqueueing the same ID
+// twice stores and delivers the task once; the second Enqueue returns the
+// stored task, or queue.ErrTaskIDTaken if another organization has the ID.
+func WithID(id string) Option {
+    return func(task *models.Task) {
+        task.ID = id
+    }
+}
+
+// Enqueue validates the task exactly like POST /tasks and submits it. The
+// returned task carries the assigned ID and status.
+func (c *Client) Enqueue(ctx context.Context, task Task, opts ...Option) (Task, error) {
+    if c.err != nil {
+        return Task{}, c.err
+    }
+
+    task.Org = c.org
+    for _, opt := range opts {
+        opt(&task)
+    }
+
+    // Priority defaults to low, as in the API
+    if task.Priority == 0 {
+        task.Priority = 1
+    }
+    if err := validate.Struct(task); err != nil {
+        return Task{}, err
+    }
+
+    task, _, err := c.queue.Submit(ctx, task)
+    return task, err
+}
@@ -0,0 +1,58 @@
+// Package dtq is the Go API for embedding producers and workers directly in
+// other services, without going through the HTTPS API.
+//
+//     client := dtq.NewClient(cfg)
+//     task, err := client.Enqueue(ctx, dtq.Task{Type: "email", Data: body}, dtq.WithPriority(3))
+//
+//     server := dtq.NewWorkerServer(cfg)
+//     server.HandleFunc("email", sendEmail)
+//     err := server.Run(ctx)
+package dtq
+
+import (
+    "errors"
+    "task_queue_system/db"
+    "task_queue_system/models"
+    "task_queue_system/queue"
+    "task_queue_system/workers"
+)
+
+type (
+    Task        = models.Task
+    Handler     = workers.Handler
+    HandlerFunc = workers.HandlerFunc
+)
+
+// Config selects the backends shared by clients and worker servers. Both
+// sides of a deployment must use the same Backend and Store.
+type Config struct {
+    // Backend holds queued tasks, Store records their state.
+    Backend queue.Backend
+    Store   db.Store
+
+    // Org is the organization whose tasks are enqueued and processed. It
+    // defaults to db.DefaultOrg.
+    Org string
+
+    // Concurrency is the number of workers run by a WorkerServer. It
+    // defaults to 1.
+    Concurrency int
+    // Name prefixes the worker IDs; it defaults to the host name.
+    Name string
+}
+
+var errNoBackend = errors.New("dtq: config needs a Backend and a Store")
+
+func (cfg Config) org() string {
+    if cfg.Org == "" {
+        return db.DefaultOrg
+    }
+    return cfg.Org
+}
+
+func (cfg Config) queue() (*queue.Queue, error) {
+    if cfg.Backend == nil || cfg.Store == nil {
+        return nil, errNoBackend
+    }
+    return queue.NewQueue(cfg.Backend, cfg.Store), nil
+}
@@ -0,0 +1,86 @@
+package dtq
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "sync"
+    "task_queue_system/models"
+    "task_queue_system/queue"
+    "task_queue_system/workers"
+)
+
+// WorkerServer runs a pool of workers and dispatches each task to the
+// handler registered for its type. Tasks of an unregistered type fail and
+// are retried like any other failure.
+type WorkerServer struct {
+    cfg Config
+
+    mu       sync.RWMutex
+    handlers map[string]Handler
+}
+
+func NewWorkerServer(cfg Config) *WorkerServer {
+    return &WorkerServer{cfg: cfg, handlers: make(map[string]Handler)}
+}
+
+// Handle registers the handler for a task type, replacing any previous one.
+func (s *WorkerServer) Handle(taskType string, h Handler) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.handlers[taskType] = h
+}
+
+func (s *WorkerServer) HandleFunc(taskType string, f func(ctx context.Context, task *Task) error) {
+    s.Handle(taskType, HandlerFunc(f))
+}
+
+// ProcessTask implements Handler by dispatching on the task type.
+func (s *WorkerServer) ProcessTask(ctx context.Context, task *models.Task) error {
+    taskType := task.Type
+    if taskType == "" {
+        taskType = queue.DefaultTaskType
+    }
+
+    s.mu.RLock()
+    h, ok := s.handlers[taskType]
+    s.mu.RUnlock()
+    if !ok {
+        return fmt.Errorf("dtq: no handler for task type %q", taskType)
+    }
+    return h.ProcessTask(ctx, task)
+}
+
+// Run starts the workers and blocks until ctx is cancelled and every worker
+// has returned from its current task. Handlers get ctx and should return
+// when it is cancelled; tasks they return an error for then go back to the
+// queue without counting as a failed attempt.
+func (s *WorkerServer) Run(ctx context.Context) error {
+    q, err := s.cfg.queue()
+    if err != nil {
+        return err
+    }
+
+    concurrency := s.cfg.Concurrency
+    if concurrency <= 0 {
+        concurrency = 1
+    }
+    name := s.cfg.Name
+    if name == "" {
+        name, _ = os.Hostname()
+    }
+
+    var wg sync.WaitGroup
+    for i := 0; i < concurrency; i++ {
+        wg.Add(1)
+        worker := workers.NewWorker(fmt.Sprintf("%s-%d", name, i+1), s.cfg.org(), q, s.cfg.Store, s)
+        go func() {
+            defer wg.Done()
+            worker.Start(ctx, ctx.Done())
+        }()
+    }
+
+    wg.Wait()
+    return nil
+}
@@ -14,5 +14,4 @@ require (
     github.com/rs/cors v1.8.2
     github.com/sirupsen/logrus v1.9.0
     golang.org/x/crypto v0.11.0
-    golang.org/x/time v0.3.0
 )
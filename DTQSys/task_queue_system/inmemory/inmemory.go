@@ -0,0 +1,98 @@
+// Package inmemory wires a complete system (API server, queue and workers)
+// over the in-memory backends, so handler tests and embedded deployments run
+// without Postgres or Redis.
+package inmemory
+
+import (
+    "context"
+    "fmt"
+    "sync"
+    "task_queue_system/api"
+    "task_queue_system/auth"
+    "task_queue_system/db"
+    "task_queue_system/queue"
+    "task_queue_system/workers"
+)
+
+type System struct {
+    Server  *api.Server
+    Queue   *queue.Queue
+    Backend *queue.MemoryBackend
+    Store   *db.MemoryStore
+    Workers []*workers.Worker
+
+    cancel context.CancelFunc
+    wg     sync.WaitGroup
+}
+
+// New builds a system whose workers run handler for the default
+// organization. A nil handler falls back to workers.SimulatedHandler, as in
+// the standalone server. It fails when the token signing keys configured in
+// the environment cannot be loaded.
+func New(numWorkers int, handler workers.Handler) (*System, error) {
+    if handler == nil {
+        handler = workers.SimulatedHandler
+    }
+
+    if auth.Keys() == nil {
+        if err := useKeys(); err != nil {
+            return nil, err
+        }
+    }
+
+    store := db.NewMemoryStore()
+    backend := queue.NewMemoryBackend()
+    taskQueue := queue.NewQueue(backend, store)
+
+    s := &System{
+        Server:  api.NewServer(taskQueue, store),
+        Queue:   taskQueue,
+        Backend: backend,
+        Store:   store,
+    }
+    for i := 0; i < numWorkers; i++ {
+        workerID := fmt.Sprintf("worker-%d", i+1)
+        s.Workers = append(s.Workers, workers.NewWorker(workerID, db.DefaultOrg, taskQueue, store, handler))
+    }
+    return s, nil
+}
+
+// useKeys installs the keys configured in the environment or, when there are
+// none, a key generated for the lifetime of the process.
+func useKeys() error {
+    keys, err := auth.LoadKeys()
+    if err == auth.ErrNoKeys {
+        var key *auth.Key
+        if key, err = auth.GenerateKey(); err == nil {
+            keys, err = auth.NewKeySet(key)
+        }
+    }
+    if err != nil {
+        return fmt.Errorf("inmemory: token signing keys: %v", err)
+    }
+    auth.SetKeys(keys)
+    return nil
+}
+
+// Start runs the workers in the background until Stop is called.
+func (s *System) Start() {
+    var ctx context.Context
+    ctx, s.cancel = context.WithCancel(context.Background())
+    for _, worker := range s.Workers {
+        s.wg.Add(1)
+        go func(worker *workers.Worker) {
+            defer s.wg.Done()
+            worker.Start(ctx, ctx.Done())
+        }(worker)
+    }
+}
+
+// Stop cancels the workers' current tasks, which go back to the queue, and
+// waits for the workers to finish. It does nothing if Start was never
+// called.
+func (s *System) Stop() {
+    if s.cancel != nil {
+        s.cancel()
+    }
+    s.wg.Wait()
+}
@@ -0,0 +1,95 @@
+package inmemory_test
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "task_queue_system/inmemory"
+    "task_queue_system/models"
+    "task_queue_system/workers"
+    "testing"
+    "time"
+)
+
+// request serves one request through the system's routes.
+func request(t *testing.T, sys *inmemory.System, method, path, token string, body interface{}) *httptest.ResponseRecorder {
+    t.Helper()
+    var payload bytes.Buffer
+    if body != nil {
+        if err := json.NewEncoder(&payload).Encode(body); err != nil {
+            t.Fatal(err)
+        }
+    }
+    r := httptest.NewRequest(method, path, &payload)
+    if body != nil {
+        r.Header.Set("Content-Type", "application/json")
+    }
+    if token != "" {
+        r.Header.Set("Authorization", "Bearer "+token)
+    }
+    w := httptest.NewRecorder()
+    sys.Server.Routes().ServeHTTP(w, r)
+    return w
+}
+
+func TestTaskLifecycle(t *testing.T) {
+    processed := make(chan string, 1)
+    sys, err := inmemory.New(1, workers.HandlerFunc(func(ctx context.Context, task *models.Task) error {
+        processed <- task.Data
+        return nil
+    }))
+    if err != nil {
+        t.Fatalf("New: %v", err)
+    }
+    sys.Server.Limiter = nil
+    sys.Start()
+    defer sys.Stop()
+
+    creds := models.Credentials{Username: "henry", Password: "correct-horse-1"}
+    if w := request(t, sys, http.MethodPost, "/register", "", creds); w.Code != http.StatusCreated {
+        t.Fatalf("POST /register = %d %s", w.Code, w.Body)
+    }
+    w := request(t, sys, http.MethodPost, "/login", "", creds)
+    var tokens map[string]string
+    if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil || w.Code != http.StatusOK {
+        t.Fatalf("POST /login = %d, %v", w.Code, err)
+    }
+    token := tokens["access_token"]
+
+    w = request(t, sys, http.MethodPost, "/tasks", token, models.Task{Data: "hello", Priority: 2})
+    var task models.Task
+    if err := json.NewDecoder(w.Body).Decode(&task); err != nil || w.Code != http.StatusCreated {
+        t.Fatalf("POST /tasks = %d, %v", w.Code, err)
+    }
+    if task.Owner != "henry" || task.Status != "pending" {
+        t.Fatalf("created task = %+v", task)
+    }
+
+    select {
+    case data := <-processed:
+        if data != "hello" {
+            t.Fatalf("worker processed %q, want hello", data)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatal("the worker did not process the task")
+    }
+
+    // The worker records the outcome right after its handler returns
+    deadline := time.Now().Add(5 * time.Second)
+    for task.Status != "completed" && time.Now().Before(deadline) {
+        time.Sleep(10 * time.Millisecond)
+        w = request(t, sys, http.MethodGet, "/tasks/"+task.ID, token, nil)
+        if err := json.NewDecoder(w.Body).Decode(&task); err != nil || w.Code != http.StatusOK {
+            t.Fatalf("GET /tasks/%s = %d, %v", task.ID, w.Code, err)
+        }
+    }
+    if task.Status != "completed" {
+        t.Fatalf("task status = %s, want completed", task.Status)
+    }
+
+    if w := request(t, sys, http.MethodGet, "/tasks/"+task.ID, "", nil); w.Code != http.StatusUnauthorized {
+        t.Fatalf("GET /tasks/%s without a token = %d, want 401", task.ID, w.Code)
+    }
+}
@@ -1,18 +1,26 @@
 package main
 
 import (
+    "context"
     "fmt"
-    "log"
     "net/http"
     "os"
     "os/signal"
+    "strconv"
+    "strings"
     "sync"
     "syscall"
+    "time"
     "task_queue_system/api"
+    "task_queue_system/auth"
     "task_queue_system/db"
+    "task_queue_system/middleware"
+    "task_queue_system/models"
     "task_queue_system/queue"
     "task_queue_system/workers"
 
+    "github.com/go-redis/redis/v8"
+    "github.com/google/uuid"
     "github.com/joho/godotenv"
     logrus "github.com/sirupsen/logrus"
 )
@@ -30,47 +38,188 @@ func main() {
         logrus.Info("No .env file found, using system environment variables")
     }
 
+    // Load the token signing keys; without one no token could be issued
+    keys, err := auth.LoadKeys()
+    if err != nil {
+        logrus.Fatalf("Failed to load token signing keys: %v", err)
+    }
+    auth.SetKeys(keys)
+    if key, err := keys.SigningKey(time.Now()); err == nil && key.Algorithm == auth.AlgHS256 {
+        logrus.Warn("Signing tokens with JWT_SECRET_KEY (HS256); set JWT_SIGNING_KEYS to publish verification keys")
+    }
+
+    // Password rules for registration, password changes and resets
+    auth.Policy, err = auth.PasswordPolicyFromEnv()
+    if err != nil {
+        logrus.Fatalf("Invalid password policy: %v", err)
+    }
+
     // Initialize the database
     database, err := db.OpenDB()
     if err != nil {
         logrus.Fatalf("Failed to connect to database: %v", err)
     }
     defer database.Close()
+    store := db.NewPostgresStore(database)
 
-    // Initialize the queue
-    redisAddr := os.Getenv("REDIS_ADDR")
-    taskQueue := queue.NewQueue(redisAddr, database)
+    // Initialize the queue backend
+    var backend queue.Backend
+    switch os.Getenv("QUEUE_BACKEND") {
+    case "postgres":
+        backend, err = queue.NewPostgresBackend(database, db.ConnString())
+        if err != nil {
+            logrus.Fatalf("Failed to start postgres queue backend: %v", err)
+        }
+    case "redis-streams":
+        backend, err = queue.NewStreamsBackend(os.Getenv("REDIS_ADDR"), queue.DefaultClaimIdle)
+        if err != nil {
+            logrus.Fatalf("Failed to start redis streams queue backend: %v", err)
+        }
+    default:
+        backend = queue.NewRedisBackend(os.Getenv("REDIS_ADDR"))
+    }
+    taskQueue := queue.NewQueue(backend, store)
+    defer taskQueue.Close()
+
+    // Quotas for organizations that have none of their own; unset means no
+    // limit
+    taskQueue.DefaultQuota = models.Quota{
+        MaxQueued:             envInt("TENANT_MAX_QUEUED"),
+        MaxTasksPerMinute:     envInt("TENANT_MAX_TASKS_PER_MINUTE"),
+        MaxTasksPerHour:       envInt("TENANT_MAX_TASKS_PER_HOUR"),
+        MaxPayloadBytesPerDay: int64(envInt("TENANT_MAX_PAYLOAD_BYTES_PER_DAY")),
+        User: models.UserQuota{
+            MaxQueued:             envInt("USER_MAX_QUEUED"),
+            MaxTasksPerHour:       envInt("USER_MAX_TASKS_PER_HOUR"),
+            MaxPayloadBytesPerDay: int64(envInt("USER_MAX_PAYLOAD_BYTES_PER_DAY")),
+        },
+    }
+
+    // Cap the data of a task, 1 MiB by default
+    if n := envInt("MAX_TASK_DATA_BYTES"); n > 0 {
+        taskQueue.MaxDataBytes = n
+    }
+
+    // Organizations served by the in-process workers; others rely on remote
+    // workers
+    workerOrgs := []string{db.DefaultOrg}
+    if orgs := os.Getenv("WORKER_ORGS"); orgs != "" {
+        workerOrgs = strings.Split(orgs, ",")
+    }
 
     // Number of workers to start
     numWorkers := 5
 
+    // Worker IDs name the stream consumers and worker registrations, so
+    // every instance needs its own
+    instanceID := os.Getenv("INSTANCE_ID")
+    if instanceID == "" {
+        hostname, _ := os.Hostname()
+        instanceID = hostname + "-" + uuid.New().String()[:8]
+    }
+
     // WaitGroup to wait for all workers to finish
     var wg sync.WaitGroup
 
-    // Channel to signal workers to stop
+    // Channel to signal workers to stop, and the context that cancels their
+    // current tasks once the shutdown timeout is up
     stopChan := make(chan struct{})
+    workerCtx, cancelWorkers := context.WithCancel(context.Background())
+    defer cancelWorkers()
 
-    // Start multiple workers
-    for i := 0; i < numWorkers; i++ {
-        wg.Add(1)
-        workerID := fmt.Sprintf("worker-%d", i+1)
-        worker := workers.NewWorker(workerID, taskQueue, database)
-        go func() {
-            defer wg.Done()
-            worker.Start(stopChan)
-        }()
+    // Start multiple workers for each organization
+    for _, org := range workerOrgs {
+        org = strings.TrimSpace(org)
+        for i := 0; i < numWorkers; i++ {
+            wg.Add(1)
+            workerID := fmt.Sprintf("%s-worker-%d", instanceID, i+1)
+            if org != db.DefaultOrg {
+                workerID = fmt.Sprintf("%s-%s-worker-%d", instanceID, org, i+1)
+            }
+            worker := workers.NewWorker(workerID, org, taskQueue, store, workers.SimulatedHandler)
+            go func() {
+                defer wg.Done()
+                worker.Start(workerCtx, stopChan)
+            }()
+        }
     }
 
     // Set up the API server
-    server := api.NewServer(taskQueue, database)
+    server := api.NewServer(taskQueue, store)
+
+    // Delegate login to an OpenID Connect provider when one is configured
+    if oidcConfig := auth.OIDCConfigFromEnv(); oidcConfig.Issuer != "" {
+        ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+        server.OIDC, err = auth.NewOIDCProvider(ctx, oidcConfig)
+        cancel()
+        if err != nil {
+            logrus.Fatalf("Failed to set up OIDC login: %v", err)
+        }
+    }
+
+    // Request body limits per route class; unset keeps the default
+    for name, class := range map[string]string{
+        "MAX_AUTH_BODY_BYTES":   api.LimitAuth,
+        "MAX_BODY_BYTES":        api.LimitAPI,
+        "MAX_WORKER_BODY_BYTES": api.LimitWorker,
+        "MAX_TASK_BODY_BYTES":   api.BodyTasks,
+    } {
+        if n := envInt(name); n > 0 {
+            server.BodyLimits[class] = int64(n)
+        }
+    }
+    if server.BodyLimits[api.BodyTasks] < int64(taskQueue.MaxDataBytes) {
+        logrus.Fatalf("MAX_TASK_BODY_BYTES must be at least MAX_TASK_DATA_BYTES (%d)", taskQueue.MaxDataBytes)
+    }
+
+    // Cross-origin access and security headers for this environment
+    server.CORS, err = middleware.CORSConfigFromEnv()
+    if err != nil {
+        logrus.Fatalf("Invalid CORS configuration: %v", err)
+    }
+    server.Security, err = middleware.SecurityConfigFromEnv()
+    if err != nil {
+        logrus.Fatalf("Invalid security headers: %v", err)
+    }
+
+    // Take client addresses from the forwarding headers of these proxies
+    server.TrustedProxies, err = middleware.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+    if err != nil {
+        logrus.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+    }
 
-    // Expose the metrics endpoint
-    http.Handle("/metrics", server.Routes())
+    // Share revoked sessions and rate limits between instances through
+    // Redis. Only the postgres backend runs without Redis, and then both
+    // stay local.
+    if os.Getenv("QUEUE_BACKEND") != "postgres" || os.Getenv("REDIS_ADDR") != "" {
+        redisClient := redis.NewClient(&redis.Options{Addr: os.Getenv("REDIS_ADDR")})
+        defer redisClient.Close()
+        server.Denylist = auth.NewRedisDenylist(redisClient)
+        server.Limiter = middleware.NewRedisLimiter(redisClient)
+    } else {
+        logrus.Warn("REDIS_ADDR not set, session revocations and rate limits are not shared between instances")
+    }
+
+    // Copy the audit log to a local file of JSON lines, e.g. for a log
+    // shipper
+    if path := os.Getenv("AUDIT_LOG_FILE"); path != "" {
+        auditFile, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+        if err != nil {
+            logrus.Fatalf("Failed to open audit log file: %v", err)
+        }
+        defer auditFile.Close()
+        server.AuditFile = auditFile
+    }
 
     // Start the HTTPS server
+    httpConfig, err := api.HTTPConfigFromEnv()
+    if err != nil {
+        logrus.Fatalf("Invalid HTTP server configuration: %v", err)
+    }
+    httpServer := server.HTTPServer(":8443", httpConfig)
     go func() {
         logrus.Info("Server started at :8443")
-        if err := http.ListenAndServeTLS(":8443", "cert/cert.pem", "cert/key.pem", server.Routes()); err != nil {
+        if err := httpServer.ListenAndServeTLS("cert/cert.pem", "cert/key.pem"); err != http.ErrServerClosed {
             logrus.Fatalf("HTTPS server error: %v", err)
         }
     }()
@@ -81,10 +230,65 @@ func main() {
     <-sigs
     logrus.Info("Shutdown signal received")
 
+    // Refuse new submissions, and keep serving the rest until load
+    // balancers have noticed
+    server.BeginShutdown()
+    time.Sleep(httpConfig.ShutdownDelay)
+
+    // Let in-flight requests and the workers' current tasks finish, within
+    // one deadline
+    ctx, cancel := context.WithTimeout(context.Background(), httpConfig.ShutdownTimeout)
+    defer cancel()
+    httpDone := make(chan error, 1)
+    go func() {
+        httpDone <- httpServer.Shutdown(ctx)
+    }()
+
     // Signal workers to stop
     close(stopChan)
+    workersDone := make(chan struct{})
+    go func() {
+        wg.Wait()
+        close(workersDone)
+    }()
 
-    // Wait for all workers to finish
-    wg.Wait()
-    logrus.Info("All workers have stopped")
+    select {
+    case <-workersDone:
+        logrus.Info("All workers have stopped")
+    case <-ctx.Done():
+        // Interrupted tasks go back to the queue as their handlers return
+        logrus.Warn("Workers did not stop in time, cancelling their tasks")
+        cancelWorkers()
+        select {
+        case <-workersDone:
+            logrus.Info("All workers have stopped")
+        case <-time.After(workerCancelGrace):
+            // With the streams backend the tasks are delivered again once
+            // idle for its claim timeout; the list and postgres backends
+            // leave them running
+            logrus.Error("Workers ignored cancellation, their tasks are left running")
+        }
+    }
+    if err := <-httpDone; err != nil {
+        logrus.Warnf("Requests still in flight were cut off: %v", err)
+    } else {
+        logrus.Info("HTTPS server stopped")
+    }
+}
+
+// workerCancelGrace is how long cancelled workers get to requeue their tasks
+// before the process exits.
+const workerCancelGrace = 5 * time.Second
+
+// envInt reads a non-negative integer setting, treating unset as zero.
+func envInt(name string) int {
+    value := os.Getenv(name)
+    if value == "" {
+        return 0
+    }
+    n, err := strconv.Atoi(value)
+    if err != nil || n < 0 {
+        logrus.Fatalf("%s must be a non-negative integer", name)
+    }
+    return n
 }
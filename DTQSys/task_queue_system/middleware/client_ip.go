@@ -0,0 +1,152 @@
+package middleware
+
+import (
+    "context"
+    "fmt"
+    "net"
+    "net/http"
+    "strings"
+)
+
+// ParseTrustedProxies parses a comma-separated list of CIDRs, such as
+// "10.0.0.0/8,fd00::/8". A bare address stands for itself alone.
+func ParseTrustedProxies(value string) ([]*net.IPNet, error) {
+    var networks []*net.IPNet
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        if !strings.Contains(entry, "/") {
+            ip := net.ParseIP(entry)
+            if ip == nil {
+                return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+            }
+            bits := 8 * net.IPv6len
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 8*net.IPv4len
+            }
+            networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, network, err := net.ParseCIDR(entry)
+        if err != nil {
+            return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+        }
+        networks = append(networks, network)
+    }
+    return networks, nil
+}
+
+// RealIP resolves the address of the client and stores it in the request
+// context for ClientIP. Requests from trusted proxies are attributed to the
+// address the proxies forwarded for, read from the Forwarded header or, when
+// there is none, X-Forwarded-For. The list is read from the right, as each
+// proxy appends the address it received the request from, and the first
+// address not of a trusted proxy is the client; anything to its left could
+// have been made up by the client.
+func RealIP(trusted []*net.IPNet) func(http.Handler) http.Handler {
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            ip := resolveClientIP(r, trusted)
+            next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "client_ip", ip)))
+        })
+    }
+}
+
+// ClientIP returns the address RealIP resolved or, without it, the peer
+// address of the connection. Neither has a port.
+func ClientIP(r *http.Request) string {
+    if ip, ok := r.Context().Value("client_ip").(string); ok {
+        return ip
+    }
+    return peerIP(r)
+}
+
+func peerIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        return r.RemoteAddr
+    }
+    return host
+}
+
+func resolveClientIP(r *http.Request, trusted []*net.IPNet) string {
+    client := peerIP(r)
+    if len(trusted) == 0 {
+        return client
+    }
+
+    var hops []string
+    if values := r.Header.Values("Forwarded"); len(values) > 0 {
+        hops = forwardedFor(values)
+    } else {
+        for _, value := range r.Header.Values("X-Forwarded-For") {
+            for _, hop := range strings.Split(value, ",") {
+                hops = append(hops, strings.TrimSpace(hop))
+            }
+        }
+    }
+
+    for i := len(hops) - 1; i >= 0 && isTrusted(client, trusted); i-- {
+        ip := parseNode(hops[i])
+        if ip == nil {
+            // Obfuscated or malformed: the proxy that added it is as far
+            // back as the chain can be followed
+            break
+        }
+        client = ip.String()
+    }
+    return client
+}
+
+func isTrusted(address string, trusted []*net.IPNet) bool {
+    ip := net.ParseIP(address)
+    if ip == nil {
+        return false
+    }
+    for _, network := range trusted {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// forwardedFor returns the for= parameters of Forwarded headers (RFC 7239),
+// one per proxy, in order.
+func forwardedFor(values []string) []string {
+    var hops []string
+    for _, value := range values {
+        for _, element := range strings.Split(value, ",") {
+            node := ""
+            for _, pair := range strings.Split(element, ";") {
+                name, val := pair, ""
+                if i := strings.Index(pair, "="); i >= 0 {
+                    name, val = pair[:i], pair[i+1:]
+                }
+                if strings.EqualFold(strings.TrimSpace(name), "for") {
+                    node = strings.Trim(strings.TrimSpace(val), `"`)
+                }
+            }
+            hops = append(hops, node)
+        }
+    }
+    return hops
+}
+
+// parseNode parses a forwarded address, which may carry a port and, for
+// IPv6, brackets. Names such as "unknown" or "_hidden" give nil.
+func parseNode(node string) net.IP {
+    if strings.HasPrefix(node, "[") {
+        end := strings.Index(node, "]")
+        if end < 0 {
+            return nil
+        }
+        return net.ParseIP(node[1:end])
+    }
+    if host, _, err := net.SplitHostPort(node); err == nil {
+        node = host
+    }
+    return net.ParseIP(node)
+}
@@ -0,0 +1,89 @@
+package middleware_test
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "task_queue_system/middleware"
+    "testing"
+)
+
+// resolve runs a request from the peer with the headers through RealIP and
+// returns the client address it resolved.
+func resolve(t *testing.T, trusted, peer string, headers http.Header) string {
+    t.Helper()
+    networks, err := middleware.ParseTrustedProxies(trusted)
+    if err != nil {
+        t.Fatalf("ParseTrustedProxies(%q): %v", trusted, err)
+    }
+
+    var ip string
+    handler := middleware.RealIP(networks)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ip = middleware.ClientIP(r)
+    }))
+    r := httptest.NewRequest(http.MethodGet, "/", nil)
+    r.RemoteAddr = peer
+    r.Header = headers
+    handler.ServeHTTP(httptest.NewRecorder(), r)
+    return ip
+}
+
+func TestRealIP(t *testing.T) {
+    const trusted = "10.0.0.0/8, fd00::/8, 192.0.2.1"
+    tests := []struct {
+        name    string
+        trusted string
+        peer    string
+        headers http.Header
+        want    string
+    }{
+        {"no trusted proxies", "", "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "10.0.0.1"},
+        {"untrusted peer", trusted, "203.0.113.5:5000", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "203.0.113.5"},
+        {"no header", trusted, "10.0.0.1:5000", http.Header{}, "10.0.0.1"},
+        {"X-Forwarded-For", trusted, "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+        {"spoofed entries on the left", trusted, "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7"}}, "198.51.100.7"},
+        {"chain of trusted proxies", trusted, "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7, 10.0.0.2"}}, "198.51.100.7"},
+        {"only trusted proxies", trusted, "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+        {"several header lines", trusted, "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"6.6.6.6", "198.51.100.7, 10.0.0.2"}}, "198.51.100.7"},
+        {"X-Forwarded-For with port", trusted, "10.0.0.1:5000", http.Header{"X-Forwarded-For": {"198.51.100.7:4711"}}, "198.51.100.7"},
+        {"bare trusted address", trusted, "192.0.2.1:5000", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+        {"next to a bare trusted address", trusted, "192.0.2.2:5000", http.Header{"X-Forwarded-For": {"198.51.100.7"}}, "192.0.2.2"},
+        {"IPv6 peer", trusted, "[fd00::1]:5000", http.Header{"X-Forwarded-For": {"2001:db8::7"}}, "2001:db8::7"},
+        {"Forwarded", trusted, "10.0.0.1:5000", http.Header{"Forwarded": {"for=198.51.100.7"}}, "198.51.100.7"},
+        {"Forwarded wins over X-Forwarded-For", trusted, "10.0.0.1:5000", http.Header{
+            "Forwarded":       {"for=198.51.100.7"},
+            "X-Forwarded-For": {"6.6.6.6"},
+        }, "198.51.100.7"},
+        {"Forwarded with parameters", trusted, "10.0.0.1:5000", http.Header{"Forwarded": {"for=6.6.6.6, for=198.51.100.7;proto=https;by=10.0.0.1"}}, "198.51.100.7"},
+        {"Forwarded case and quotes", trusted, "10.0.0.1:5000", http.Header{"Forwarded": {`proto=https; For="198.51.100.7"`}}, "198.51.100.7"},
+        {"Forwarded IPv6 with port", trusted, "10.0.0.1:5000", http.Header{"Forwarded": {`for="[2001:db8::7]:4711"`}}, "2001:db8::7"},
+        {"Forwarded obfuscated", trusted, "10.0.0.1:5000", http.Header{"Forwarded": {"for=198.51.100.7, for=_hidden"}}, "10.0.0.1"},
+        {"Forwarded unknown behind a proxy", trusted, "10.0.0.1:5000", http.Header{"Forwarded": {"for=unknown, for=10.0.0.2"}}, "10.0.0.2"},
+        {"Forwarded without for", trusted, "10.0.0.1:5000", http.Header{"Forwarded": {"proto=https"}}, "10.0.0.1"},
+    }
+    for _, test := range tests {
+        if got := resolve(t, test.trusted, test.peer, test.headers); got != test.want {
+            t.Errorf("%s: client IP = %q, want %q", test.name, got, test.want)
+        }
+    }
+}
+
+func TestClientIPWithoutRealIP(t *testing.T) {
+    r := httptest.NewRequest(http.MethodGet, "/", nil)
+    r.RemoteAddr = "198.51.100.7:5000"
+    r.Header.Set("X-Forwarded-For", "6.6.6.6")
+    if got := middleware.ClientIP(r); got != "198.51.100.7" {
+        t.Fatalf("ClientIP = %q, want the peer address", got)
+    }
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+    for _, value := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0.0/8,nope"} {
+        if _, err := middleware.ParseTrustedProxies(value); err == nil {
+            t.Errorf("ParseTrustedProxies(%q) succeeded, want an error", value)
+        }
+    }
+    networks, err := middleware.ParseTrustedProxies(" 10.0.0.0/8 ,, ::1 ")
+    if err != nil || len(networks) != 2 {
+        t.Fatalf("ParseTrustedProxies = %v, %v, want two networks", networks, err)
+    }
+}
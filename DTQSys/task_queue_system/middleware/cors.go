@@ -0,0 +1,137 @@
+package middleware
+
+import (
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+
+    "github.com/rs/cors"
+)
+
+// CORSConfig controls which web origins may call the API from a browser.
+// Without AllowedOrigins only same-origin pages can.
+type CORSConfig struct {
+    // AllowedOrigins are scheme://host[:port] origins, or "*" for any. One
+    // "*" may stand for a subdomain, as in "https://*.example.com".
+    AllowedOrigins []string
+    AllowedMethods []string
+    // AllowedHeaders are the request headers pages may send.
+    AllowedHeaders []string
+    // ExposedHeaders are the response headers pages may read.
+    ExposedHeaders []string
+    // AllowCredentials lets pages send cookies and TLS client
+    // certificates. Bearer tokens do not need it.
+    AllowCredentials bool
+    // MaxAge is how many seconds browsers may cache a preflight response.
+    MaxAge int
+}
+
+func DefaultCORSConfig() CORSConfig {
+    return CORSConfig{
+        AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+        AllowedHeaders: []string{"Authorization", "Content-Type", "Idempotency-Key"},
+        ExposedHeaders: []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "X-Request-ID"},
+        MaxAge:         600,
+    }
+}
+
+// CORSConfigFromEnv adjusts the default configuration with
+// CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS and
+// CORS_EXPOSED_HEADERS (comma-separated), CORS_ALLOW_CREDENTIALS and
+// CORS_MAX_AGE, and validates the result.
+func CORSConfigFromEnv() (CORSConfig, error) {
+    config := DefaultCORSConfig()
+    for name, field := range map[string]*[]string{
+        "CORS_ALLOWED_ORIGINS": &config.AllowedOrigins,
+        "CORS_ALLOWED_METHODS": &config.AllowedMethods,
+        "CORS_ALLOWED_HEADERS": &config.AllowedHeaders,
+        "CORS_EXPOSED_HEADERS": &config.ExposedHeaders,
+    } {
+        if value, ok := os.LookupEnv(name); ok {
+            *field = splitList(value)
+        }
+    }
+    if value := os.Getenv("CORS_ALLOW_CREDENTIALS"); value != "" {
+        allow, err := strconv.ParseBool(value)
+        if err != nil {
+            return config, fmt.Errorf("CORS_ALLOW_CREDENTIALS must be true or false")
+        }
+        config.AllowCredentials = allow
+    }
+    if value := os.Getenv("CORS_MAX_AGE"); value != "" {
+        n, err := strconv.Atoi(value)
+        if err != nil || n < 0 {
+            return config, fmt.Errorf("CORS_MAX_AGE must be a non-negative number of seconds")
+        }
+        config.MaxAge = n
+    }
+    return config, config.Validate()
+}
+
+// Validate rejects configurations that would let any site act with the
+// credentials of the API's users, and origins browsers never send.
+func (c CORSConfig) Validate() error {
+    for _, origin := range c.AllowedOrigins {
+        if origin == "*" {
+            if c.AllowCredentials {
+                return fmt.Errorf("CORS: the origin * cannot be combined with credentials")
+            }
+            continue
+        }
+        if origin == "null" {
+            return fmt.Errorf("CORS: the origin null is sent by sandboxed and local pages and cannot be allowed")
+        }
+        u, err := url.Parse(origin)
+        if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" ||
+            (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.User != nil {
+            return fmt.Errorf("CORS: invalid origin %q, want scheme://host[:port]", origin)
+        }
+        if strings.Count(origin, "*") > 1 {
+            return fmt.Errorf("CORS: origin %q may contain at most one *", origin)
+        }
+        if c.AllowCredentials && u.Scheme == "http" && !isLoopback(u.Hostname()) {
+            return fmt.Errorf("CORS: credentials cannot be allowed for the plain http origin %q", origin)
+        }
+    }
+    for _, header := range c.AllowedHeaders {
+        if header == "*" && c.AllowCredentials {
+            return fmt.Errorf("CORS: the allowed header * cannot be combined with credentials")
+        }
+    }
+    return nil
+}
+
+// Handler applies the configuration to preflight and actual requests.
+// Without allowed origins it answers no cross-origin request, as rs/cors
+// would otherwise allow every origin.
+func (c CORSConfig) Handler(next http.Handler) http.Handler {
+    if len(c.AllowedOrigins) == 0 {
+        return next
+    }
+    return cors.New(cors.Options{
+        AllowedOrigins:   c.AllowedOrigins,
+        AllowedMethods:   c.AllowedMethods,
+        AllowedHeaders:   c.AllowedHeaders,
+        ExposedHeaders:   c.ExposedHeaders,
+        AllowCredentials: c.AllowCredentials,
+        MaxAge:           c.MaxAge,
+    }).Handler(next)
+}
+
+func isLoopback(host string) bool {
+    return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(value string) []string {
+    var list []string
+    for _, entry := range strings.Split(value, ",") {
+        if entry = strings.TrimSpace(entry); entry != "" {
+            list = append(list, entry)
+        }
+    }
+    return list
+}
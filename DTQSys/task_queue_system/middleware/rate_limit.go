@@ -1,44 +1,153 @@
 package middleware
 
 import (
-    "net/http"
+    "context"
+    "strconv"
     "sync"
     "time"
 
-    "golang.org/x/time/rate"
+    "github.com/go-redis/redis/v8"
 )
 
-var visitors = make(map[string]*rate.Limiter)
-var mu sync.Mutex
+// Limit allows Requests per Period on average, and up to Burst requests at
+// once after a quiet spell.
+type Limit struct {
+    Requests int
+    Period   time.Duration
+    Burst    int
+}
+
+// interval is the share of the budget one request uses up.
+func (l Limit) interval() time.Duration {
+    return l.Period / time.Duration(l.Requests)
+}
 
-func getVisitor(ip string) *rate.Limiter {
-    mu.Lock()
-    defer mu.Unlock()
+// Decision is a limiter's answer for one request.
+type Decision struct {
+    Allowed bool
+    // Limit is the burst size, Remaining how many more requests fit in it
+    // right now.
+    Limit     int
+    Remaining int
+    // ResetAfter is how long until the full burst is available again.
+    ResetAfter time.Duration
+    // RetryAfter is how long a rejected caller has to wait.
+    RetryAfter time.Duration
+}
 
-    limiter, exists := visitors[ip]
-    if !exists {
-        limiter = rate.NewLimiter(1, 5) // 1 request per second, burst of 5
-        visitors[ip] = limiter
+// Limiter rate limits requests per key with the generic cell rate algorithm
+// (GCRA): each key stores the time at which its budget is fully spent, its
+// theoretical arrival time, and a request is allowed while that stays
+// within one burst of now.
+type Limiter interface {
+    Allow(ctx context.Context, key string, limit Limit) (Decision, error)
+}
+
+// gcra applies a request at now to the theoretical arrival time tat and
+// returns the new one, which is unchanged for rejected requests.
+func gcra(tat, now time.Time, limit Limit) (time.Time, Decision) {
+    interval := limit.interval()
+    decision := Decision{Limit: limit.Burst}
+    if tat.Before(now) {
+        tat = now
+    }
 
-        go func() {
-            time.Sleep(3 * time.Minute)
-            mu.Lock()
-            delete(visitors, ip)
-            mu.Unlock()
-        }()
+    next := tat.Add(interval)
+    allowAt := next.Add(-interval * time.Duration(limit.Burst))
+    if now.Before(allowAt) {
+        decision.ResetAfter = tat.Sub(now)
+        decision.RetryAfter = allowAt.Sub(now)
+        return tat, decision
     }
-    return limiter
+    decision.Allowed = true
+    decision.Remaining = int(now.Sub(allowAt) / interval)
+    decision.ResetAfter = next.Sub(now)
+    return next, decision
 }
 
-func RateLimiter(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        ip := r.RemoteAddr
-        limiter := getVisitor(ip)
+// RedisLimiter shares the budgets between all API instances. The instances'
+// clocks are assumed to agree to within a small fraction of an interval.
+type RedisLimiter struct {
+    Client *redis.Client
+}
+
+func NewRedisLimiter(client *redis.Client) *RedisLimiter {
+    return &RedisLimiter{Client: client}
+}
+
+// gcraScript is gcra over milliseconds, run atomically in Redis. The key
+// expires once the budget is full again.
+var gcraScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+
+local tat = tonumber(redis.call("GET", KEYS[1]) or now)
+if tat < now then
+    tat = now
+end
+
+local new_tat = tat + interval
+local allow_at = new_tat - interval * burst
+if now < allow_at then
+    return {0, 0, math.ceil(tat - now), math.ceil(allow_at - now)}
+end
+redis.call("SET", KEYS[1], string.format("%.3f", new_tat), "PX", math.ceil(new_tat - now))
+return {1, math.floor((now - allow_at) / interval), math.ceil(new_tat - now), 0}
+`)
 
-        if !limiter.Allow() {
-            http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
-            return
+func (l *RedisLimiter) Allow(ctx context.Context, key string, limit Limit) (Decision, error) {
+    now := float64(time.Now().UnixNano()) / float64(time.Millisecond)
+    interval := float64(limit.interval()) / float64(time.Millisecond)
+    values, err := gcraScript.Run(ctx, l.Client, []string{"ratelimit:" + key},
+        strconv.FormatFloat(now, 'f', 3, 64),
+        strconv.FormatFloat(interval, 'f', 3, 64),
+        limit.Burst,
+    ).Int64Slice()
+    if err != nil {
+        return Decision{}, err
+    }
+
+    return Decision{
+        Allowed:    values[0] == 1,
+        Limit:      limit.Burst,
+        Remaining:  int(values[1]),
+        ResetAfter: time.Duration(values[2]) * time.Millisecond,
+        RetryAfter: time.Duration(values[3]) * time.Millisecond,
+    }, nil
+}
+
+// MemoryLimiter keeps the budgets in process, for single-instance and
+// embedded deployments.
+type MemoryLimiter struct {
+    mu        sync.Mutex
+    tats      map[string]time.Time
+    lastSweep time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+    return &MemoryLimiter{tats: make(map[string]time.Time)}
+}
+
+// sweepInterval is how often MemoryLimiter drops the keys whose budget is
+// full again.
+const sweepInterval = time.Minute
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, limit Limit) (Decision, error) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    now := time.Now()
+    if now.Sub(l.lastSweep) > sweepInterval {
+        for k, tat := range l.tats {
+            if tat.Before(now) {
+                delete(l.tats, k)
+            }
         }
-        next.ServeHTTP(w, r)
-    })
+        l.lastSweep = now
+    }
+
+    tat, decision := gcra(l.tats[key], now, limit)
+    l.tats[key] = tat
+    return decision, nil
 }
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+    "context"
+    "testing"
+    "time"
+)
+
+func TestGCRA(t *testing.T) {
+    // One request per 100ms, up to three at once
+    limit := Limit{Requests: 10, Period: time.Second, Burst: 3}
+    start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+    steps := []struct {
+        at   time.Duration
+        want Decision
+    }{
+        // A fresh key gets the whole burst
+        {0, Decision{Allowed: true, Limit: 3, Remaining: 2, ResetAfter: 100 * time.Millisecond}},
+        {0, Decision{Allowed: true, Limit: 3, Remaining: 1, ResetAfter: 200 * time.Millisecond}},
+        {0, Decision{Allowed: true, Limit: 3, Remaining: 0, ResetAfter: 300 * time.Millisecond}},
+        // then has to wait one interval for the next request
+        {0, Decision{Limit: 3, ResetAfter: 300 * time.Millisecond, RetryAfter: 100 * time.Millisecond}},
+        {50 * time.Millisecond, Decision{Limit: 3, ResetAfter: 250 * time.Millisecond, RetryAfter: 50 * time.Millisecond}},
+        {100 * time.Millisecond, Decision{Allowed: true, Limit: 3, Remaining: 0, ResetAfter: 300 * time.Millisecond}},
+        // A quiet spell of one burst refills the budget
+        {time.Second, Decision{Allowed: true, Limit: 3, Remaining: 2, ResetAfter: 100 * time.Millisecond}},
+    }
+
+    var tat time.Time
+    for i, step := range steps {
+        var got Decision
+        tat, got = gcra(tat, start.Add(step.at), limit)
+        if got != step.want {
+            t.Fatalf("request %d at %v = %+v, want %+v", i+1, step.at, got, step.want)
+        }
+    }
+}
+
+func TestMemoryLimiterKeys(t *testing.T) {
+    limiter := NewMemoryLimiter()
+    limit := Limit{Requests: 1, Period: time.Hour, Burst: 2}
+    ctx := context.Background()
+
+    for i := 0; i < 2; i++ {
+        if decision, err := limiter.Allow(ctx, "alice", limit); err != nil || !decision.Allowed {
+            t.Fatalf("request %d of alice = %+v, %v, want allowed", i+1, decision, err)
+        }
+    }
+    decision, err := limiter.Allow(ctx, "alice", limit)
+    if err != nil || decision.Allowed {
+        t.Fatalf("request 3 of alice = %+v, %v, want rejected", decision, err)
+    }
+    if decision.RetryAfter <= 0 || decision.RetryAfter > time.Hour {
+        t.Fatalf("RetryAfter = %v, want within the hour", decision.RetryAfter)
+    }
+
+    // Each key has a budget of its own
+    if decision, err := limiter.Allow(ctx, "bob", limit); err != nil || !decision.Allowed {
+        t.Fatalf("request of bob = %+v, %v, want allowed", decision, err)
+    }
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+    "context"
+    "net/http"
+
+    "github.com/google/uuid"
+)
+
+// maxRequestIDLength bounds the request IDs accepted from clients.
+const maxRequestIDLength = 128
+
+// AssignRequestID stores the ID of the request in its context for RequestID
+// and returns it in the X-Request-ID response header. A well-formed
+// X-Request-ID sent by the client or a proxy is kept, so one ID follows the
+// request through every service; otherwise a new one is made.
+func AssignRequestID(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID(id) {
+            id = uuid.New().String()
+        }
+        w.Header().Set("X-Request-ID", id)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "request_id", id)))
+    })
+}
+
+// RequestID returns the ID AssignRequestID gave the request, or "" without
+// it.
+func RequestID(r *http.Request) string {
+    id, _ := r.Context().Value("request_id").(string)
+    return id
+}
+
+// validRequestID accepts IDs that cannot forge log lines or headers.
+func validRequestID(id string) bool {
+    if id == "" || len(id) > maxRequestIDLength {
+        return false
+    }
+    for _, c := range id {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+        case c == '-' || c == '_' || c == '.' || c == ':' || c == '/' || c == '+' || c == '=':
+        default:
+            return false
+        }
+    }
+    return true
+}
@@ -1,13 +1,145 @@
 package middleware
 
-import "net/http"
-
-func SecurityHeaders(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("X-Content-Type-Options", "nosniff")
-        w.Header().Set("X-Frame-Options", "DENY")
-        w.Header().Set("X-XSS-Protection", "1; mode=block")
-        w.Header().Set("Content-Security-Policy", "default-src 'self'")
-        next.ServeHTTP(w, r)
-    })
+import (
+    "fmt"
+    "net/http"
+    "os"
+    "strconv"
+    "time"
+)
+
+// SecurityConfig sets the security headers of every response. An empty
+// value leaves its header out.
+type SecurityConfig struct {
+    ContentSecurityPolicy string
+    // FrameOptions is DENY or SAMEORIGIN.
+    FrameOptions string
+    // XSSProtection is "0" by default: the filter of old browsers it
+    // controls can be abused to leak data, and the CSP does its job.
+    XSSProtection     string
+    ReferrerPolicy    string
+    PermissionsPolicy string
+    // HSTSMaxAge is how long browsers should only use HTTPS for this host;
+    // zero sends no Strict-Transport-Security header.
+    HSTSMaxAge            time.Duration
+    HSTSIncludeSubdomains bool
+    // HSTSPreload asks for the host to be added to the browsers' preload
+    // lists, which is hard to undo.
+    HSTSPreload bool
+}
+
+// hstsPreloadMinAge is the shortest max-age the preload lists accept.
+const hstsPreloadMinAge = 365 * 24 * time.Hour
+
+func DefaultSecurityConfig() SecurityConfig {
+    return SecurityConfig{
+        // The API serves JSON only, so pages may load nothing
+        ContentSecurityPolicy: "default-src 'none'; frame-ancestors 'none'",
+        FrameOptions:          "DENY",
+        XSSProtection:         "0",
+        ReferrerPolicy:        "no-referrer",
+        PermissionsPolicy:     "camera=(), microphone=(), geolocation=(), payment=()",
+        HSTSMaxAge:            hstsPreloadMinAge,
+    }
+}
+
+// SecurityConfigFromEnv adjusts the default configuration with
+// SECURITY_CSP, SECURITY_FRAME_OPTIONS, SECURITY_XSS_PROTECTION,
+// SECURITY_REFERRER_POLICY, SECURITY_PERMISSIONS_POLICY (empty to omit the
+// header), HSTS_MAX_AGE (a duration, 0 to disable), HSTS_INCLUDE_SUBDOMAINS
+// and HSTS_PRELOAD, and validates the result.
+func SecurityConfigFromEnv() (SecurityConfig, error) {
+    config := DefaultSecurityConfig()
+    for name, field := range map[string]*string{
+        "SECURITY_CSP":                &config.ContentSecurityPolicy,
+        "SECURITY_FRAME_OPTIONS":      &config.FrameOptions,
+        "SECURITY_XSS_PROTECTION":     &config.XSSProtection,
+        "SECURITY_REFERRER_POLICY":    &config.ReferrerPolicy,
+        "SECURITY_PERMISSIONS_POLICY": &config.PermissionsPolicy,
+    } {
+        if value, ok := os.LookupEnv(name); ok {
+            *field = value
+        }
+    }
+    if value := os.Getenv("HSTS_MAX_AGE"); value != "" {
+        maxAge, err := time.ParseDuration(value)
+        if err != nil || maxAge < 0 {
+            return config, fmt.Errorf("HSTS_MAX_AGE must be a non-negative duration, such as 8760h")
+        }
+        config.HSTSMaxAge = maxAge
+    }
+    for name, field := range map[string]*bool{
+        "HSTS_INCLUDE_SUBDOMAINS": &config.HSTSIncludeSubdomains,
+        "HSTS_PRELOAD":            &config.HSTSPreload,
+    } {
+        if value := os.Getenv(name); value != "" {
+            enabled, err := strconv.ParseBool(value)
+            if err != nil {
+                return config, fmt.Errorf("%s must be true or false", name)
+            }
+            *field = enabled
+        }
+    }
+    return config, config.Validate()
+}
+
+// referrerPolicies are the values of the Referrer-Policy header.
+var referrerPolicies = map[string]bool{
+    "": true, "no-referrer": true, "no-referrer-when-downgrade": true, "origin": true,
+    "origin-when-cross-origin": true, "same-origin": true, "strict-origin": true,
+    "strict-origin-when-cross-origin": true, "unsafe-url": true,
+}
+
+// Validate rejects header values browsers would ignore and HSTS preloading
+// the preload lists would refuse.
+func (c SecurityConfig) Validate() error {
+    if c.FrameOptions != "" && c.FrameOptions != "DENY" && c.FrameOptions != "SAMEORIGIN" {
+        return fmt.Errorf("security headers: frame options must be DENY or SAMEORIGIN")
+    }
+    if c.XSSProtection != "" && c.XSSProtection != "0" && c.XSSProtection != "1" && c.XSSProtection != "1; mode=block" {
+        return fmt.Errorf("security headers: invalid X-XSS-Protection %q", c.XSSProtection)
+    }
+    if !referrerPolicies[c.ReferrerPolicy] {
+        return fmt.Errorf("security headers: invalid referrer policy %q", c.ReferrerPolicy)
+    }
+    if c.HSTSPreload && (c.HSTSMaxAge < hstsPreloadMinAge || !c.HSTSIncludeSubdomains) {
+        return fmt.Errorf("security headers: HSTS preload needs a max-age of at least a year and subdomains included")
+    }
+    return nil
+}
+
+// SecurityHeaders sets the configured headers on every response. Browsers
+// ignore HSTS received over plain HTTP, so it is always sent, which also
+// covers TLS terminated by a proxy.
+func SecurityHeaders(config SecurityConfig) func(http.Handler) http.Handler {
+    hsts := ""
+    if config.HSTSMaxAge > 0 {
+        hsts = "max-age=" + strconv.FormatInt(int64(config.HSTSMaxAge/time.Second), 10)
+        if config.HSTSIncludeSubdomains {
+            hsts += "; includeSubDomains"
+        }
+        if config.HSTSPreload {
+            hsts += "; preload"
+        }
+    }
+    headers := map[string]string{
+        "X-Content-Type-Options":    "nosniff",
+        "Content-Security-Policy":   config.ContentSecurityPolicy,
+        "X-Frame-Options":           config.FrameOptions,
+        "X-XSS-Protection":          config.XSSProtection,
+        "Referrer-Policy":           config.ReferrerPolicy,
+        "Permissions-Policy":        config.PermissionsPolicy,
+        "Strict-Transport-Security": hsts,
+    }
+
+    return func(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            for name, value := range headers {
+                if value != "" {
+                    w.Header().Set(name, value)
+                }
+            }
+            next.ServeHTTP(w, r)
+        })
+    }
 }
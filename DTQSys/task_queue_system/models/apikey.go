@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// APIKey is a long-lived credential of a service account. Only a hash of
+// the secret is stored; the secret itself is shown once, when the key is
+// created.
+type APIKey struct {
+    ID      string    `json:"id"`
+    Account string    `json:"account"`
+    Org     string    `json:"org"`
+    Scopes  []string  `json:"scopes"`
+    Created time.Time `json:"created"`
+    // Expires is nil for keys that never expire.
+    Expires *time.Time `json:"expires,omitempty"`
+    Revoked bool       `json:"revoked"`
+    Hash    string     `json:"-"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// AuditEvent records one security or administrative action. Events are
+// only ever appended.
+type AuditEvent struct {
+    ID   string    `json:"id"`
+    Time time.Time `json:"time"`
+    // Actor is the user or service account that acted, or the username a
+    // login was attempted for; empty when unknown.
+    Actor  string `json:"actor"`
+    Org    string `json:"org"`
+    Action string `json:"action"`
+    // Target names what was acted on, such as id=<task ID>.
+    Target    string `json:"target,omitempty"`
+    IP        string `json:"ip"`
+    UserAgent string `json:"user_agent"`
+    // Result is success, denied or failure; Status is the HTTP status.
+    Result string `json:"result"`
+    Status int    `json:"status"`
+}
@@ -1,6 +1,48 @@
 package models
 
+import "time"
+
 type Credentials struct {
     Username string `json:"username" validate:"required,alphanum,min=3,max=30"`
-    Password string `json:"password" validate:"required,min=6"`
+    // Password strength is checked by auth.Policy when a password is set,
+    // not here, so login keeps accepting passwords set under older policies.
+    Password string `json:"password" validate:"required"`
+    // Org is only read on registration; see auth.RegisterUser.
+    Org string `json:"org,omitempty" validate:"omitempty,alphanum,min=2,max=50"`
+}
+
+type User struct {
+    Username string `json:"username"`
+    Role     string `json:"role"`
+    Org      string `json:"org"`
+    // Disabled users cannot log in, refresh tokens or use API keys.
+    Disabled bool `json:"disabled"`
+    // TOTPEnabled users complete password logins with a one-time code.
+    TOTPEnabled bool `json:"totp_enabled"`
+}
+
+// LoginRecord is what a password login checks besides the password itself.
+type LoginRecord struct {
+    // PasswordHash is empty for users who cannot log in with a password,
+    // such as service accounts and users created through OIDC.
+    PasswordHash string
+    // FailedLogins counts failed attempts since the last successful login.
+    FailedLogins    int
+    LastFailedLogin time.Time
+    Disabled        bool
+    TOTPEnabled     bool
+}
+
+// TOTP is a user's enrollment in two-factor authentication.
+type TOTP struct {
+    // Secret is the base32 shared secret. It is set when enrollment starts
+    // but only asked for once Enabled, after the user confirmed it with a
+    // code.
+    Secret  string
+    Enabled bool
+    // RecoveryCodes are SHA-256 hashes of the unused recovery codes.
+    RecoveryCodes []string
+    // LastStep is the time step of the last accepted code. Codes of that
+    // step or earlier are refused, so each code works once.
+    LastStep int64
 }
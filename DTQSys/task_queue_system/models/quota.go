@@ -0,0 +1,43 @@
+package models
+
+// Quota limits how much of the queue an organization, and each of its
+// members, may use. Zero means no limit.
+type Quota struct {
+    // MaxQueued caps the organization's pending tasks.
+    MaxQueued int `json:"max_queued" validate:"min=0"`
+    // MaxTasksPerMinute and MaxTasksPerHour cap submissions over the last
+    // minute and hour.
+    MaxTasksPerMinute int `json:"max_tasks_per_minute" validate:"min=0"`
+    MaxTasksPerHour   int `json:"max_tasks_per_hour" validate:"min=0"`
+    // MaxPayloadBytesPerDay caps the size of the data submitted over the
+    // last 24 hours.
+    MaxPayloadBytesPerDay int64 `json:"max_payload_bytes_per_day" validate:"min=0"`
+    // User applies to every user and service account of the organization
+    // on its own.
+    User UserQuota `json:"user"`
+}
+
+// UserQuota limits how much of the queue one member of an organization may
+// use. Zero means no limit.
+type UserQuota struct {
+    MaxQueued             int   `json:"max_queued" validate:"min=0"`
+    MaxTasksPerHour       int   `json:"max_tasks_per_hour" validate:"min=0"`
+    MaxPayloadBytesPerDay int64 `json:"max_payload_bytes_per_day" validate:"min=0"`
+}
+
+// QuotaUsage is what an organization or user has used of its quota.
+type QuotaUsage struct {
+    Queued              int   `json:"queued"`
+    TasksLastMinute     int   `json:"tasks_last_minute"`
+    TasksLastHour       int   `json:"tasks_last_hour"`
+    PayloadBytesLastDay int64 `json:"payload_bytes_last_day"`
+}
+
+// QuotaReport is a member's view of the organization's quota: its limits
+// and how much of them the organization and the member have used.
+type QuotaReport struct {
+    Org       string     `json:"org"`
+    Quota     Quota      `json:"quota"`
+    OrgUsage  QuotaUsage `json:"org_usage"`
+    UserUsage QuotaUsage `json:"user_usage"`
+}
@@ -4,9 +4,14 @@ import "time"
 
 type Task struct {
     ID       string    `json:"id"`
+    Type     string    `json:"type" validate:"omitempty,max=100"`
+    Owner    string    `json:"owner"`
+    Org      string    `json:"org"`
     Data     string    `json:"data" validate:"required"`
     Status   string    `json:"status"`
     Created  time.Time `json:"created"`
     Retries  int       `json:"retries"`
     Priority int       `json:"priority" validate:"required,min=1,max=3"`
+    // Receipt identifies the delivery of a dequeued task to its backend.
+    Receipt  string    `json:"-"`
 }
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// RefreshToken is the server-side record of an issued refresh token. All
+// tokens obtained from one login share a SessionID.
+type RefreshToken struct {
+    ID        string
+    SessionID string
+    Username  string
+    Expires   time.Time
+    // Used is set when the token is exchanged at /refresh; Revoked when its
+    // session is logged out or reuse of a used token is detected.
+    Used    bool
+    Revoked bool
+}
@@ -0,0 +1,206 @@
+// Package oidcmock is a minimal OpenID Connect provider for tests and local
+// development. It approves every authorization request for one configurable
+// identity, so the whole login flow runs without a real identity provider:
+//
+//     provider, err := oidcmock.NewServer("dtq", "secret", map[string]interface{}{
+//         "sub": "1234", "preferred_username": "alice", "groups": []string{"dtq-admins"},
+//     })
+//     defer provider.Close()
+//     config := auth.OIDCConfig{Issuer: provider.Issuer, ClientID: "dtq", ClientSecret: "secret", ...}
+package oidcmock
+
+import (
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/json"
+    "math/big"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "sync"
+    "time"
+
+    "github.com/golang-jwt/jwt/v5"
+    "github.com/google/uuid"
+)
+
+const keyID = "oidcmock"
+
+// Provider serves discovery, authorization, token and JWKS endpoints.
+type Provider struct {
+    Issuer       string
+    ClientID     string
+    ClientSecret string
+
+    mu     sync.Mutex
+    claims map[string]interface{}
+    codes  map[string]authRequest
+    key    *rsa.PrivateKey
+    server *httptest.Server
+}
+
+// authRequest is what the token endpoint checks a code against.
+type authRequest struct {
+    redirectURI string
+    challenge   string
+    nonce       string
+}
+
+// NewServer starts a provider on a local port. claims are copied into every
+// ID token and must include "sub".
+func NewServer(clientID, clientSecret string, claims map[string]interface{}) (*Provider, error) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        return nil, err
+    }
+    p := &Provider{
+        ClientID:     clientID,
+        ClientSecret: clientSecret,
+        claims:       claims,
+        codes:        make(map[string]authRequest),
+        key:          key,
+    }
+
+    mux := http.NewServeMux()
+    mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+    mux.HandleFunc("/authorize", p.authorize)
+    mux.HandleFunc("/token", p.token)
+    mux.HandleFunc("/jwks", p.jwks)
+    p.server = httptest.NewServer(mux)
+    p.Issuer = p.server.URL
+    return p, nil
+}
+
+// SetClaims replaces the identity returned by later logins.
+func (p *Provider) SetClaims(claims map[string]interface{}) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    p.claims = claims
+}
+
+func (p *Provider) Close() {
+    p.server.Close()
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "issuer":                                p.Issuer,
+        "authorization_endpoint":                p.Issuer + "/authorize",
+        "token_endpoint":                        p.Issuer + "/token",
+        "jwks_uri":                              p.Issuer + "/jwks",
+        "response_types_supported":              []string{"code"},
+        "subject_types_supported":               []string{"public"},
+        "id_token_signing_alg_values_supported": []string{"RS256"},
+        "code_challenge_methods_supported":      []string{"S256"},
+    })
+}
+
+// authorize approves the request at once and redirects back with a code.
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    redirectURI, err := url.Parse(query.Get("redirect_uri"))
+    if err != nil || query.Get("redirect_uri") == "" || query.Get("client_id") != p.ClientID {
+        http.Error(w, "unknown client or redirect URI", http.StatusBadRequest)
+        return
+    }
+    if query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+        http.Error(w, "only the authorization-code flow with PKCE (S256) is supported", http.StatusBadRequest)
+        return
+    }
+
+    code := uuid.New().String()
+    p.mu.Lock()
+    p.codes[code] = authRequest{
+        redirectURI: redirectURI.String(),
+        challenge:   query.Get("code_challenge"),
+        nonce:       query.Get("nonce"),
+    }
+    p.mu.Unlock()
+
+    params := redirectURI.Query()
+    params.Set("code", code)
+    params.Set("state", query.Get("state"))
+    redirectURI.RawQuery = params.Encode()
+    http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+// token redeems a code once, checking the client, redirect URI and PKCE
+// verifier, and returns a signed ID token.
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+        tokenError(w, "invalid_request")
+        return
+    }
+    clientID, clientSecret, ok := r.BasicAuth()
+    if ok {
+        clientID, _ = url.QueryUnescape(clientID)
+        clientSecret, _ = url.QueryUnescape(clientSecret)
+    } else {
+        clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+    }
+    if clientID != p.ClientID || clientSecret != p.ClientSecret {
+        tokenError(w, "invalid_client")
+        return
+    }
+
+    p.mu.Lock()
+    request, found := p.codes[r.PostForm.Get("code")]
+    delete(p.codes, r.PostForm.Get("code"))
+    claims := jwt.MapClaims{}
+    for name, value := range p.claims {
+        claims[name] = value
+    }
+    p.mu.Unlock()
+
+    verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+    if !found || request.redirectURI != r.PostForm.Get("redirect_uri") ||
+        base64.RawURLEncoding.EncodeToString(verifier[:]) != request.challenge {
+        tokenError(w, "invalid_grant")
+        return
+    }
+
+    now := time.Now()
+    claims["iss"] = p.Issuer
+    claims["aud"] = p.ClientID
+    claims["iat"] = now.Unix()
+    claims["exp"] = now.Add(5 * time.Minute).Unix()
+    if request.nonce != "" {
+        claims["nonce"] = request.nonce
+    }
+    token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+    token.Header["kid"] = keyID
+    idToken, err := token.SignedString(p.key)
+    if err != nil {
+        tokenError(w, "server_error")
+        return
+    }
+
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "access_token": uuid.New().String(),
+        "token_type":   "Bearer",
+        "expires_in":   300,
+        "id_token":     idToken,
+    })
+}
+
+func (p *Provider) jwks(w http.ResponseWriter, r *http.Request) {
+    b64 := base64.RawURLEncoding
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "keys": []map[string]string{{
+            "kty": "RSA",
+            "kid": keyID,
+            "use": "sig",
+            "alg": "RS256",
+            "n":   b64.EncodeToString(p.key.N.Bytes()),
+            "e":   b64.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+        }},
+    })
+}
+
+func tokenError(w http.ResponseWriter, code string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusBadRequest)
+    json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
@@ -0,0 +1,228 @@
+package queue
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strconv"
+    "sync"
+    "task_queue_system/models"
+    "time"
+)
+
+// DefaultLeaseTimeout is how long a task handed out by MemoryBackend or
+// PostgresBackend stays leased to its consumer before it is delivered again.
+const DefaultLeaseTimeout = time.Minute
+
+type lease struct {
+    task       models.Task
+    consumer   string
+    expires    time.Time
+    deliveries int
+}
+
+// MemoryBackend is an in-process Backend for tests and embedded use. It
+// mirrors the Streams backend: each organization's tasks are served by
+// priority, each delivery is leased to its consumer until acknowledged, and
+// leases that expire are handed out again ahead of new tasks of the same
+// priority, up to MaxDeliveries deliveries.
+type MemoryBackend struct {
+    LeaseTimeout  time.Duration
+    MaxDeliveries int
+
+    mu      sync.Mutex
+    queues  map[memoryQueue][]models.Task
+    leases  map[string]*lease
+    nextID  int
+    workers map[string]map[string]string
+    notify  chan struct{}
+}
+
+// memoryQueue names one organization's queue for one priority.
+type memoryQueue struct {
+    org      string
+    priority int
+}
+
+func NewMemoryBackend() *MemoryBackend {
+    return &MemoryBackend{
+        LeaseTimeout:  DefaultLeaseTimeout,
+        MaxDeliveries: DefaultMaxDeliveries,
+        queues:        make(map[memoryQueue][]models.Task),
+        leases:        make(map[string]*lease),
+        workers:       make(map[string]map[string]string),
+        notify:        make(chan struct{}, 1),
+    }
+}
+
+// memoryPriority folds out-of-range priorities into low, like queueName.
+func memoryPriority(priority int) int {
+    if priority == 3 || priority == 2 {
+        return priority
+    }
+    return 1
+}
+
+func (b *MemoryBackend) Push(ctx context.Context, task models.Task) error {
+    b.mu.Lock()
+    key := memoryQueue{org: task.Org, priority: memoryPriority(task.Priority)}
+    task.Receipt = ""
+    b.queues[key] = append(b.queues[key], task)
+    b.mu.Unlock()
+
+    // Wake one idle worker without blocking when nobody is waiting
+    select {
+    case b.notify <- struct{}{}:
+    default:
+    }
+    return nil
+}
+
+func (b *MemoryBackend) Pop(ctx context.Context, org, consumer string) (*models.Task, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    now := time.Now()
+    for _, priority := range []int{3, 2, 1} {
+        // Reclaim the oldest expired lease of this priority first
+        var expired *lease
+        for _, l := range b.leases {
+            if l.task.Org != org || memoryPriority(l.task.Priority) != priority || now.Before(l.expires) {
+                continue
+            }
+            if expired == nil || l.task.Receipt < expired.task.Receipt {
+                expired = l
+            }
+        }
+        if expired != nil {
+            expired.deliveries++
+            if b.MaxDeliveries > 0 && expired.deliveries > b.MaxDeliveries {
+                delete(b.leases, expired.task.Receipt)
+                task := expired.task
+                return nil, &DeadLetterError{Task: &task, Reason: fmt.Sprintf("delivered %d times", expired.deliveries)}
+            }
+            // A fresh receipt keeps the previous consumer from acking or
+            // extending the new delivery
+            delete(b.leases, expired.task.Receipt)
+            expired.task.Receipt = b.receipt()
+            expired.consumer = consumer
+            expired.expires = now.Add(b.LeaseTimeout)
+            b.leases[expired.task.Receipt] = expired
+            task := expired.task
+            return &task, nil
+        }
+
+        key := memoryQueue{org: org, priority: priority}
+        if len(b.queues[key]) == 0 {
+            continue
+        }
+        task := b.queues[key][0]
+        b.queues[key] = b.queues[key][1:]
+
+        task.Receipt = b.receipt()
+        b.leases[task.Receipt] = &lease{task: task, consumer: consumer, expires: now.Add(b.LeaseTimeout), deliveries: 1}
+        return &task, nil
+    }
+    return nil, ErrEmpty
+}
+
+// receipt returns the receipt of a new delivery. Receipts are zero-padded
+// so they sort in delivery order. b.mu must be held.
+func (b *MemoryBackend) receipt() string {
+    b.nextID++
+    return strconv.Itoa(1e9 + b.nextID)
+}
+
+// Ack releases the consumer's lease on the task. A consumer whose lease was
+// reclaimed by another no longer holds the task and cannot ack it.
+func (b *MemoryBackend) Ack(ctx context.Context, consumer string, task *models.Task) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if l, exists := b.leases[task.Receipt]; !exists || l.task.ID != task.ID || l.consumer != consumer {
+        return errors.New("task has no active lease")
+    }
+    delete(b.leases, task.Receipt)
+    return nil
+}
+
+// Extend renews the consumer's lease on the task.
+func (b *MemoryBackend) Extend(ctx context.Context, consumer string, task *models.Task) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    l, exists := b.leases[task.Receipt]
+    if !exists || l.task.ID != task.ID || l.consumer != consumer {
+        return ErrLeaseLost
+    }
+    l.expires = time.Now().Add(b.LeaseTimeout)
+    return nil
+}
+
+// Pending returns the number of unacknowledged deliveries held by each of
+// the organization's consumers.
+func (b *MemoryBackend) Pending(ctx context.Context, org string) (map[string]int64, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    pending := make(map[string]int64)
+    for _, l := range b.leases {
+        if l.task.Org == org {
+            pending[l.consumer]++
+        }
+    }
+    return pending, nil
+}
+
+func (b *MemoryBackend) Wait(ctx context.Context, timeout time.Duration) {
+    select {
+    case <-b.notify:
+    case <-ctx.Done():
+    case <-time.After(timeout):
+    }
+}
+
+func (b *MemoryBackend) RegisterWorker(ctx context.Context, org, id string) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.workers[org] == nil {
+        b.workers[org] = make(map[string]string)
+    }
+    b.workers[org][id] = "active"
+    return nil
+}
+
+func (b *MemoryBackend) DeregisterWorker(ctx context.Context, org, id string) error {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    delete(b.workers[org], id)
+    return nil
+}
+
+func (b *MemoryBackend) Workers(ctx context.Context, org string) (map[string]string, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    workers := make(map[string]string, len(b.workers[org]))
+    for id, status := range b.workers[org] {
+        workers[id] = status
+    }
+    return workers, nil
+}
+
+func (b *MemoryBackend) Depths(ctx context.Context, org string) (map[string]int64, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    depths := make(map[string]int64)
+    for _, priority := range []int{3, 2, 1} {
+        depths[PriorityName(priority)] = int64(len(b.queues[memoryQueue{org: org, priority: priority}]))
+    }
+    return depths, nil
+}
+
+func (b *MemoryBackend) Close() error {
+    return nil
+}
@@ -0,0 +1,239 @@
+package queue
+
+import (
+    "context"
+    "database/sql"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strconv"
+    "sync"
+    "task_queue_system/models"
+    "time"
+
+    "github.com/lib/pq"
+)
+
+// notifyChannel is the LISTEN/NOTIFY channel used to wake idle workers.
+const notifyChannel = "task_queue"
+
+// PostgresBackend keeps queued tasks in the task_queue table so deployments
+// without Redis can still run workers. Concurrent workers claim rows with
+// FOR UPDATE SKIP LOCKED and never block on each other. A claimed row is
+// leased to its consumer for LeaseTimeout and deleted when acknowledged;
+// rows whose lease expired are claimed again, up to MaxDeliveries times.
+type PostgresBackend struct {
+    LeaseTimeout  time.Duration
+    MaxDeliveries int
+
+    db       *sql.DB
+    listener *pq.Listener
+
+    // wake is closed and replaced on every notification
+    mu   sync.Mutex
+    wake chan struct{}
+}
+
+func NewPostgresBackend(db *sql.DB, connStr string) (*PostgresBackend, error) {
+    listener := pq.NewListener(connStr, 10*time.Second, time.Minute, nil)
+    if err := listener.Listen(notifyChannel); err != nil {
+        listener.Close()
+        return nil, err
+    }
+    b := &PostgresBackend{
+        LeaseTimeout:  DefaultLeaseTimeout,
+        MaxDeliveries: DefaultMaxDeliveries,
+        db:            db,
+        listener:      listener,
+        wake:          make(chan struct{}),
+    }
+    go b.broadcast()
+    return b, nil
+}
+
+// broadcast wakes every waiting worker on each notification until the
+// listener is closed. Workers of all organizations share the channel, so
+// waking only one could leave the pushed task to the wrong organization's
+// worker. A reconnect, which may have lost notifications, wakes them too.
+func (b *PostgresBackend) broadcast() {
+    for range b.listener.NotificationChannel() {
+        b.mu.Lock()
+        close(b.wake)
+        b.wake = make(chan struct{})
+        b.mu.Unlock()
+    }
+}
+
+func (b *PostgresBackend) Push(ctx context.Context, task models.Task) error {
+    data, err := json.Marshal(task)
+    if err != nil {
+        return err
+    }
+
+    sqlStatement := `
+        INSERT INTO task_queue (task_id, org, priority, payload)
+        VALUES ($1, $2, $3, $4)`
+    if _, err := b.db.ExecContext(ctx, sqlStatement, task.ID, task.Org, task.Priority, data); err != nil {
+        return err
+    }
+
+    _, err = b.db.ExecContext(ctx, "SELECT pg_notify($1, $2)", notifyChannel, task.ID)
+    return err
+}
+
+// Pop leases the organization's next row to the consumer. Rows are served
+// by priority and then in queue order, so a row whose lease expired is
+// claimed again ahead of newer rows of the same priority. The receipt is
+// the row's ID.
+func (b *PostgresBackend) Pop(ctx context.Context, org, consumer string) (*models.Task, error) {
+    sqlStatement := `
+        UPDATE task_queue
+        SET leased_by = $2,
+            lease_until = NOW() + $3 * INTERVAL '1 millisecond',
+            deliveries = deliveries + 1
+        WHERE id = (
+            SELECT id FROM task_queue
+            WHERE org = $1 AND (lease_until IS NULL OR lease_until < NOW())
+            ORDER BY priority DESC, id
+            LIMIT 1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING id, payload, deliveries`
+    var id int64
+    var data []byte
+    var deliveries int
+    err := b.db.QueryRowContext(ctx, sqlStatement, org, consumer, b.LeaseTimeout.Milliseconds()).Scan(&id, &data, &deliveries)
+    if err == sql.ErrNoRows {
+        return nil, ErrEmpty
+    } else if err != nil {
+        return nil, err
+    }
+
+    // Give up on rows that cannot be decoded or keep being abandoned, so
+    // they cannot circulate among the workers forever
+    var task models.Task
+    if err := json.Unmarshal(data, &task); err != nil {
+        return nil, b.deadLetter(ctx, id, nil, err.Error())
+    }
+    if b.MaxDeliveries > 0 && deliveries > b.MaxDeliveries {
+        return nil, b.deadLetter(ctx, id, &task, fmt.Sprintf("delivered %d times", deliveries))
+    }
+    task.Receipt = strconv.FormatInt(id, 10)
+    return &task, nil
+}
+
+// deadLetter deletes the row and returns the DeadLetterError for Pop.
+func (b *PostgresBackend) deadLetter(ctx context.Context, id int64, task *models.Task, reason string) error {
+    if _, err := b.db.ExecContext(ctx, "DELETE FROM task_queue WHERE id = $1", id); err != nil {
+        return err
+    }
+    return &DeadLetterError{Task: task, Reason: reason}
+}
+
+// Ack deletes the row, provided the consumer still holds its lease.
+func (b *PostgresBackend) Ack(ctx context.Context, consumer string, task *models.Task) error {
+    sqlStatement := `
+        DELETE FROM task_queue
+        WHERE id = $1 AND task_id = $2 AND org = $3 AND leased_by = $4`
+    result, err := b.db.ExecContext(ctx, sqlStatement, task.Receipt, task.ID, task.Org, consumer)
+    if err != nil {
+        return err
+    }
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return errors.New("task has no active lease")
+    }
+    return nil
+}
+
+// Extend renews the consumer's lease on the row.
+func (b *PostgresBackend) Extend(ctx context.Context, consumer string, task *models.Task) error {
+    sqlStatement := `
+        UPDATE task_queue
+        SET lease_until = NOW() + $5 * INTERVAL '1 millisecond'
+        WHERE id = $1 AND task_id = $2 AND org = $3 AND leased_by = $4`
+    result, err := b.db.ExecContext(ctx, sqlStatement, task.Receipt, task.ID, task.Org, consumer, b.LeaseTimeout.Milliseconds())
+    if err != nil {
+        return err
+    }
+    n, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if n == 0 {
+        return ErrLeaseLost
+    }
+    return nil
+}
+
+// Wait returns as soon as a NOTIFY arrives. Every notification wakes all
+// waiting workers; those of other organizations find nothing and wait again.
+func (b *PostgresBackend) Wait(ctx context.Context, timeout time.Duration) {
+    b.mu.Lock()
+    wake := b.wake
+    b.mu.Unlock()
+
+    select {
+    case <-wake:
+    case <-ctx.Done():
+    case <-time.After(timeout):
+    }
+}
+
+func (b *PostgresBackend) RegisterWorker(ctx context.Context, org, id string) error {
+    sqlStatement := `
+        INSERT INTO workers (org, worker_id, status, last_seen)
+        VALUES ($1, $2, 'active', NOW())
+        ON CONFLICT (org, worker_id) DO UPDATE SET status = 'active', last_seen = NOW()`
+    _, err := b.db.ExecContext(ctx, sqlStatement, org, id)
+    return err
+}
+
+func (b *PostgresBackend) DeregisterWorker(ctx context.Context, org, id string) error {
+    _, err := b.db.ExecContext(ctx, "DELETE FROM workers WHERE org = $1 AND worker_id = $2", org, id)
+    return err
+}
+
+func (b *PostgresBackend) Workers(ctx context.Context, org string) (map[string]string, error) {
+    rows, err := b.db.QueryContext(ctx, "SELECT worker_id, status FROM workers WHERE org = $1", org)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    workers := make(map[string]string)
+    for rows.Next() {
+        var id, status string
+        if err := rows.Scan(&id, &status); err != nil {
+            return nil, err
+        }
+        workers[id] = status
+    }
+    return workers, rows.Err()
+}
+
+func (b *PostgresBackend) Depths(ctx context.Context, org string) (map[string]int64, error) {
+    depths := map[string]int64{"high": 0, "medium": 0, "low": 0}
+    rows, err := b.db.QueryContext(ctx, "SELECT priority, COUNT(*) FROM task_queue WHERE org = $1 GROUP BY priority", org)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    for rows.Next() {
+        var priority int
+        var n int64
+        if err := rows.Scan(&priority, &n); err != nil {
+            return nil, err
+        }
+        depths[PriorityName(priority)] += n
+    }
+    return depths, rows.Err()
+}
+
+func (b *PostgresBackend) Close() error {
+    return b.listener.Close()
+}
@@ -2,67 +2,290 @@ package queue
 
 import (
     "context"
-    "database/sql"
-    "encoding/json"
+    "errors"
+    "fmt"
     "task_queue_system/db"
     "task_queue_system/models"
+    "time"
 
-    "github.com/go-redis/redis/v8"
+    "github.com/google/uuid"
 )
 
 var ctx = context.Background()
 
+// ErrEmpty is returned by a backend when there is no task to hand out.
+var ErrEmpty = errors.New("queue is empty")
+
+// Backend stores queued tasks and hands them out to workers in priority order.
+// Every organization has its own queues and worker registry: a task is
+// pushed to the queues of task.Org and only popped by that org's workers.
+type Backend interface {
+    Push(ctx context.Context, task models.Task) error
+    // Pop hands the organization's next task to the named consumer. Backends
+    // that track deliveries keep it pending until Ack is called.
+    Pop(ctx context.Context, org, consumer string) (*models.Task, error)
+    Ack(ctx context.Context, consumer string, task *models.Task) error
+    // Extend renews the consumer's hold on a task it is still processing, so
+    // the task is not delivered to another consumer meanwhile. Backends that
+    // do not track deliveries do nothing.
+    Extend(ctx context.Context, consumer string, task *models.Task) error
+    // Wait blocks until new work may be available or the timeout expires.
+    Wait(ctx context.Context, timeout time.Duration)
+
+    RegisterWorker(ctx context.Context, org, id string) error
+    DeregisterWorker(ctx context.Context, org, id string) error
+    Workers(ctx context.Context, org string) (map[string]string, error)
+
+    // Depths returns the number of queued tasks per priority name.
+    Depths(ctx context.Context, org string) (map[string]int64, error)
+
+    Close() error
+}
+
+// ErrLeaseLost is returned by Extend when the consumer no longer holds the
+// task, e.g. because it was reclaimed after its lease expired.
+var ErrLeaseLost = errors.New("task is no longer held by the consumer")
+
+// DeadLetterError is returned by Pop for a delivery the backend gave up on:
+// one that was delivered too many times or cannot be decoded. The backend
+// has already removed it from the queue. Task is nil when the payload could
+// not be decoded.
+type DeadLetterError struct {
+    Task   *models.Task
+    Reason string
+}
+
+func (e *DeadLetterError) Error() string {
+    return "dead-lettered delivery: " + e.Reason
+}
+
+// ErrInvalidTransition is returned when a task cannot be cancelled or retried
+// from its current status.
+var ErrInvalidTransition = errors.New("task status does not allow this operation")
+
+// ErrTaskIDTaken is returned by Submit when the task's ID belongs to a task
+// of another organization.
+var ErrTaskIDTaken = errors.New("task ID is taken by another organization")
+
+// PriorityName maps a task priority to the name used for its queue.
+func PriorityName(priority int) string {
+    switch priority {
+    case 3:
+        return "high"
+    case 2:
+        return "medium"
+    default:
+        return "low"
+    }
+}
+
+// tenantKey namespaces a backend key by organization. The default
+// organization keeps the plain names used before organizations existed, so
+// tasks queued by an older deployment are still served.
+func tenantKey(org, name string) string {
+    if org == "" || org == db.DefaultOrg {
+        return name
+    }
+    return "org:" + org + ":" + name
+}
+
 type Queue struct {
-    Client *redis.Client
-    db     *sql.DB
+    Backend Backend
+    // DefaultQuota applies to organizations without a quota of their own.
+    DefaultQuota models.Quota
+    // MaxDataBytes caps the data of submitted tasks. Zero is no limit.
+    MaxDataBytes int
+    // HeartbeatInterval is how often workers extend their hold on the task
+    // they are processing. It must be well below the backend's lease timeout
+    // or claim idle time.
+    HeartbeatInterval time.Duration
+    store             db.Store
+}
+
+// DefaultMaxDataBytes is the MaxDataBytes of new queues.
+const DefaultMaxDataBytes = 1 << 20
+
+// DefaultHeartbeatInterval is the HeartbeatInterval of new queues.
+const DefaultHeartbeatInterval = 15 * time.Second
+
+func NewQueue(backend Backend, store db.Store) *Queue {
+    return &Queue{
+        Backend:           backend,
+        MaxDataBytes:      DefaultMaxDataBytes,
+        HeartbeatInterval: DefaultHeartbeatInterval,
+        store:             store,
+    }
+}
+
+// DataSizeError is returned by Submit for a task whose data is larger than
+// MaxDataBytes.
+type DataSizeError struct {
+    Size int `json:"size"`
+    Max  int `json:"max"`
+}
+
+func (e *DataSizeError) Error() string {
+    return fmt.Sprintf("task data is %d bytes, the limit is %d", e.Size, e.Max)
 }
 
-func NewQueue(redisAddr string, db *sql.DB) *Queue {
-    client := redis.NewClient(&redis.Options{
-        Addr: redisAddr,
-    })
-    return &Queue{Client: client, db: db}
+// DefaultTaskType is assigned to submitted tasks that do not name a type.
+const DefaultTaskType = "default"
+
+// Submit stamps a new task with its ID, initial status and defaults, then
+// enqueues it if its data is within MaxDataBytes and its organization and
+// owner are within quota. The returned task is the one that was stored. If
+// a task with the ID was stored before, Submit returns that task with
+// created false and does not enqueue it again. A task the backend fails to
+// take is not kept, so the submission can be retried.
+func (q *Queue) Submit(ctx context.Context, task models.Task) (submitted models.Task, created bool, err error) {
+    if q.MaxDataBytes > 0 && len(task.Data) > q.MaxDataBytes {
+        return task, false, &DataSizeError{Size: len(task.Data), Max: q.MaxDataBytes}
+    }
+    if task.ID == "" {
+        task.ID = uuid.New().String()
+    }
+    task.Status = "pending"
+    task.Created = time.Now()
+    task.Retries = 0
+
+    // Set default priority and type if not provided
+    if task.Priority == 0 {
+        task.Priority = 1
+    }
+    if task.Type == "" {
+        task.Type = DefaultTaskType
+    }
+    if task.Org == "" {
+        task.Org = db.DefaultOrg
+    }
+
+    inserted, err := q.insertWithinQuota(task)
+    if err != nil {
+        return task, false, err
+    }
+    if !inserted {
+        existing, err := q.store.GetTask(task.ID)
+        if err != nil {
+            return task, false, err
+        }
+        if existing.Org != task.Org {
+            return task, false, ErrTaskIDTaken
+        }
+        return *existing, false, nil
+    }
+    if err := q.Backend.Push(ctx, task); err != nil {
+        // A row left behind would make a retry with the same ID look
+        // accepted although no worker ever receives the task
+        if delErr := q.store.DeleteTask(task.ID); delErr != nil {
+            return task, false, fmt.Errorf("%v, and removing the task failed: %v", err, delErr)
+        }
+        return task, false, err
+    }
+    return task, true, nil
 }
 
-func (q *Queue) Enqueue(task models.Task) error {
+// Enqueue stores the task and pushes it to the backend as is. Workers use it
+// directly to re-enqueue failed attempts.
+func (q *Queue) Enqueue(ctx context.Context, task models.Task) error {
+    // Tasks queued before organizations existed carry no org
+    if task.Org == "" {
+        task.Org = db.DefaultOrg
+    }
+
     // Save task to the database
-    if err := db.InsertTask(q.db, task); err != nil {
+    if err := q.store.InsertTask(task); err != nil {
         return err
     }
 
-    // Enqueue the task in Redis
-    data, err := json.Marshal(task)
+    return q.Backend.Push(ctx, task)
+}
+
+// Cancel marks a pending task as cancelled. Backends cannot remove a task
+// from the middle of a queue, so workers skip it when it is delivered.
+func (q *Queue) Cancel(ctx context.Context, taskID string) error {
+    if _, err := q.store.GetTask(taskID); err != nil {
+        return err
+    }
+    ok, err := q.store.TransitionTaskStatus(taskID, []string{"pending"}, "cancelled")
     if err != nil {
         return err
     }
+    if !ok {
+        return ErrInvalidTransition
+    }
+    return nil
+}
 
-    var queueName string
-    switch task.Priority {
-    case 3:
-        queueName = "high_task_queue"
-    case 2:
-        queueName = "medium_task_queue"
-    default:
-        queueName = "low_task_queue"
+// Retry puts a failed task back on the queue with a fresh retry budget.
+// Cancelled tasks may still sit in the backend, so they cannot be retried.
+func (q *Queue) Retry(ctx context.Context, taskID string) (*models.Task, error) {
+    task, err := q.store.GetTask(taskID)
+    if err != nil {
+        return nil, err
+    }
+    ok, err := q.store.TransitionTaskStatus(taskID, []string{"failed"}, "pending")
+    if err != nil {
+        return nil, err
     }
+    if !ok {
+        return nil, ErrInvalidTransition
+    }
+
+    task.Status = "pending"
+    task.Retries = 0
+    return task, q.Backend.Push(ctx, *task)
+}
 
-    return q.Client.RPush(ctx, queueName, data).Err()
+func (q *Queue) Depths(ctx context.Context, org string) (map[string]int64, error) {
+    return q.Backend.Depths(ctx, org)
 }
 
-func (q *Queue) Dequeue() (*models.Task, error) {
-    var task models.Task
-    for _, queueName := range []string{"high_task_queue", "medium_task_queue", "low_task_queue"} {
-        result, err := q.Client.LPop(ctx, queueName).Result()
-        if err == redis.Nil {
+// Dequeue hands the consumer the next task of the organization. Tasks the
+// backend dead-letters on the way are marked failed and skipped.
+func (q *Queue) Dequeue(org, consumer string) (*models.Task, error) {
+    for {
+        task, err := q.Backend.Pop(ctx, org, consumer)
+        deadLetter, ok := err.(*DeadLetterError)
+        if !ok {
+            return task, err
+        }
+        if deadLetter.Task == nil {
             continue
-        } else if err != nil {
-            return nil, err
         }
-
-        if err := json.Unmarshal([]byte(result), &task); err != nil {
+        if _, err := q.store.TransitionTaskStatus(deadLetter.Task.ID, []string{"pending", "running"}, "failed"); err != nil {
             return nil, err
         }
-        return &task, nil
     }
-    return nil, redis.Nil
+}
+
+// Ack marks a dequeued task as handled, whatever its outcome.
+func (q *Queue) Ack(consumer string, task *models.Task) error {
+    return q.Backend.Ack(ctx, consumer, task)
+}
+
+// Extend renews the consumer's hold on a task it is still processing.
+func (q *Queue) Extend(consumer string, task *models.Task) error {
+    return q.Backend.Extend(ctx, consumer, task)
+}
+
+// Wait blocks an idle worker until the backend signals new work or the
+// timeout expires.
+func (q *Queue) Wait(timeout time.Duration) {
+    q.Backend.Wait(ctx, timeout)
+}
+
+func (q *Queue) RegisterWorker(org, id string) error {
+    return q.Backend.RegisterWorker(ctx, org, id)
+}
+
+func (q *Queue) DeregisterWorker(org, id string) error {
+    return q.Backend.DeregisterWorker(ctx, org, id)
+}
+
+func (q *Queue) Workers(org string) (map[string]string, error) {
+    return q.Backend.Workers(ctx, org)
+}
+
+func (q *Queue) Close() error {
+    return q.Backend.Close()
 }
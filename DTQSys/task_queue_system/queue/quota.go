@@ -0,0 +1,118 @@
+package queue
+
+import (
+    "fmt"
+    "task_queue_system/db"
+    "task_queue_system/models"
+    "time"
+)
+
+// Quota scopes: the whole organization, or the member submitting the task.
+const (
+    QuotaScopeOrg  = "org"
+    QuotaScopeUser = "user"
+)
+
+// QuotaError is returned by Submit when the task would take its
+// organization or owner over a quota. Limit is the name of the exceeded
+// field of models.Quota or models.UserQuota, such as "max_queued".
+type QuotaError struct {
+    Scope string `json:"scope"`
+    Limit string `json:"limit"`
+    Max   int64  `json:"max"`
+    Used  int64  `json:"used"`
+}
+
+// quotaDescriptions phrase the limits for error messages.
+var quotaDescriptions = map[string]string{
+    "max_queued":                "queued tasks",
+    "max_tasks_per_minute":      "tasks per minute",
+    "max_tasks_per_hour":        "tasks per hour",
+    "max_payload_bytes_per_day": "payload bytes per day",
+}
+
+func (e *QuotaError) Error() string {
+    who := "organization"
+    if e.Scope == QuotaScopeUser {
+        who = "user"
+    }
+    return fmt.Sprintf("%s has reached its limit of %d %s", who, e.Max, quotaDescriptions[e.Limit])
+}
+
+// Quota returns the organization's quota, or DefaultQuota when none is set.
+func (q *Queue) Quota(org string) (models.Quota, error) {
+    quota, err := q.store.OrgQuota(org)
+    if err == db.ErrNotFound {
+        return q.DefaultQuota, nil
+    } else if err != nil {
+        return models.Quota{}, err
+    }
+    return *quota, nil
+}
+
+// Usage reports the quota of the organization and its use by the
+// organization and the owner.
+func (q *Queue) Usage(org, owner string) (*models.QuotaReport, error) {
+    quota, err := q.Quota(org)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    orgUsage, err := q.store.QuotaUsage(org, "", now)
+    if err != nil {
+        return nil, err
+    }
+    userUsage, err := q.store.QuotaUsage(org, owner, now)
+    if err != nil {
+        return nil, err
+    }
+    return &models.QuotaReport{Org: org, Quota: quota, OrgUsage: *orgUsage, UserUsage: *userUsage}, nil
+}
+
+// insertWithinQuota stores the new task if it keeps its organization and
+// owner within quota, and reports false if a task with its ID was already
+// stored. The store checks and inserts atomically, so the limits hold across
+// API instances and concurrent submissions.
+func (q *Queue) insertWithinQuota(task models.Task) (bool, error) {
+    quota, err := q.Quota(task.Org)
+    if err != nil {
+        return false, err
+    }
+    size := int64(len(task.Data))
+
+    return q.store.InsertTaskWithinQuota(task, func(org, user *models.QuotaUsage) error {
+        if err := exceeded(QuotaScopeOrg, "max_queued", int64(quota.MaxQueued), int64(org.Queued), 1); err != nil {
+            return err
+        }
+        if err := exceeded(QuotaScopeOrg, "max_tasks_per_minute", int64(quota.MaxTasksPerMinute), int64(org.TasksLastMinute), 1); err != nil {
+            return err
+        }
+        if err := exceeded(QuotaScopeOrg, "max_tasks_per_hour", int64(quota.MaxTasksPerHour), int64(org.TasksLastHour), 1); err != nil {
+            return err
+        }
+        if err := exceeded(QuotaScopeOrg, "max_payload_bytes_per_day", quota.MaxPayloadBytesPerDay, org.PayloadBytesLastDay, size); err != nil {
+            return err
+        }
+        // Tasks submitted on behalf of no one only count for the
+        // organization
+        if task.Owner == "" {
+            return nil
+        }
+        if err := exceeded(QuotaScopeUser, "max_queued", int64(quota.User.MaxQueued), int64(user.Queued), 1); err != nil {
+            return err
+        }
+        if err := exceeded(QuotaScopeUser, "max_tasks_per_hour", int64(quota.User.MaxTasksPerHour), int64(user.TasksLastHour), 1); err != nil {
+            return err
+        }
+        return exceeded(QuotaScopeUser, "max_payload_bytes_per_day", quota.User.MaxPayloadBytesPerDay, user.PayloadBytesLastDay, size)
+    })
+}
+
+// exceeded returns a QuotaError if adding to used goes over max. A max of
+// zero is no limit.
+func exceeded(scope, limit string, max, used, adding int64) error {
+    if max > 0 && used+adding > max {
+        return &QuotaError{Scope: scope, Limit: limit, Max: max, Used: used}
+    }
+    return nil
+}
@@ -0,0 +1,104 @@
+package queue
+
+import (
+    "context"
+    "encoding/json"
+    "task_queue_system/models"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+)
+
+// RedisBackend keeps one Redis list per organization and priority level.
+type RedisBackend struct {
+    Client *redis.Client
+}
+
+func NewRedisBackend(redisAddr string) *RedisBackend {
+    client := redis.NewClient(&redis.Options{
+        Addr: redisAddr,
+    })
+    return &RedisBackend{Client: client}
+}
+
+func queueName(org string, priority int) string {
+    return tenantKey(org, PriorityName(priority)+"_task_queue")
+}
+
+func workersKey(org string) string {
+    return tenantKey(org, "workers")
+}
+
+func (b *RedisBackend) Push(ctx context.Context, task models.Task) error {
+    data, err := json.Marshal(task)
+    if err != nil {
+        return err
+    }
+
+    return b.Client.RPush(ctx, queueName(task.Org, task.Priority), data).Err()
+}
+
+func (b *RedisBackend) Pop(ctx context.Context, org, consumer string) (*models.Task, error) {
+    var task models.Task
+    for _, priority := range []int{3, 2, 1} {
+        result, err := b.Client.LPop(ctx, queueName(org, priority)).Result()
+        if err == redis.Nil {
+            continue
+        } else if err != nil {
+            return nil, err
+        }
+
+        if err := json.Unmarshal([]byte(result), &task); err != nil {
+            return nil, err
+        }
+        return &task, nil
+    }
+    return nil, ErrEmpty
+}
+
+// Ack is a no-op: LPOP removes the task from Redis on delivery.
+func (b *RedisBackend) Ack(ctx context.Context, consumer string, task *models.Task) error {
+    return nil
+}
+
+// Extend is a no-op: tasks popped from a list are not held by anyone.
+func (b *RedisBackend) Extend(ctx context.Context, consumer string, task *models.Task) error {
+    return nil
+}
+
+// Wait polls: Redis lists have no wake-up signal we can share across
+// priorities, so idle workers simply sleep.
+func (b *RedisBackend) Wait(ctx context.Context, timeout time.Duration) {
+    select {
+    case <-ctx.Done():
+    case <-time.After(timeout):
+    }
+}
+
+func (b *RedisBackend) RegisterWorker(ctx context.Context, org, id string) error {
+    return b.Client.HSet(ctx, workersKey(org), id, "active").Err()
+}
+
+func (b *RedisBackend) DeregisterWorker(ctx context.Context, org, id string) error {
+    return b.Client.HDel(ctx, workersKey(org), id).Err()
+}
+
+func (b *RedisBackend) Workers(ctx context.Context, org string) (map[string]string, error) {
+    return b.Client.HGetAll(ctx, workersKey(org)).Result()
+}
+
+func (b *RedisBackend) Depths(ctx context.Context, org string) (map[string]int64, error) {
+    depths := make(map[string]int64)
+    for _, priority := range []int{3, 2, 1} {
+        n, err := b.Client.LLen(ctx, queueName(org, priority)).Result()
+        if err != nil {
+            return nil, err
+        }
+        depths[PriorityName(priority)] = n
+    }
+    return depths, nil
+}
+
+func (b *RedisBackend) Close() error {
+    return b.Client.Close()
+}
@@ -0,0 +1,333 @@
+package queue
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "strings"
+    "sync"
+    "task_queue_system/models"
+    "time"
+
+    "github.com/go-redis/redis/v8"
+)
+
+// streamGroup is the consumer group shared by all workers.
+const streamGroup = "task_workers"
+
+// DefaultClaimIdle is how long a delivered message may stay unacknowledged
+// before another worker reclaims it.
+const DefaultClaimIdle = time.Minute
+
+// DefaultMaxDeliveries is how many times a message is delivered before it
+// is moved to the dead-letter stream.
+const DefaultMaxDeliveries = 5
+
+// StreamsBackend keeps one Redis stream per organization and priority level
+// and delivers tasks through a consumer group. Every worker reads as its own
+// consumer, so Redis tracks which worker holds which unacknowledged task,
+// and messages left pending by a crashed worker are reclaimed once they have
+// been idle for ClaimIdle. Workers call Extend to keep the messages they are
+// still processing from going idle. A message delivered more than
+// MaxDeliveries times, or one that cannot be decoded, is moved to the
+// stream's "_dead" stream instead of being delivered again.
+type StreamsBackend struct {
+    *RedisBackend
+    ClaimIdle     time.Duration
+    MaxDeliveries int
+
+    // groups records the streams known to have the consumer group
+    groups sync.Map
+}
+
+func NewStreamsBackend(redisAddr string, claimIdle time.Duration) (*StreamsBackend, error) {
+    b := &StreamsBackend{
+        RedisBackend:  NewRedisBackend(redisAddr),
+        ClaimIdle:     claimIdle,
+        MaxDeliveries: DefaultMaxDeliveries,
+    }
+
+    // Create the default organization's groups up front so a bad Redis
+    // address fails at startup
+    for _, priority := range []int{3, 2, 1} {
+        if err := b.ensureGroup(ctx, streamName("", priority)); err != nil {
+            b.Client.Close()
+            return nil, err
+        }
+    }
+    return b, nil
+}
+
+func streamName(org string, priority int) string {
+    return tenantKey(org, PriorityName(priority)+"_task_stream")
+}
+
+// deadLetterStream names the stream that keeps the messages given up on.
+func deadLetterStream(stream string) string {
+    return stream + "_dead"
+}
+
+// ensureGroup creates the consumer group on a stream the first time this
+// process uses it, ignoring groups that already exist from a previous run.
+// Organizations appear at runtime, so their groups are created lazily.
+func (b *StreamsBackend) ensureGroup(ctx context.Context, stream string) error {
+    if _, ok := b.groups.Load(stream); ok {
+        return nil
+    }
+    err := b.Client.XGroupCreateMkStream(ctx, stream, streamGroup, "0").Err()
+    if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+        return err
+    }
+    b.groups.Store(stream, true)
+    return nil
+}
+
+func (b *StreamsBackend) Push(ctx context.Context, task models.Task) error {
+    data, err := json.Marshal(task)
+    if err != nil {
+        return err
+    }
+
+    stream := streamName(task.Org, task.Priority)
+    if err := b.ensureGroup(ctx, stream); err != nil {
+        return err
+    }
+    return b.Client.XAdd(ctx, &redis.XAddArgs{
+        Stream: stream,
+        Values: map[string]interface{}{"task": data},
+    }).Err()
+}
+
+// Pop walks the streams from high to low priority. Within each stream it
+// first reclaims messages abandoned by other consumers, then reads new ones.
+func (b *StreamsBackend) Pop(ctx context.Context, org, consumer string) (*models.Task, error) {
+    for _, priority := range []int{3, 2, 1} {
+        stream := streamName(org, priority)
+        if err := b.ensureGroup(ctx, stream); err != nil {
+            return nil, err
+        }
+
+        msg, err := b.autoClaim(ctx, stream, consumer)
+        if err != nil {
+            return nil, err
+        }
+        if msg != nil {
+            return b.deliver(ctx, stream, *msg, true)
+        }
+
+        streams, err := b.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
+            Group:    streamGroup,
+            Consumer: consumer,
+            Streams:  []string{stream, ">"},
+            Count:    1,
+            Block:    -1,
+        }).Result()
+        if err == redis.Nil {
+            continue
+        } else if err != nil {
+            return nil, err
+        }
+        if len(streams) > 0 && len(streams[0].Messages) > 0 {
+            return b.deliver(ctx, stream, streams[0].Messages[0], false)
+        }
+    }
+    return nil, ErrEmpty
+}
+
+// autoClaim transfers one message that has been idle for ClaimIdle to the
+// consumer. The reply is parsed by hand because go-redis v8 only understands
+// the two-element reply of Redis 6.2, while Redis 7 appends a third element
+// listing deleted entries.
+func (b *StreamsBackend) autoClaim(ctx context.Context, stream, consumer string) (*redis.XMessage, error) {
+    reply, err := b.Client.Do(ctx, "XAUTOCLAIM", stream, streamGroup, consumer,
+        b.ClaimIdle.Milliseconds(), "0-0", "COUNT", 1).Slice()
+    if err != nil {
+        return nil, err
+    }
+    if len(reply) < 2 {
+        return nil, errors.New("unexpected XAUTOCLAIM reply")
+    }
+
+    entries, _ := reply[1].([]interface{})
+    for _, entry := range entries {
+        // Entries deleted while pending come back as nil on Redis 6.2
+        fields, ok := entry.([]interface{})
+        if !ok || len(fields) != 2 {
+            continue
+        }
+        id, _ := fields[0].(string)
+        pairs, _ := fields[1].([]interface{})
+
+        values := make(map[string]interface{}, len(pairs)/2)
+        for i := 0; i+1 < len(pairs); i += 2 {
+            key, _ := pairs[i].(string)
+            values[key] = pairs[i+1]
+        }
+        return &redis.XMessage{ID: id, Values: values}, nil
+    }
+    return nil, nil
+}
+
+// deliver decodes a message read from the stream. Messages that cannot be
+// decoded, and reclaimed ones that used up MaxDeliveries, are dead-lettered
+// so a poison message cannot circulate among the workers forever.
+func (b *StreamsBackend) deliver(ctx context.Context, stream string, msg redis.XMessage, reclaimed bool) (*models.Task, error) {
+    task, err := decodeMessage(stream, msg)
+    if err != nil {
+        return nil, b.deadLetter(ctx, stream, msg, nil, err.Error())
+    }
+    if !reclaimed || b.MaxDeliveries <= 0 {
+        return task, nil
+    }
+
+    pending, err := b.Client.XPendingExt(ctx, &redis.XPendingExtArgs{
+        Stream: stream,
+        Group:  streamGroup,
+        Start:  msg.ID,
+        End:    msg.ID,
+        Count:  1,
+    }).Result()
+    if err != nil {
+        return nil, err
+    }
+    if len(pending) > 0 && pending[0].RetryCount > int64(b.MaxDeliveries) {
+        reason := fmt.Sprintf("delivered %d times", pending[0].RetryCount)
+        return nil, b.deadLetter(ctx, stream, msg, task, reason)
+    }
+    return task, nil
+}
+
+// deadLetter copies the message to the dead-letter stream for inspection and
+// removes it from its stream. It returns the DeadLetterError for Pop.
+func (b *StreamsBackend) deadLetter(ctx context.Context, stream string, msg redis.XMessage, task *models.Task, reason string) error {
+    values := map[string]interface{}{"id": msg.ID, "reason": reason}
+    if data, ok := msg.Values["task"]; ok {
+        values["task"] = data
+    }
+    if err := b.Client.XAdd(ctx, &redis.XAddArgs{Stream: deadLetterStream(stream), Values: values}).Err(); err != nil {
+        return err
+    }
+    if err := b.Client.XAck(ctx, stream, streamGroup, msg.ID).Err(); err != nil {
+        return err
+    }
+    if err := b.Client.XDel(ctx, stream, msg.ID).Err(); err != nil {
+        return err
+    }
+    return &DeadLetterError{Task: task, Reason: reason}
+}
+
+// receipt splits the task's receipt into its stream and message ID.
+func (b *StreamsBackend) receipt(task *models.Task) (stream, id string, err error) {
+    i := strings.LastIndex(task.Receipt, "/")
+    if i < 0 {
+        return "", "", errors.New("task has no stream receipt")
+    }
+    stream, id = task.Receipt[:i], task.Receipt[i+1:]
+    if !b.ownsStream(task.Org, stream) {
+        return "", "", errors.New("receipt is not of the task's organization")
+    }
+    return stream, id, nil
+}
+
+// Ack acknowledges the delivery and removes the message from its stream.
+func (b *StreamsBackend) Ack(ctx context.Context, consumer string, task *models.Task) error {
+    stream, id, err := b.receipt(task)
+    if err != nil {
+        return err
+    }
+
+    if err := b.Client.XAck(ctx, stream, streamGroup, id).Err(); err != nil {
+        return err
+    }
+    return b.Client.XDel(ctx, stream, id).Err()
+}
+
+// extendScript resets the idle time of a pending message, but only while
+// the consumer still holds it: XCLAIM alone would take back a message that
+// another worker has already reclaimed. The delivery count is carried over
+// so heartbeats never count as deliveries.
+var extendScript = redis.NewScript(`
+local pending = redis.call("XPENDING", KEYS[1], ARGV[1], ARGV[2], ARGV[2], 1)
+if #pending == 0 or pending[1][2] ~= ARGV[3] then
+    return 0
+end
+redis.call("XCLAIM", KEYS[1], ARGV[1], ARGV[3], 0, ARGV[2], "RETRYCOUNT", pending[1][4], "JUSTID")
+return 1
+`)
+
+// Extend resets the idle time of the consumer's delivery so it is not
+// reclaimed while the consumer is still processing it.
+func (b *StreamsBackend) Extend(ctx context.Context, consumer string, task *models.Task) error {
+    stream, id, err := b.receipt(task)
+    if err != nil {
+        return err
+    }
+
+    held, err := extendScript.Run(ctx, b.Client, []string{stream}, streamGroup, id, consumer).Int()
+    if err != nil {
+        return err
+    }
+    if held == 0 {
+        return ErrLeaseLost
+    }
+    return nil
+}
+
+// ownsStream reports whether the stream is one of the organization's.
+func (b *StreamsBackend) ownsStream(org, stream string) bool {
+    for _, priority := range []int{3, 2, 1} {
+        if stream == streamName(org, priority) {
+            return true
+        }
+    }
+    return false
+}
+
+// Pending returns the number of unacknowledged deliveries held by each of the
+// organization's consumers across all priority streams.
+func (b *StreamsBackend) Pending(ctx context.Context, org string) (map[string]int64, error) {
+    pending := make(map[string]int64)
+    for _, priority := range []int{3, 2, 1} {
+        stream := streamName(org, priority)
+        if err := b.ensureGroup(ctx, stream); err != nil {
+            return nil, err
+        }
+        summary, err := b.Client.XPending(ctx, stream, streamGroup).Result()
+        if err != nil {
+            return nil, err
+        }
+        for consumer, count := range summary.Consumers {
+            pending[consumer] += count
+        }
+    }
+    return pending, nil
+}
+
+// Depths counts the entries in each stream. Acknowledged messages are
+// deleted, so this includes tasks that are delivered but still pending.
+func (b *StreamsBackend) Depths(ctx context.Context, org string) (map[string]int64, error) {
+    depths := make(map[string]int64)
+    for _, priority := range []int{3, 2, 1} {
+        n, err := b.Client.XLen(ctx, streamName(org, priority)).Result()
+        if err != nil {
+            return nil, err
+        }
+        depths[PriorityName(priority)] = n
+    }
+    return depths, nil
+}
+
+func decodeMessage(stream string, msg redis.XMessage) (*models.Task, error) {
+    data, ok := msg.Values["task"].(string)
+    if !ok {
+        return nil, errors.New("stream message " + msg.ID + " has no task payload")
+    }
+
+    var task models.Task
+    if err := json.Unmarshal([]byte(data), &task); err != nil {
+        return nil, err
+    }
+    task.Receipt = stream + "/" + msg.ID
+    return &task, nil
+}
@@ -0,0 +1,38 @@
+package workers
+
+import (
+    "context"
+    "errors"
+    "math/rand"
+    "task_queue_system/models"
+    "time"
+)
+
+// Handler processes a single task. Returning an error marks the attempt as
+// failed and the worker re-enqueues the task until MaxRetries is reached.
+type Handler interface {
+    ProcessTask(ctx context.Context, task *models.Task) error
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(ctx context.Context, task *models.Task) error
+
+func (f HandlerFunc) ProcessTask(ctx context.Context, task *models.Task) error {
+    return f(ctx, task)
+}
+
+// SimulatedHandler stands in for real work in the standalone server: it
+// fails a quarter of the attempts and otherwise takes two seconds.
+var SimulatedHandler = HandlerFunc(func(ctx context.Context, task *models.Task) error {
+    if rand.Intn(4) == 0 { // 25% chance to fail
+        return errors.New("simulated failure")
+    }
+
+    // Simulate task processing time
+    select {
+    case <-ctx.Done():
+        return ctx.Err()
+    case <-time.After(2 * time.Second):
+        return nil
+    }
+})
@@ -2,8 +2,6 @@ package workers
 
 import (
     "context"
-    "database/sql"
-    "math/rand"
     "task_queue_system/db"
     "task_queue_system/models"
     "task_queue_system/queue"
@@ -38,31 +36,39 @@ func init() {
 
 const MaxRetries = 3
 
+// Worker processes the tasks of a single organization.
 type Worker struct {
-    ID    string
-    Queue *queue.Queue
-    db    *sql.DB
+    ID      string
+    Org     string
+    Queue   *queue.Queue
+    Handler Handler
+    store   db.Store
 }
 
-func NewWorker(id string, queue *queue.Queue, db *sql.DB) *Worker {
-    return &Worker{ID: id, Queue: queue, db: db}
+func NewWorker(id, org string, queue *queue.Queue, store db.Store, handler Handler) *Worker {
+    return &Worker{ID: id, Org: org, Queue: queue, Handler: handler, store: store}
 }
 
 func (w *Worker) Register() {
-    // Register the worker in Redis
-    ctx := context.Background()
-    w.Queue.Client.HSet(ctx, "workers", w.ID, "active")
+    // Register the worker with the queue backend
+    if err := w.Queue.RegisterWorker(w.Org, w.ID); err != nil {
+        log.WithField("worker", w.ID).WithError(err).Error("Failed to register worker")
+    }
     log.WithField("worker", w.ID).Info("Worker registered")
 }
 
 func (w *Worker) Deregister() {
-    // Deregister the worker from Redis
-    ctx := context.Background()
-    w.Queue.Client.HDel(ctx, "workers", w.ID)
+    // Deregister the worker from the queue backend
+    if err := w.Queue.DeregisterWorker(w.Org, w.ID); err != nil {
+        log.WithField("worker", w.ID).WithError(err).Error("Failed to deregister worker")
+    }
     log.WithField("worker", w.ID).Info("Worker deregistered")
 }
 
-func (w *Worker) Start(stopChan chan struct{}) {
+// Start processes tasks until stopChan is closed or ctx is done. Closing
+// stopChan lets the current task finish; handlers get ctx, so cancelling it
+// also interrupts the current task, which goes back to the queue.
+func (w *Worker) Start(ctx context.Context, stopChan <-chan struct{}) {
     w.Register()
     defer w.Deregister()
 
@@ -71,35 +77,120 @@ func (w *Worker) Start(stopChan chan struct{}) {
         case <-stopChan:
             log.WithField("worker", w.ID).Info("Worker stopping gracefully")
             return
+        case <-ctx.Done():
+            log.WithField("worker", w.ID).Info("Worker cancelled")
+            return
         default:
-            task, err := w.Queue.Dequeue()
+            task, err := w.Queue.Dequeue(w.Org, w.ID)
             if err != nil {
-                time.Sleep(1 * time.Second)
+                w.Queue.Wait(1 * time.Second)
                 continue
             }
 
-            w.processTask(task)
+            w.processTask(ctx, task)
+            w.Acknowledge(task)
         }
     }
 }
 
-func (w *Worker) processTask(task *models.Task) {
+func (w *Worker) processTask(ctx context.Context, task *models.Task) {
     startTime := time.Now()
+    if !w.Claim(task) {
+        return
+    }
+
     log.WithFields(log.Fields{
         "worker": w.ID,
         "task":   task.ID,
     }).Info("Processing task")
 
-    // Simulate task processing with a random failure
-    if rand.Intn(4) == 0 { // 25% chance to fail
+    // The heartbeat reads its own copy, as the handler may modify the task
+    held := *task
+    done := make(chan struct{})
+    go w.heartbeat(&held, done)
+    err := w.Handler.ProcessTask(ctx, task)
+    close(done)
+    if err != nil && ctx.Err() != nil {
+        // Cut short by shutdown rather than failed
+        w.Requeue(task)
+    } else {
+        w.Finish(task, err)
+    }
+
+    duration := time.Since(startTime).Seconds()
+    taskProcessingTime.Observe(duration)
+}
+
+// heartbeat extends the worker's hold on the task every HeartbeatInterval
+// until done is closed, so a long-running handler does not see its task
+// reclaimed and run a second time by another worker.
+func (w *Worker) heartbeat(task *models.Task, done <-chan struct{}) {
+    if w.Queue.HeartbeatInterval <= 0 {
+        return
+    }
+    ticker := time.NewTicker(w.Queue.HeartbeatInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-done:
+            return
+        case <-ticker.C:
+            if err := w.Queue.Extend(w.ID, task); err != nil {
+                log.WithFields(log.Fields{
+                    "worker": w.ID,
+                    "task":   task.ID,
+                }).WithError(err).Warn("Failed to extend task delivery")
+            }
+        }
+    }
+}
+
+// Claim marks a delivered task as running. A delivery reclaimed from a
+// crashed worker is still running and may be claimed again; anything else
+// (e.g. a cancelled task) returns false and must be skipped.
+func (w *Worker) Claim(task *models.Task) bool {
+    claimed, err := w.store.TransitionTaskStatus(task.ID, []string{"pending", "running"}, "running")
+    if err != nil {
+        log.WithFields(log.Fields{
+            "worker": w.ID,
+            "task":   task.ID,
+        }).WithError(err).Error("Failed to claim task")
+        return false
+    }
+    if !claimed {
+        log.WithFields(log.Fields{
+            "worker": w.ID,
+            "task":   task.ID,
+        }).Info("Skipping task that is no longer pending")
+        return false
+    }
+    task.Status = "running"
+    return true
+}
+
+// Finish records the outcome of an attempt. A failed attempt is re-enqueued
+// until the task has used MaxRetries attempts and is then marked failed.
+func (w *Worker) Finish(task *models.Task, err error) {
+    if err != nil {
         log.WithFields(log.Fields{
             "worker": w.ID,
             "task":   task.ID,
-        }).Warn("Failed to process task")
+        }).WithError(err).Warn("Failed to process task")
         task.Retries++
+        // Remote workers' tasks are loaded from the store on every ack, so
+        // the count must be stored for them to ever run out of attempts
+        if err := w.store.UpdateTaskRetries(task.ID, task.Retries); err != nil {
+            log.WithFields(log.Fields{
+                "worker": w.ID,
+                "task":   task.ID,
+            }).WithError(err).Error("Failed to record task retries")
+        }
 
         if task.Retries < MaxRetries {
-            if err := w.Queue.Enqueue(*task); err != nil {
+            task.Status = "pending"
+            w.store.UpdateTaskStatus(task.ID, "pending")
+            if err := w.Queue.Enqueue(context.Background(), *task); err != nil {
                 log.WithFields(log.Fields{
                     "worker": w.ID,
                     "task":   task.ID,
@@ -107,21 +198,53 @@ func (w *Worker) processTask(task *models.Task) {
             }
         } else {
             task.Status = "failed"
-            db.UpdateTaskStatus(w.db, task.ID, "failed")
+            w.store.UpdateTaskStatus(task.ID, "failed")
             tasksProcessed.WithLabelValues("failed").Inc()
         }
     } else {
-        // Simulate task processing time
-        time.Sleep(2 * time.Second)
         task.Status = "completed"
-        db.UpdateTaskStatus(w.db, task.ID, "completed")
+        w.store.UpdateTaskStatus(task.ID, "completed")
         tasksProcessed.WithLabelValues("completed").Inc()
         log.WithFields(log.Fields{
             "worker": w.ID,
             "task":   task.ID,
         }).Info("Completed task")
     }
+}
 
-    duration := time.Since(startTime).Seconds()
-    taskProcessingTime.Observe(duration)
+// Requeue returns a claimed task to the queue without counting the attempt,
+// e.g. when shutdown interrupts it. Backends without leases would otherwise
+// leave it running forever.
+func (w *Worker) Requeue(task *models.Task) {
+    ok, err := w.store.TransitionTaskStatus(task.ID, []string{"running"}, "pending")
+    if err != nil || !ok {
+        log.WithFields(log.Fields{
+            "worker": w.ID,
+            "task":   task.ID,
+        }).WithError(err).Error("Failed to requeue task")
+        return
+    }
+    task.Status = "pending"
+    if err := w.Queue.Enqueue(context.Background(), *task); err != nil {
+        log.WithFields(log.Fields{
+            "worker": w.ID,
+            "task":   task.ID,
+        }).WithError(err).Error("Failed to requeue task")
+        return
+    }
+    log.WithFields(log.Fields{
+        "worker": w.ID,
+        "task":   task.ID,
+    }).Info("Requeued interrupted task")
+}
+
+// Acknowledge releases the delivery once the outcome is recorded, so a crash
+// mid-task leaves it pending for another worker.
+func (w *Worker) Acknowledge(task *models.Task) {
+    if err := w.Queue.Ack(w.ID, task); err != nil {
+        log.WithFields(log.Fields{
+            "worker": w.ID,
+            "task":   task.ID,
+        }).WithError(err).Error("Failed to acknowledge task")
+    }
 }